@@ -1,20 +1,30 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"strings"
 	"syscall"
 
+	dbmigrations "github.com/awhdesmond/user-service/db"
+	"github.com/awhdesmond/user-service/docs"
 	"github.com/awhdesmond/user-service/pkg/api"
 	"github.com/awhdesmond/user-service/pkg/common"
 	"github.com/awhdesmond/user-service/pkg/users"
+	"github.com/awhdesmond/user-service/pkg/users/pb"
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 
 	"github.com/spf13/viper"
+	"github.com/upper/db/v4"
 	"go.uber.org/zap"
 )
 
@@ -22,6 +32,7 @@ const (
 	cfgFlagHost        = "host"
 	cfgFlagPort        = "port"
 	cfgFlagMetricsPort = "metrics-port"
+	cfgFlagGRPCPort    = "grpc-port"
 	cfgFlagLogLevel    = "log-level"
 	cfgFlagCORSOrigin  = "cors-origin"
 
@@ -30,26 +41,102 @@ const (
 	cfgFlagPostgresDatabase = "postgres-database"
 	cfgFlagPostgresUsername = "postgres-username"
 	cfgFlagPostgresPassword = "postgres-password"
+	// cfgFlagPostgresReplicaHosts is a comma-separated list of host[:port]
+	cfgFlagPostgresReplicaHosts = "postgres-replica-hosts"
+
+	cfgFlagPostgresMaxOpenConns     = "postgres-max-open-conns"
+	cfgFlagPostgresMaxIdleConns     = "postgres-max-idle-conns"
+	cfgFlagPostgresConnMaxLifetime  = "postgres-conn-max-lifetime"
+	cfgFlagPostgresConnMaxIdleTime  = "postgres-conn-max-idle-time"
+	cfgFlagPostgresSSLMode          = "postgres-sslmode"
+	cfgFlagPostgresSSLRootCert      = "postgres-sslrootcert"
+	cfgFlagPostgresSSLCert          = "postgres-sslcert"
+	cfgFlagPostgresSSLKey           = "postgres-sslkey"
+	cfgFlagPostgresApplicationName  = "postgres-application-name"
+	cfgFlagPostgresStatementTimeout = "postgres-statement-timeout"
+
+	cfgFlagReadYourWritesWindow = "read-your-writes-window"
+
+	cfgFlagSQLitePath = "sqlite-path"
 
 	cfgFlagRedisURI         = "redis-uri"
 	cfgFlagRedisPassword    = "redis-password"
 	cfgFlagRedisClusterMode = "redis-cluster-mode"
+	// cfgFlagRedisSentinelAddrs is a comma-separated list of host:port
+	cfgFlagRedisSentinelAddrs      = "redis-sentinel-addrs"
+	cfgFlagRedisSentinelMasterName = "redis-sentinel-master-name"
+	cfgFlagRedisSentinelPassword   = "redis-sentinel-password"
+	cfgFlagRedisDB                 = "redis-db"
+	cfgFlagRedisPoolSize           = "redis-pool-size"
+	cfgFlagRedisMinIdleConns       = "redis-min-idle-conns"
+	cfgFlagRedisPoolTimeout        = "redis-pool-timeout"
+	cfgFlagRedisDialTimeout        = "redis-dial-timeout"
+	cfgFlagRedisReadTimeout        = "redis-read-timeout"
+	cfgFlagRedisWriteTimeout       = "redis-write-timeout"
+	cfgFlagRedisTLS                = "redis-tls"
+	cfgFlagRedisTLSCACert          = "redis-tls-ca-cert"
+	cfgFlagRedisTLSServerName      = "redis-tls-server-name"
+	cfgFlagRedisTLSCert            = "redis-tls-cert"
+	cfgFlagRedisTLSKey             = "redis-tls-key"
+
+	cfgFlagStore         = "store"
+	cfgFlagStoreSeedFile = "store-seed-file"
+
+	cfgFlagLocalCacheSize = "local-cache-size"
+	cfgFlagLocalCacheTTL  = "local-cache-ttl"
+
+	cfgFlagNotFoundCacheTTL    = "not-found-cache-ttl"
+	cfgFlagBloomFilterInterval = "bloom-filter-interval"
+
+	cfgFlagCacheWriteWorkers   = "cache-write-workers"
+	cfgFlagCacheWriteQueueSize = "cache-write-queue-size"
+	cfgFlagCacheWriteTimeout   = "cache-write-timeout"
+
+	cfgFlagCacheCodec       = "cache-codec"
+	cfgFlagCacheCompression = "cache-compression"
+
+	cfgFlagOpenAPIValidateRequests  = "openapi-validate-requests"
+	cfgFlagOpenAPIValidateResponses = "openapi-validate-responses"
+	cfgFlagSwaggerUI                = "swagger-ui"
+
+	cfgFlagIdempotencyTTL = "idempotency-ttl"
+
+	cfgFlagAdminToken = "admin-token"
+
+	cfgFlagKeyringFile = "keyring-file"
+
+	cfgFlagLogRedaction       = "log-redaction"
+	cfgFlagLogRedactionKey    = "log-redaction-key"
+	cfgFlagLogRedactionFields = "log-redaction-fields"
+	cfgFlagLogRedactionPaths  = "log-redaction-paths"
 
 	envVarPrefix = "USERS_SVC"
 
 	defaultApiPort     = "8080"
 	defaultMetricsPort = "9090"
+	defaultGRPCPort    = "9000"
 	defaultLogLevel    = "info"
 	defaultCORSOrigin  = "*"
+
+	defaultPostgresApplicationName = "user-service"
 )
 
 type ServerConfig struct {
 	common.PostgresSQLConfig `mapstructure:",squash"`
+	common.SQLiteConfig      `mapstructure:",squash"`
 	common.RedisCfg          `mapstructure:",squash"`
+	users.StoreConfig        `mapstructure:",squash"`
+	api.OpenAPIConfig        `mapstructure:",squash"`
+	api.IdempotencyConfig    `mapstructure:",squash"`
+	api.AdminConfig          `mapstructure:",squash"`
+	api.ReadYourWritesConfig `mapstructure:",squash"`
+	common.KeyringConfig     `mapstructure:",squash"`
+	common.RedactionPolicy   `mapstructure:",squash"`
 
 	Host        string `mapstructure:"host"`
 	Port        string `mapstructure:"port"`
 	MetricsPort string `mapstructure:"metrics-port"`
+	GRPCPort    string `mapstructure:"grpc-port"`
 	CORSOrigin  string `mapstructure:"cors-origin"`
 }
 
@@ -57,6 +144,9 @@ func (cfg ServerConfig) RedactedString() string {
 	tmp := cfg
 	tmp.PostgresSQLConfig.Password = "***"
 	tmp.RedisCfg.Password = "***"
+	tmp.RedisCfg.SentinelPassword = "***"
+	tmp.RedactionPolicy.Key = "***"
+	tmp.AdminConfig.AdminToken = "***"
 	return fmt.Sprintf("%+v", tmp)
 }
 
@@ -68,10 +158,15 @@ func (cfg ServerConfig) HTTPMetricsBindAddress() string {
 	return fmt.Sprintf("%s:%s", cfg.Host, cfg.MetricsPort)
 }
 
+func (cfg ServerConfig) GRPCBindAddress() string {
+	return fmt.Sprintf("%s:%s", cfg.Host, cfg.GRPCPort)
+}
+
 func main() {
 	viper.SetDefault(cfgFlagHost, "")
 	viper.SetDefault(cfgFlagPort, defaultApiPort)
 	viper.SetDefault(cfgFlagMetricsPort, defaultMetricsPort)
+	viper.SetDefault(cfgFlagGRPCPort, defaultGRPCPort)
 	viper.SetDefault(cfgFlagLogLevel, defaultLogLevel)
 	viper.SetDefault(cfgFlagCORSOrigin, defaultCORSOrigin)
 
@@ -80,18 +175,80 @@ func main() {
 	viper.SetDefault(cfgFlagPostgresDatabase, "")
 	viper.SetDefault(cfgFlagPostgresUsername, "")
 	viper.SetDefault(cfgFlagPostgresPassword, "")
+	viper.SetDefault(cfgFlagPostgresReplicaHosts, []string{})
+	viper.SetDefault(cfgFlagPostgresMaxOpenConns, 0)
+	viper.SetDefault(cfgFlagPostgresMaxIdleConns, 0)
+	viper.SetDefault(cfgFlagPostgresConnMaxLifetime, 0)
+	viper.SetDefault(cfgFlagPostgresConnMaxIdleTime, 0)
+	viper.SetDefault(cfgFlagPostgresSSLMode, "")
+	viper.SetDefault(cfgFlagPostgresSSLRootCert, "")
+	viper.SetDefault(cfgFlagPostgresSSLCert, "")
+	viper.SetDefault(cfgFlagPostgresSSLKey, "")
+	viper.SetDefault(cfgFlagPostgresApplicationName, defaultPostgresApplicationName)
+	viper.SetDefault(cfgFlagPostgresStatementTimeout, 0)
+	viper.SetDefault(cfgFlagReadYourWritesWindow, api.DefaultReadYourWritesWindow)
+
+	viper.SetDefault(cfgFlagSQLitePath, "")
 
 	viper.SetDefault(cfgFlagRedisURI, "")
 	viper.SetDefault(cfgFlagRedisPassword, "")
 	viper.SetDefault(cfgFlagRedisClusterMode, "")
+	viper.SetDefault(cfgFlagRedisSentinelAddrs, []string{})
+	viper.SetDefault(cfgFlagRedisSentinelMasterName, "")
+	viper.SetDefault(cfgFlagRedisSentinelPassword, "")
+	viper.SetDefault(cfgFlagRedisDB, 0)
+	viper.SetDefault(cfgFlagRedisPoolSize, 0)
+	viper.SetDefault(cfgFlagRedisMinIdleConns, 0)
+	viper.SetDefault(cfgFlagRedisPoolTimeout, 0)
+	viper.SetDefault(cfgFlagRedisDialTimeout, 0)
+	viper.SetDefault(cfgFlagRedisReadTimeout, 0)
+	viper.SetDefault(cfgFlagRedisWriteTimeout, 0)
+	viper.SetDefault(cfgFlagRedisTLS, false)
+	viper.SetDefault(cfgFlagRedisTLSCACert, "")
+	viper.SetDefault(cfgFlagRedisTLSServerName, "")
+	viper.SetDefault(cfgFlagRedisTLSCert, "")
+	viper.SetDefault(cfgFlagRedisTLSKey, "")
+
+	viper.SetDefault(cfgFlagStore, users.StoreBackendPostgres)
+	viper.SetDefault(cfgFlagStoreSeedFile, "")
+
+	viper.SetDefault(cfgFlagLocalCacheSize, 0)
+	viper.SetDefault(cfgFlagLocalCacheTTL, users.DefaultLocalCacheTTL)
+	viper.SetDefault(cfgFlagNotFoundCacheTTL, users.DefaultNotFoundCacheTTL)
+	viper.SetDefault(cfgFlagBloomFilterInterval, 0)
+
+	viper.SetDefault(cfgFlagCacheWriteWorkers, users.DefaultCacheWriteWorkers)
+	viper.SetDefault(cfgFlagCacheWriteQueueSize, users.DefaultCacheWriteQueueSize)
+	viper.SetDefault(cfgFlagCacheWriteTimeout, users.DefaultCacheWriteTimeout)
+
+	viper.SetDefault(cfgFlagCacheCodec, users.CacheCodecJSON)
+	viper.SetDefault(cfgFlagCacheCompression, users.CacheCompressionNone)
+
+	viper.SetDefault(cfgFlagOpenAPIValidateRequests, false)
+	viper.SetDefault(cfgFlagOpenAPIValidateResponses, false)
+	viper.SetDefault(cfgFlagSwaggerUI, false)
+
+	viper.SetDefault(cfgFlagIdempotencyTTL, api.DefaultIdempotencyTTL)
+	viper.SetDefault(cfgFlagAdminToken, "")
+
+	viper.SetDefault(cfgFlagKeyringFile, "")
+
+	viper.SetDefault(cfgFlagLogRedaction, common.DefaultRedactionPolicy.Mode)
+	viper.SetDefault(cfgFlagLogRedactionKey, "")
+	viper.SetDefault(cfgFlagLogRedactionFields, common.DefaultRedactionFields)
+	viper.SetDefault(cfgFlagLogRedactionPaths, common.DefaultRedactionPaths)
 
 	viper.SetEnvPrefix(envVarPrefix)
 	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
 	viper.AutomaticEnv()
 
+	// the redaction policy is part of the config, so the error is logged once there is a logger
+	var srvCfg ServerConfig
+	cfgErr := viper.Unmarshal(&srvCfg)
+
 	// Logger
 
-	logger, _ := common.InitZap(viper.GetString(cfgFlagLogLevel))
+	logger, _ := common.InitZapWithPolicy(viper.GetString(cfgFlagLogLevel), srvCfg.RedactionPolicy)
 	defer func() {
 		err := logger.Sync()
 		if err != nil && !errors.Is(err, syscall.ENOTTY) {
@@ -100,18 +257,40 @@ func main() {
 	}()
 	defer zap.RedirectStdLog(logger)
 
-	var srvCfg ServerConfig
-	if err := viper.Unmarshal(&srvCfg); err != nil {
-		logger.Panic("config unmarshal failed", zap.Error(err))
+	if cfgErr != nil {
+		logger.Panic("config unmarshal failed", zap.Error(cfgErr))
 	}
 
 	logger.Info("server configuration", zap.String("config", srvCfg.RedactedString()))
 
-	// Make Server
-	apiSrv, err := makeAPIServer(srvCfg, logger)
+	sess, migrator, err := makeDB(srvCfg)
+	if err != nil {
+		logger.Panic("error initialising database", zap.Error(err))
+	}
+	if args := os.Args[1:]; len(args) > 0 && args[0] == "migrate" {
+		if err := runMigrate(context.Background(), migrator, args[1:], os.Stdout); err != nil {
+			logger.Fatal("migrate failed", zap.Error(err))
+		}
+		return
+	}
+
+	// Make Servers
+	// Redis is optional with SQLite, and not used by the memory store
+	var rdb redis.UniversalClient
+	if srvCfg.Backend == users.StoreBackendPostgres || srvCfg.Backend == users.StoreBackendSQLite && srvCfg.RedisCfg.Enabled() {
+		if rdb, err = common.MakeRedisClient(srvCfg.RedisCfg); err != nil {
+			logger.Panic("error initialising redis client", zap.Error(err))
+		}
+	}
+	svc, store, events, err := makeService(srvCfg, sess, rdb, logger)
+	if err != nil {
+		logger.Panic("error initialising users service", zap.Error(err))
+	}
+	apiSrv, err := makeAPIServer(srvCfg, migrator, svc, store, events, rdb, logger)
 	if err != nil {
 		logger.Panic("error initialising api server", zap.Error(err))
 	}
+	grpcSrv, grpcHealth := makeGRPCServer(svc)
 
 	// Run Servers
 	go func() {
@@ -121,12 +300,29 @@ func main() {
 			zap.String("commit", common.GitCommit),
 			zap.String("version", common.Version),
 		)
-		if err := http.ListenAndServe(srvCfg.HTTPBindAddress(), apiSrv.Handler); err != nil {
+		// Shutdown makes ListenAndServe return http.ErrServerClosed
+		if err := apiSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			logger.Panic("error starting api server", zap.Error(err))
 			os.Exit(1)
 		}
 	}()
 
+	go func() {
+		logger.Info("starting grpc server",
+			zap.String("host", srvCfg.Host),
+			zap.String("port", srvCfg.GRPCPort),
+		)
+		lis, err := net.Listen("tcp", srvCfg.GRPCBindAddress())
+		if err != nil {
+			logger.Panic("error starting grpc server", zap.Error(err))
+			os.Exit(1)
+		}
+		if err := grpcSrv.Serve(lis); err != nil {
+			logger.Panic("error starting grpc server", zap.Error(err))
+			os.Exit(1)
+		}
+	}()
+
 	go func() {
 		logger.Info("starting metrics server")
 		http.Handle("/metrics", promhttp.Handler())
@@ -139,22 +335,105 @@ func main() {
 	// graceful shutdown
 	stopCh := api.SetupSignalHandler()
 	sd, _ := api.NewShutdown(logger)
-	sd.Graceful(stopCh, apiSrv)
+	// end the event streams along with the HTTP server, the store is drained
+	// once the servers stopped
+	sd.CloseOnShutdown(apiSrv, events)
+	sd.Graceful(stopCh, apiSrv, grpcSrv, grpcHealth, store)
 }
 
-func makeAPIServer(cfg ServerConfig, logger *zap.Logger) (*http.Server, error) {
-	pgSess, err := common.MakePostgresDBSession(cfg.PostgresSQLConfig)
+// makeDB opens the database of the configured store along with its
+// migrations. Both are nil for the memory store.
+func makeDB(cfg ServerConfig) (db.Session, *common.Migrator, error) {
+	var sess db.Session
+	var err error
+	migrations := dbmigrations.Postgres
+	switch cfg.Backend {
+	case users.StoreBackendPostgres:
+		sess, err = common.MakePostgresDBSession(cfg.PostgresSQLConfig)
+	case users.StoreBackendSQLite:
+		sess, err = common.MakeSQLiteDBSession(cfg.SQLiteConfig)
+		migrations = dbmigrations.SQLite
+	case users.StoreBackendMemory:
+		return nil, nil, nil
+	default:
+		return nil, nil, users.ErrStoreBackendInvalid
+	}
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	rdb, err := common.MakeRedisClient(cfg.RedisCfg)
+
+	migrator, err := common.NewMigrator(sess, migrations)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	return sess, migrator, nil
+}
+
+// makeService makes the service over the configured store. The events
+// are kept in process when rdb is nil.
+func makeService(
+	cfg ServerConfig,
+	sess db.Session,
+	rdb redis.UniversalClient,
+	logger *zap.Logger,
+) (users.Service, users.Store, users.EventBroker, error) {
+	if err := cfg.StoreConfig.Validate(); err != nil {
+		return nil, nil, nil, err
+	}
+	var err error
+	if cfg.StoreConfig.Keyring, err = common.LoadKeyring(cfg.KeyringConfig); err != nil {
+		return nil, nil, nil, err
+	}
+	events := users.NewMemoryEventBroker()
+	if rdb != nil {
+		events = users.NewRedisEventBroker(rdb, logger)
+	}
+
+	var store users.Store
+	switch cfg.Backend {
+	case users.StoreBackendPostgres:
+		cfg.StoreConfig.Replicas = common.MakePostgresReplicaSessions(cfg.PostgresSQLConfig, logger)
+		store = users.NewStore(sess, rdb, events, cfg.StoreConfig, logger)
+	case users.StoreBackendSQLite:
+		store = users.NewSQLiteStore(sess, rdb, events, cfg.StoreConfig, logger)
+	case users.StoreBackendMemory:
+		store = users.NewMemoryStore(events, logger)
+	default:
+		return nil, nil, nil, users.ErrStoreBackendInvalid
 	}
 
-	store := users.NewStore(pgSess, rdb, logger)
 	svc := users.NewDefaultService(store)
+	if cfg.SeedFile != "" {
+		n, err := users.SeedFromFile(context.Background(), svc, cfg.SeedFile)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		logger.Info("seeded users", zap.String("file", cfg.SeedFile), zap.Int("users", n))
+	}
+	return svc, store, events, nil
+}
+
+// makeAPIServer refuses to make the server when migrator has pending migrations
+func makeAPIServer(
+	cfg ServerConfig,
+	migrator *common.Migrator,
+	svc users.Service,
+	store users.Store,
+	events users.EventBroker,
+	rdb redis.UniversalClient,
+	logger *zap.Logger,
+) (*http.Server, error) {
+	if migrator != nil {
+		if err := migrator.Check(context.Background()); err != nil {
+			return nil, err
+		}
+	}
+
 	handler := users.MakeHandler(svc)
+	openapi, err := api.NewOpenAPI(docs.OpenAPISpec, logger)
+	if err != nil {
+		return nil, err
+	}
 
 	r := mux.NewRouter()
 	securityMW := api.NewSecureHeadersMiddleware(cfg.CORSOrigin)
@@ -166,9 +445,59 @@ func makeAPIServer(cfg ServerConfig, logger *zap.Logger) (*http.Server, error) {
 	r.Use(wrwMW.Handler)
 	r.Use(loggingMW.Handler)
 	r.Use(metricsMW.Handler)
+	if cfg.ValidateRequests || cfg.ValidateResponses {
+		r.Use(api.NewOpenAPIValidationMiddleware(openapi, cfg.OpenAPIConfig).Handler)
+	}
+	// replicas serve the reads, so clients read from the primary after they write
+	if cfg.Backend == users.StoreBackendPostgres && len(cfg.ReplicaHosts) > 0 {
+		r.Use(api.NewReadYourWritesMiddleware(cfg.ReadYourWritesConfig).Handler)
+	}
+	// responses are stored in Redis, so writes are not idempotent without it
+	if rdb != nil {
+		r.Use(api.NewIdempotencyMiddleware(rdb, cfg.IdempotencyConfig, logger).Handler)
+	}
 
+	// the service keeps serving from the db while the cache is unavailable
+	var readiness []api.ReadinessCheck
+	if checker, ok := store.(users.CacheHealthChecker); ok && rdb != nil {
+		readiness = append(readiness, api.ReadinessCheck{Name: "cache", Check: checker.CacheHealth})
+	}
 	r.HandleFunc("/healthz", api.HealthzHandler)
+	r.HandleFunc("/readyz", api.NewReadyzHandler(readiness...))
+	r.HandleFunc(api.OpenAPIPath, openapi.SpecHandler).Methods(http.MethodGet)
+	if cfg.SwaggerUI {
+		r.PathPrefix(api.SwaggerUIPath).Handler(openapi.SwaggerUIHandler()).Methods(http.MethodGet)
+	}
+
+	// data subject requests and events expose the data of any user, so only operators may send them
+	adminMW := api.NewAdminAuthMiddleware(cfg.AdminConfig)
+	adminHandler := adminMW.Handler(handler)
+	for _, prefix := range []string{users.APIV1Prefix, ""} {
+		r.Handle(prefix+"/hello/{username}/export", adminHandler).Methods(http.MethodGet)
+		r.Handle(prefix+"/hello/{username}/erase", adminHandler).Methods(http.MethodPost)
+	}
+
+	eventsHandler := adminMW.Handler(users.MakeEventsHandler(events, logger))
+	r.Handle(users.APIV1Prefix+"/events", eventsHandler).Methods(http.MethodGet)
+	r.PathPrefix(users.APIV1Prefix).Handler(handler)
+
+	// deprecated aliases of /v1
+	r.Handle("/events", users.NewLegacyRoutesMiddleware().Handler(eventsHandler)).Methods(http.MethodGet)
 	r.PathPrefix("/hello").Handler(handler)
+	r.Handle("/birthdays", handler)
+	r.Handle("/birthdays.ics", handler)
 
 	return &http.Server{Handler: r, Addr: cfg.HTTPBindAddress()}, nil
 }
+
+func makeGRPCServer(svc users.Service) (*grpc.Server, *health.Server) {
+	srv := grpc.NewServer()
+	pb.RegisterUsersServer(srv, users.MakeGRPCServer(svc))
+
+	healthSrv := health.NewServer()
+	healthSrv.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	healthSrv.SetServingStatus(users.GRPCServiceName, healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(srv, healthSrv)
+
+	return srv, healthSrv
+}
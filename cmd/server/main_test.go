@@ -11,18 +11,27 @@ import (
 	"time"
 
 	"github.com/awhdesmond/user-service/pkg/common"
+	"github.com/awhdesmond/user-service/pkg/users"
+	"github.com/awhdesmond/user-service/pkg/users/pb"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/suite"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
 )
 
 const (
 	testPort       = "18080"
 	testMetricPort = "19090"
+	testGRPCPort   = "19000"
 )
 
 var (
 	envPort       = ""
 	envMetricPort = ""
+	envGRPCPort   = ""
 )
 
 type testSuite struct {
@@ -32,9 +41,11 @@ type testSuite struct {
 func (ts *testSuite) SetupSuite() {
 	envPort = os.Getenv("USERS_SVC_PORT")
 	envMetricPort = os.Getenv("USERS_SVC_METRICS_PORT")
+	envGRPCPort = os.Getenv("USERS_SVC_GRPC_PORT")
 
 	os.Setenv("USERS_SVC_PORT", testPort)
 	os.Setenv("USERS_SVC_METRICS_PORT", testMetricPort)
+	os.Setenv("USERS_SVC_GRPC_PORT", testGRPCPort)
 	os.Setenv("USERS_SVC_POSTGRES_HOST", "localhost")
 	os.Setenv("USERS_SVC_POSTGRES_PORT", "5432")
 	os.Setenv("USERS_SVC_POSTGRES_USERNAME", "postgres")
@@ -72,6 +83,7 @@ func (ts *testSuite) TearDownSuite() {
 	// Set back env vars
 	os.Setenv("USERS_SVC_PORT", envPort)
 	os.Setenv("USERS_SVC_METRICS_PORT", envMetricPort)
+	os.Setenv("USERS_SVC_GRPC_PORT", envGRPCPort)
 }
 
 type ApiTestSuite struct {
@@ -85,6 +97,9 @@ func TestApiTestSuite(t *testing.T) {
 func (ts *ApiTestSuite) Test() {
 	ts.testUpsertAndRead()
 	ts.testHealth()
+	ts.testOpenAPI()
+	ts.testGRPCUpsertAndRead()
+	ts.testGRPCHealth()
 }
 
 func (ts *ApiTestSuite) testUpsertAndRead() {
@@ -96,7 +111,7 @@ func (ts *ApiTestSuite) testUpsertAndRead() {
 	bodyReader := bytes.NewReader(jsonBody)
 	req, err := http.NewRequest(
 		http.MethodPut,
-		fmt.Sprintf("http://localhost:%s/hello/apple", testPort),
+		fmt.Sprintf("http://localhost:%s/v1/hello/apple", testPort),
 		bodyReader,
 	)
 	if err != nil {
@@ -129,6 +144,10 @@ func (ts *ApiTestSuite) testUpsertAndRead() {
 	if res.StatusCode != http.StatusOK {
 		ts.T().Fatalf("got %v, want = %v", res.StatusCode, http.StatusNoContent)
 	}
+	// the unversioned route is a deprecated alias of /v1
+	if res.Header.Get("Deprecation") == "" {
+		ts.T().Fatalf("got %v, want = %v", res.Header.Get("Deprecation"), "@<timestamp>")
+	}
 
 	var bodyResp struct {
 		Message string `json:"message"`
@@ -163,3 +182,78 @@ func (ts *ApiTestSuite) testHealth() {
 		ts.T().Fatalf("got %v, want = %v", res.StatusCode, http.StatusNoContent)
 	}
 }
+
+func (ts *ApiTestSuite) testOpenAPI() {
+	res, err := http.Get(fmt.Sprintf("http://localhost:%s/openapi.json", testPort))
+	if err != nil {
+		ts.T().Fatalf("got %v, want = %v", err, nil)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		ts.T().Fatalf("got %v, want = %v", res.StatusCode, http.StatusOK)
+	}
+
+	var spec struct {
+		Paths map[string]interface{} `json:"paths"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&spec); err != nil {
+		ts.T().Fatalf("got %v, want = %v", err, nil)
+	}
+	if _, ok := spec.Paths["/hello/{username}"]; !ok {
+		ts.T().Fatalf("got %v, want = %v", ok, true)
+	}
+}
+
+func (ts *ApiTestSuite) dialGRPC() *grpc.ClientConn {
+	conn, err := grpc.Dial(
+		fmt.Sprintf("localhost:%s", testGRPCPort),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		ts.T().Fatalf("got %v, want = %v", err, nil)
+	}
+	return conn
+}
+
+func (ts *ApiTestSuite) testGRPCUpsertAndRead() {
+	conn := ts.dialGRPC()
+	defer conn.Close()
+	client := pb.NewUsersClient(conn)
+
+	_, err := client.Upsert(context.Background(), &pb.UpsertRequest{Username: "pear", DateOfBirth: "2020-04-01"})
+	if err != nil {
+		ts.T().Fatalf("got %v, want = %v", err, nil)
+	}
+
+	res, err := client.Read(context.Background(), &pb.ReadRequest{Username: "pear"})
+	if err != nil {
+		ts.T().Fatalf("got %v, want = %v", err, nil)
+	}
+	if res.Message == "" {
+		ts.T().Fatalf("got %v, want non-empty message", res.Message)
+	}
+
+	_, err = client.Read(context.Background(), &pb.ReadRequest{Username: "grape"})
+	if status.Code(err) != codes.NotFound {
+		ts.T().Fatalf("got %v, want = %v", status.Code(err), codes.NotFound)
+	}
+
+	_, err = client.Upsert(context.Background(), &pb.UpsertRequest{Username: "pear", DateOfBirth: "abcd"})
+	if status.Code(err) != codes.InvalidArgument {
+		ts.T().Fatalf("got %v, want = %v", status.Code(err), codes.InvalidArgument)
+	}
+}
+
+func (ts *ApiTestSuite) testGRPCHealth() {
+	conn := ts.dialGRPC()
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+
+	res, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: users.GRPCServiceName})
+	if err != nil {
+		ts.T().Fatalf("got %v, want = %v", err, nil)
+	}
+	if res.Status != healthpb.HealthCheckResponse_SERVING {
+		ts.T().Fatalf("got %v, want = %v", res.Status, healthpb.HealthCheckResponse_SERVING)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/awhdesmond/user-service/pkg/common"
+)
+
+const (
+	migrateTimeLayout = "2006-01-02 15:04:05"
+)
+
+var (
+	errMigrateUsage = errors.New("usage: server migrate up|status|down")
+	errMigrateNoDB  = errors.New("the memory store has no schema to migrate")
+)
+
+// runMigrate runs the migrate subcommand with migrator, which is nil for the memory store
+func runMigrate(ctx context.Context, migrator *common.Migrator, args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return errMigrateUsage
+	}
+	if migrator == nil {
+		return errMigrateNoDB
+	}
+
+	switch args[0] {
+	case "up":
+		done, err := migrator.Up(ctx)
+		for _, m := range done {
+			fmt.Fprintf(out, "applied %d %s\n", m.Version, m.Description)
+		}
+		if err == nil && len(done) == 0 {
+			fmt.Fprintf(out, "schema is up to date at version %d\n", migrator.Latest())
+		}
+		return err
+	case "down":
+		m, err := migrator.Down(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "undone %d %s\n", m.Version, m.Description)
+		return nil
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tDESCRIPTION\tAPPLIED AT")
+		for _, s := range statuses {
+			appliedAt := "pending"
+			if s.AppliedAt != nil {
+				appliedAt = s.AppliedAt.UTC().Format(migrateTimeLayout)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", s.Version, s.Description, appliedAt)
+		}
+		return w.Flush()
+	}
+	return errMigrateUsage
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/awhdesmond/user-service/pkg/client"
+	"github.com/awhdesmond/user-service/pkg/common"
+	"github.com/awhdesmond/user-service/pkg/users"
+	"github.com/redis/go-redis/v9"
+	"github.com/upper/db/v4"
+	"go.uber.org/zap"
+)
+
+// closeTimeout bounds the wait for the pending writes of the store in direct mode
+const closeTimeout = 5 * time.Second
+
+var (
+	errMemoryStoreDirect      = errors.New("-direct cannot reach the memory store of the server, use the API instead")
+	errKeysRotatePostgresOnly = errors.New("keys can only be rotated in postgres")
+)
+
+type ctl struct {
+	cfg    CtlConfig
+	direct bool
+	out    *printer
+}
+
+func (c *ctl) dispatch(ctx context.Context, cmd string, args []string) error {
+	switch {
+	case cmd == "get" && len(args) == 1:
+		return c.get(ctx, args[0])
+	case cmd == "put" && len(args) == 2:
+		return c.put(ctx, args[0], args[1])
+	case cmd == "delete" && len(args) == 1:
+		return c.delete(ctx, args[0])
+	case cmd == "list" && len(args) == 0:
+		return c.list(ctx)
+	case cmd == "upcoming" && len(args) <= 1:
+		days := users.DefaultUpcomingDays
+		if len(args) == 1 {
+			d, err := strconv.Atoi(args[0])
+			if err != nil {
+				return users.ErrDaysInvalid
+			}
+			days = d
+		}
+		return c.upcoming(ctx, days)
+	case cmd == "cache" && len(args) == 2 && args[0] == "inspect":
+		return c.cacheInspect(ctx, args[1])
+	case cmd == "cache" && len(args) == 2 && args[0] == "evict":
+		return c.cacheEvict(ctx, args[1])
+	case cmd == "export" && len(args) == 1:
+		return c.export(ctx, args[0])
+	case cmd == "erase" && len(args) == 1:
+		return c.erase(ctx, args[0])
+	case cmd == "erasures" && len(args) == 1 && args[0] == "verify":
+		return c.erasuresVerify(ctx)
+	case cmd == "keys" && len(args) == 1 && args[0] == "rotate":
+		return c.keysRotate(ctx)
+	}
+	return errUsage
+}
+
+// service returns the users service over the API, or backed by the store of
+// the server when running in direct mode, along with a func which releases
+// its connections.
+func (c *ctl) service() (users.Service, func(), error) {
+	if !c.direct {
+		svc, err := client.New(client.Config{BaseURL: c.cfg.APIURL, AdminToken: c.cfg.AdminToken})
+		return svc, func() {}, err
+	}
+
+	storeCfg := c.cfg.StoreConfig
+	if err := storeCfg.Validate(); err != nil {
+		return nil, nil, err
+	}
+	keyring, err := common.LoadKeyring(c.cfg.KeyringConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	storeCfg.Keyring = keyring
+
+	sess, err := c.openDB()
+	if err != nil {
+		return nil, nil, err
+	}
+	// Redis is optional with SQLite, as in the server
+	var rdb redis.UniversalClient
+	if c.cfg.Backend == users.StoreBackendPostgres || c.cfg.RedisCfg.Enabled() {
+		if rdb, err = common.MakeRedisClient(c.cfg.RedisCfg); err != nil {
+			sess.Close()
+			return nil, nil, err
+		}
+	}
+	logger := zap.NewNop()
+	events := users.NewMemoryEventBroker()
+	if rdb != nil {
+		events = users.NewRedisEventBroker(rdb, logger)
+	}
+
+	var store users.Store
+	if c.cfg.Backend == users.StoreBackendPostgres {
+		storeCfg.Replicas = common.MakePostgresReplicaSessions(c.cfg.PostgresSQLConfig, logger)
+		store = users.NewStore(sess, rdb, events, storeCfg, logger)
+	} else {
+		store = users.NewSQLiteStore(sess, rdb, events, storeCfg, logger)
+	}
+	closeFn := func() {
+		// not the command's ctx, so that the pending cache writes are
+		// still drained when the command is interrupted
+		ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+		defer cancel()
+		store.Close(ctx)
+		events.Close(ctx)
+		if rdb != nil {
+			rdb.Close()
+		}
+		for _, replica := range storeCfg.Replicas {
+			replica.Close()
+		}
+		sess.Close()
+	}
+	return users.NewDefaultService(store), closeFn, nil
+}
+
+// openDB opens the database of the store of the server. The memory store
+// lives in the server process, so it cannot be reached directly.
+func (c *ctl) openDB() (db.Session, error) {
+	switch c.cfg.Backend {
+	case users.StoreBackendPostgres:
+		return common.MakePostgresDBSession(c.cfg.PostgresSQLConfig)
+	case users.StoreBackendSQLite:
+		return common.MakeSQLiteDBSession(c.cfg.SQLiteConfig)
+	case users.StoreBackendMemory:
+		return nil, errMemoryStoreDirect
+	}
+	return nil, users.ErrStoreBackendInvalid
+}
+
+func (c *ctl) cacheAdmin() (users.CacheAdmin, func(), error) {
+	rdb, err := common.MakeRedisClient(c.cfg.RedisCfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return users.NewCacheAdmin(rdb, zap.NewNop()), func() { rdb.Close() }, nil
+}
+
+func (c *ctl) get(ctx context.Context, username string) error {
+	svc, closeFn, err := c.service()
+	if err != nil {
+		return err
+	}
+	defer closeFn()
+
+	msg, err := svc.Read(ctx, username)
+	if err != nil {
+		return err
+	}
+	return c.out.print(
+		common.GenericJSON{"username": username, "message": msg},
+		[]string{"USERNAME", "MESSAGE"},
+		[][]string{{username, msg}},
+	)
+}
+
+func (c *ctl) put(ctx context.Context, username, dob string) error {
+	svc, closeFn, err := c.service()
+	if err != nil {
+		return err
+	}
+	defer closeFn()
+
+	if err := svc.Upsert(ctx, username, dob); err != nil {
+		return err
+	}
+	return c.out.status(username, "saved")
+}
+
+func (c *ctl) delete(ctx context.Context, username string) error {
+	svc, closeFn, err := c.service()
+	if err != nil {
+		return err
+	}
+	defer closeFn()
+
+	if err := svc.Delete(ctx, username); err != nil {
+		return err
+	}
+	return c.out.status(username, "deleted")
+}
+
+func (c *ctl) list(ctx context.Context) error {
+	svc, closeFn, err := c.service()
+	if err != nil {
+		return err
+	}
+	defer closeFn()
+
+	usrs, err := svc.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	rows := [][]string{}
+	for _, u := range usrs {
+		rows = append(rows, []string{u.Username, u.DoB.Format(dateLayout)})
+	}
+	return c.out.print(usrs, []string{"USERNAME", "DATE OF BIRTH"}, rows)
+}
+
+func (c *ctl) upcoming(ctx context.Context, days int) error {
+	svc, closeFn, err := c.service()
+	if err != nil {
+		return err
+	}
+	defer closeFn()
+
+	birthdays, err := svc.Upcoming(ctx, days)
+	if err != nil {
+		return err
+	}
+
+	rows := [][]string{}
+	for _, b := range birthdays {
+		rows = append(rows, []string{
+			b.Username,
+			b.DoB.Format(dateLayout),
+			strconv.Itoa(b.DaysToBirthday),
+		})
+	}
+	return c.out.print(birthdays, []string{"USERNAME", "DATE OF BIRTH", "DAYS"}, rows)
+}
+
+func (c *ctl) cacheInspect(ctx context.Context, username string) error {
+	admin, closeFn, err := c.cacheAdmin()
+	if err != nil {
+		return err
+	}
+	defer closeFn()
+
+	entry, err := admin.Inspect(ctx, username)
+	if err != nil {
+		return err
+	}
+	return c.out.print(
+		entry,
+		[]string{"KEY", "TTL", "VERSION", "FORMAT", "VALUE"},
+		[][]string{{entry.Key, entry.TTL.String(), strconv.FormatInt(entry.Version, 10), entry.Format, entry.Value}},
+	)
+}
+
+func (c *ctl) cacheEvict(ctx context.Context, username string) error {
+	admin, closeFn, err := c.cacheAdmin()
+	if err != nil {
+		return err
+	}
+	defer closeFn()
+
+	if err := admin.Evict(ctx, username); err != nil {
+		return err
+	}
+	return c.out.status(username, "evicted")
+}
+
+// export always prints JSON, the archive does not fit in a table
+func (c *ctl) export(ctx context.Context, username string) error {
+	svc, closeFn, err := c.service()
+	if err != nil {
+		return err
+	}
+	defer closeFn()
+
+	export, err := svc.Export(ctx, username)
+	if err != nil {
+		return err
+	}
+	return newPrinter(c.out.w, outputJSON).print(export, nil, nil)
+}
+
+func (c *ctl) erase(ctx context.Context, username string) error {
+	svc, closeFn, err := c.service()
+	if err != nil {
+		return err
+	}
+	defer closeFn()
+
+	receipt, err := svc.Erase(ctx, username)
+	if err != nil {
+		return err
+	}
+	return c.out.print(
+		receipt,
+		[]string{"RECEIPT", "ROWS", "EVENTS", "HASH"},
+		[][]string{{
+			strconv.FormatInt(receipt.ID, 10),
+			strconv.Itoa(receipt.RowsDeleted),
+			strconv.Itoa(receipt.EventsDeleted),
+			receipt.Hash,
+		}},
+	)
+}
+
+// erasuresVerify checks the receipt chain in the database of the store, with or without -direct
+func (c *ctl) erasuresVerify(ctx context.Context) error {
+	sess, err := c.openDB()
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+
+	receipts, err := users.ListErasureReceipts(ctx, sess)
+	if err != nil {
+		return err
+	}
+	if err := users.VerifyErasureReceipts(receipts); err != nil {
+		return err
+	}
+	head := ""
+	if len(receipts) > 0 {
+		head = receipts[len(receipts)-1].Hash
+	}
+	return c.out.print(
+		common.GenericJSON{"receipts": len(receipts), "head": head, "status": "verified"},
+		[]string{"RECEIPTS", "HEAD", "STATUS"},
+		[][]string{{strconv.Itoa(len(receipts)), head, "verified"}},
+	)
+}
+
+// keysRotate re-encrypts the users in Postgres, with or without -direct
+func (c *ctl) keysRotate(ctx context.Context) error {
+	if c.cfg.Backend != users.StoreBackendPostgres {
+		return errKeysRotatePostgresOnly
+	}
+	keyring, err := common.LoadKeyring(c.cfg.KeyringConfig)
+	if err != nil {
+		return err
+	}
+	if keyring == nil {
+		return common.ErrEncryptionDisabled
+	}
+	pgSess, err := common.MakePostgresDBSession(c.cfg.PostgresSQLConfig)
+	if err != nil {
+		return err
+	}
+	defer pgSess.Close()
+	admin, closeFn, err := c.cacheAdmin()
+	if err != nil {
+		return err
+	}
+	defer closeFn()
+
+	n, err := users.ReencryptUsers(ctx, pgSess, keyring, admin, users.DefaultReencryptBatchSize)
+	if err != nil {
+		return err
+	}
+	return c.out.print(
+		common.GenericJSON{"keyId": keyring.PrimaryKeyID(), "reencrypted": n},
+		[]string{"KEY ID", "RE-ENCRYPTED"},
+		[][]string{{keyring.PrimaryKeyID(), strconv.Itoa(n)}},
+	)
+}
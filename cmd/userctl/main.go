@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/awhdesmond/user-service/pkg/common"
+	"github.com/awhdesmond/user-service/pkg/users"
+	"github.com/spf13/viper"
+)
+
+const (
+	cfgFlagAPIURL     = "api-url"
+	cfgFlagAdminToken = "admin-token"
+
+	cfgFlagPostgresHost     = "postgres-host"
+	cfgFlagPostgresPort     = "postgres-port"
+	cfgFlagPostgresDatabase = "postgres-database"
+	cfgFlagPostgresUsername = "postgres-username"
+	cfgFlagPostgresPassword = "postgres-password"
+	// cfgFlagPostgresReplicaHosts is a comma-separated list of host[:port]
+	cfgFlagPostgresReplicaHosts = "postgres-replica-hosts"
+
+	cfgFlagPostgresMaxOpenConns     = "postgres-max-open-conns"
+	cfgFlagPostgresMaxIdleConns     = "postgres-max-idle-conns"
+	cfgFlagPostgresConnMaxLifetime  = "postgres-conn-max-lifetime"
+	cfgFlagPostgresConnMaxIdleTime  = "postgres-conn-max-idle-time"
+	cfgFlagPostgresSSLMode          = "postgres-sslmode"
+	cfgFlagPostgresSSLRootCert      = "postgres-sslrootcert"
+	cfgFlagPostgresSSLCert          = "postgres-sslcert"
+	cfgFlagPostgresSSLKey           = "postgres-sslkey"
+	cfgFlagPostgresApplicationName  = "postgres-application-name"
+	cfgFlagPostgresStatementTimeout = "postgres-statement-timeout"
+
+	cfgFlagSQLitePath = "sqlite-path"
+
+	cfgFlagRedisURI         = "redis-uri"
+	cfgFlagRedisPassword    = "redis-password"
+	cfgFlagRedisClusterMode = "redis-cluster-mode"
+	// cfgFlagRedisSentinelAddrs is a comma-separated list of host:port
+	cfgFlagRedisSentinelAddrs      = "redis-sentinel-addrs"
+	cfgFlagRedisSentinelMasterName = "redis-sentinel-master-name"
+	cfgFlagRedisSentinelPassword   = "redis-sentinel-password"
+	cfgFlagRedisDB                 = "redis-db"
+	cfgFlagRedisPoolSize           = "redis-pool-size"
+	cfgFlagRedisMinIdleConns       = "redis-min-idle-conns"
+	cfgFlagRedisPoolTimeout        = "redis-pool-timeout"
+	cfgFlagRedisDialTimeout        = "redis-dial-timeout"
+	cfgFlagRedisReadTimeout        = "redis-read-timeout"
+	cfgFlagRedisWriteTimeout       = "redis-write-timeout"
+	cfgFlagRedisTLS                = "redis-tls"
+	cfgFlagRedisTLSCACert          = "redis-tls-ca-cert"
+	cfgFlagRedisTLSServerName      = "redis-tls-server-name"
+	cfgFlagRedisTLSCert            = "redis-tls-cert"
+	cfgFlagRedisTLSKey             = "redis-tls-key"
+
+	cfgFlagStore = "store"
+
+	cfgFlagLocalCacheSize = "local-cache-size"
+	cfgFlagLocalCacheTTL  = "local-cache-ttl"
+
+	cfgFlagNotFoundCacheTTL = "not-found-cache-ttl"
+
+	cfgFlagCacheWriteWorkers   = "cache-write-workers"
+	cfgFlagCacheWriteQueueSize = "cache-write-queue-size"
+	cfgFlagCacheWriteTimeout   = "cache-write-timeout"
+
+	cfgFlagCacheCodec       = "cache-codec"
+	cfgFlagCacheCompression = "cache-compression"
+
+	cfgFlagKeyringFile = "keyring-file"
+
+	defaultPostgresApplicationName = "userctl"
+
+	envVarPrefix = "USERS_SVC"
+
+	defaultAPIURL = "http://localhost:8080"
+
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+var (
+	errUsage = errors.New("invalid usage")
+)
+
+const usage = `userctl manages users of the user service.
+
+Usage:
+  userctl [flags] <command> [args]
+
+Commands:
+  get <username>             Print the birthday message of a user
+  put <username> <date>      Save a user's date of birth (YYYY-MM-DD)
+  delete <username>          Delete a user
+  list                       List all users
+  upcoming [days]            List users whose birthday is within days (default 30)
+  cache inspect <username>   Print the cached value of a user
+  cache evict <username>     Evict a user from the cache of every replica
+  export <username>          Print every piece of data held about a user as JSON
+  erase <username>           Erase every piece of data held about a user
+  erasures verify            Verify the hash chain of erasure receipts in the database
+  keys rotate                Re-encrypt dates of birth with the primary key of the keyring (Postgres only)
+
+Flags:
+`
+
+// CtlConfig is read from the same USERS_SVC_* environment variables as the
+// server, so that -direct acts on the store of the server.
+type CtlConfig struct {
+	common.PostgresSQLConfig `mapstructure:",squash"`
+	common.SQLiteConfig      `mapstructure:",squash"`
+	common.RedisCfg          `mapstructure:",squash"`
+	users.StoreConfig        `mapstructure:",squash"`
+	common.KeyringConfig     `mapstructure:",squash"`
+
+	APIURL string `mapstructure:"api-url"`
+	// AdminToken authorizes export and erase over the API
+	AdminToken string `mapstructure:"admin-token"`
+}
+
+func loadConfig() (CtlConfig, error) {
+	v := viper.New()
+	v.SetDefault(cfgFlagAPIURL, defaultAPIURL)
+	v.SetDefault(cfgFlagAdminToken, "")
+
+	v.SetDefault(cfgFlagPostgresHost, "")
+	v.SetDefault(cfgFlagPostgresPort, "")
+	v.SetDefault(cfgFlagPostgresDatabase, "")
+	v.SetDefault(cfgFlagPostgresUsername, "")
+	v.SetDefault(cfgFlagPostgresPassword, "")
+	v.SetDefault(cfgFlagPostgresReplicaHosts, []string{})
+	v.SetDefault(cfgFlagPostgresMaxOpenConns, 0)
+	v.SetDefault(cfgFlagPostgresMaxIdleConns, 0)
+	v.SetDefault(cfgFlagPostgresConnMaxLifetime, 0)
+	v.SetDefault(cfgFlagPostgresConnMaxIdleTime, 0)
+	v.SetDefault(cfgFlagPostgresSSLMode, "")
+	v.SetDefault(cfgFlagPostgresSSLRootCert, "")
+	v.SetDefault(cfgFlagPostgresSSLCert, "")
+	v.SetDefault(cfgFlagPostgresSSLKey, "")
+	v.SetDefault(cfgFlagPostgresApplicationName, defaultPostgresApplicationName)
+	v.SetDefault(cfgFlagPostgresStatementTimeout, 0)
+
+	v.SetDefault(cfgFlagSQLitePath, "")
+
+	v.SetDefault(cfgFlagRedisURI, "")
+	v.SetDefault(cfgFlagRedisPassword, "")
+	v.SetDefault(cfgFlagRedisClusterMode, "")
+	v.SetDefault(cfgFlagRedisSentinelAddrs, []string{})
+	v.SetDefault(cfgFlagRedisSentinelMasterName, "")
+	v.SetDefault(cfgFlagRedisSentinelPassword, "")
+	v.SetDefault(cfgFlagRedisDB, 0)
+	v.SetDefault(cfgFlagRedisPoolSize, 0)
+	v.SetDefault(cfgFlagRedisMinIdleConns, 0)
+	v.SetDefault(cfgFlagRedisPoolTimeout, 0)
+	v.SetDefault(cfgFlagRedisDialTimeout, 0)
+	v.SetDefault(cfgFlagRedisReadTimeout, 0)
+	v.SetDefault(cfgFlagRedisWriteTimeout, 0)
+	v.SetDefault(cfgFlagRedisTLS, false)
+	v.SetDefault(cfgFlagRedisTLSCACert, "")
+	v.SetDefault(cfgFlagRedisTLSServerName, "")
+	v.SetDefault(cfgFlagRedisTLSCert, "")
+	v.SetDefault(cfgFlagRedisTLSKey, "")
+
+	v.SetDefault(cfgFlagStore, users.StoreBackendPostgres)
+
+	v.SetDefault(cfgFlagLocalCacheSize, 0)
+	v.SetDefault(cfgFlagLocalCacheTTL, users.DefaultLocalCacheTTL)
+	v.SetDefault(cfgFlagNotFoundCacheTTL, users.DefaultNotFoundCacheTTL)
+
+	v.SetDefault(cfgFlagCacheWriteWorkers, users.DefaultCacheWriteWorkers)
+	v.SetDefault(cfgFlagCacheWriteQueueSize, users.DefaultCacheWriteQueueSize)
+	v.SetDefault(cfgFlagCacheWriteTimeout, users.DefaultCacheWriteTimeout)
+
+	v.SetDefault(cfgFlagCacheCodec, users.CacheCodecJSON)
+	v.SetDefault(cfgFlagCacheCompression, users.CacheCompressionNone)
+
+	v.SetDefault(cfgFlagKeyringFile, "")
+
+	v.SetEnvPrefix(envVarPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	v.AutomaticEnv()
+
+	var cfg CtlConfig
+	err := v.Unmarshal(&cfg)
+	return cfg, err
+}
+
+func main() {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	if err := run(ctx, os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		if !errors.Is(err, errUsage) && !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintln(os.Stderr, "error:", err)
+		}
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	fs := flag.NewFlagSet("userctl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		fs.PrintDefaults()
+	}
+	output := fs.String("o", outputTable, "output format: table or json")
+	direct := fs.Bool("direct", false, "talk to Postgres and Redis directly instead of the API")
+	fs.StringVar(&cfg.APIURL, "api-url", cfg.APIURL, "URL of the users API (env USERS_SVC_API_URL)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *output != outputTable && *output != outputJSON {
+		fs.Usage()
+		return errUsage
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errUsage
+	}
+
+	c := &ctl{cfg: cfg, direct: *direct, out: newPrinter(stdout, *output)}
+	if err := c.dispatch(ctx, fs.Arg(0), fs.Args()[1:]); err != nil {
+		if errors.Is(err, errUsage) {
+			fs.Usage()
+		}
+		return err
+	}
+	return nil
+}
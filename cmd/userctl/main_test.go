@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awhdesmond/user-service/pkg/common"
+	"github.com/awhdesmond/user-service/pkg/users"
+)
+
+// stubService returns canned responses without a database
+type stubService struct {
+	users.Service
+}
+
+func (stubService) Read(_ context.Context, username string) (string, error) {
+	if username == "grape" {
+		return "", users.ErrUserNotFound
+	}
+	return "Hello, " + username + "! Happy birthday!", nil
+}
+
+func (stubService) List(_ context.Context) ([]users.User, error) {
+	return []users.User{
+		{Username: "apple", DoB: time.Date(2000, 3, 3, 0, 0, 0, 0, time.UTC)},
+		{Username: "pear", DoB: time.Date(2000, 7, 3, 0, 0, 0, 0, time.UTC)},
+	}, nil
+}
+
+func (stubService) Erase(_ context.Context, username string) (users.ErasureReceipt, error) {
+	return users.ErasureReceipt{ID: 1, SubjectHash: "subject", RowsDeleted: 1, Hash: "abc"}, nil
+}
+
+func runWithStub(t *testing.T, args ...string) (string, error) {
+	srv := httptest.NewServer(users.MakeHandler(stubService{}))
+	t.Cleanup(srv.Close)
+
+	var stdout, stderr bytes.Buffer
+	args = append([]string{"-api-url", srv.URL}, args...)
+	err := run(context.Background(), args, &stdout, &stderr)
+	return stdout.String(), err
+}
+
+func TestGet(t *testing.T) {
+	out, err := runWithStub(t, "get", "apple")
+	if err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	if !strings.Contains(out, "Hello, apple! Happy birthday!") {
+		t.Fatalf("got = %v, want = %v", out, "Hello, apple! Happy birthday!")
+	}
+
+	_, err = runWithStub(t, "get", "grape")
+	if err != users.ErrUserNotFound {
+		t.Fatalf("got = %v, want = %v", err, users.ErrUserNotFound)
+	}
+}
+
+func TestListJSON(t *testing.T) {
+	out, err := runWithStub(t, "-o", "json", "list")
+	if err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+
+	var usrs []users.User
+	if err := json.Unmarshal([]byte(out), &usrs); err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	if len(usrs) != 2 || usrs[0].Username != "apple" {
+		t.Fatalf("got = %v, want = %v", usrs, "apple and pear")
+	}
+}
+
+func TestErase(t *testing.T) {
+	out, err := runWithStub(t, "-o", "json", "erase", "apple")
+	if err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+
+	var receipt users.ErasureReceipt
+	if err := json.Unmarshal([]byte(out), &receipt); err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	if receipt.SubjectHash != "subject" || receipt.RowsDeleted != 1 {
+		t.Fatalf("got = %v, want = %v", receipt, "receipt of apple")
+	}
+}
+
+func TestUsage(t *testing.T) {
+	for _, args := range [][]string{{}, {"get"}, {"cache", "flush", "apple"}, {"-o", "yaml", "list"}} {
+		if _, err := runWithStub(t, args...); err != errUsage {
+			t.Fatalf("got = %v, want = %v", err, errUsage)
+		}
+	}
+}
+
+func TestDirectSQLite(t *testing.T) {
+	dir := t.TempDir()
+	sess, err := common.TestMakeSQLiteDBSession(dir)
+	if err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	sess.Close()
+	t.Setenv("USERS_SVC_STORE", users.StoreBackendSQLite)
+	t.Setenv("USERS_SVC_SQLITE_PATH", filepath.Join(dir, "users.db"))
+
+	var stdout, stderr bytes.Buffer
+	if err := run(context.Background(), []string{"-direct", "put", "apple", "2000-03-03"}, &stdout, &stderr); err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	stdout.Reset()
+	if err := run(context.Background(), []string{"-direct", "-o", "json", "list"}, &stdout, &stderr); err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	var usrs []users.User
+	if err := json.Unmarshal(stdout.Bytes(), &usrs); err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	if len(usrs) != 1 || usrs[0].Username != "apple" {
+		t.Fatalf("got = %v, want = %v", usrs, "apple")
+	}
+
+	if err := run(context.Background(), []string{"-direct", "erase", "apple"}, &stdout, &stderr); err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	stdout.Reset()
+	if err := run(context.Background(), []string{"-o", "json", "erasures", "verify"}, &stdout, &stderr); err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	if !strings.Contains(stdout.String(), `"receipts": 1`) {
+		t.Fatalf("got = %v, want = %v", stdout.String(), "one receipt")
+	}
+	if err := run(context.Background(), []string{"keys", "rotate"}, &stdout, &stderr); err != errKeysRotatePostgresOnly {
+		t.Fatalf("got = %v, want = %v", err, errKeysRotatePostgresOnly)
+	}
+}
+
+func TestDirectMemory(t *testing.T) {
+	t.Setenv("USERS_SVC_STORE", users.StoreBackendMemory)
+
+	var stdout, stderr bytes.Buffer
+	if err := run(context.Background(), []string{"-direct", "list"}, &stdout, &stderr); err != errMemoryStoreDirect {
+		t.Fatalf("got = %v, want = %v", err, errMemoryStoreDirect)
+	}
+}
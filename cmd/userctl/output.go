@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/awhdesmond/user-service/pkg/common"
+)
+
+const (
+	dateLayout = "2006-01-02"
+)
+
+// printer writes results either as a table or as JSON
+type printer struct {
+	w      io.Writer
+	format string
+}
+
+func newPrinter(w io.Writer, format string) *printer {
+	return &printer{w: w, format: format}
+}
+
+func (p *printer) print(v interface{}, header []string, rows [][]string) error {
+	if p.format == outputJSON {
+		enc := json.NewEncoder(p.w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+
+	tw := tabwriter.NewWriter(p.w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+func (p *printer) status(username, status string) error {
+	if p.format == outputJSON {
+		return p.print(common.GenericJSON{"username": username, "status": status}, nil, nil)
+	}
+	_, err := fmt.Fprintf(p.w, "user %q %s\n", username, status)
+	return err
+}
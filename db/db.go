@@ -0,0 +1,21 @@
+// Package db embeds the SQL migrations of the users service.
+//
+// Migrations are named V<version>__<description>.sql as for Flyway. The
+// optional undo script of a migration is named U<version>__<description>.sql,
+// in the undo directory next to the migrations directory.
+package db
+
+import (
+	"embed"
+	"io/fs"
+)
+
+//go:embed migrations/*.sql undo/*.sql sqlite/migrations/*.sql sqlite/undo/*.sql
+var files embed.FS
+
+var (
+	// Postgres has the migrations and undo directories of Postgres
+	Postgres fs.FS = files
+	// SQLite has the migrations and undo directories of SQLite
+	SQLite, _ = fs.Sub(files, "sqlite")
+)
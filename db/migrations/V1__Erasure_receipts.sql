@@ -0,0 +1,13 @@
+-- Receipts of GDPR erasures. Each receipt is chained to the previous one
+-- through prev_hash, so that editing or deleting a receipt is detectable.
+-- The username is only stored as a hash.
+CREATE TABLE erasure_receipts (
+    "id" BIGSERIAL NOT NULL,
+    "subject_hash" TEXT NOT NULL,
+    "erased_at" TIMESTAMP NOT NULL,
+    "rows_deleted" INTEGER NOT NULL,
+    "events_deleted" INTEGER NOT NULL,
+    "prev_hash" TEXT NOT NULL,
+    "hash" TEXT NOT NULL,
+    constraint erasure_receipts_pk primary key (id)
+);
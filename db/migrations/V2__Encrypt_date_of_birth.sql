@@ -0,0 +1,14 @@
+-- date_of_birth is kept for rows written without a keyring, and for rows
+-- written before encryption was enabled until they are re-encrypted.
+-- Encrypted rows store the date in date_of_birth_enc instead, along with
+-- the ID of the key it was encrypted with, and a blind index of its
+-- month and day for birthday queries.
+ALTER TABLE users ALTER COLUMN "date_of_birth" DROP NOT NULL;
+ALTER TABLE users ADD COLUMN "date_of_birth_enc" TEXT;
+ALTER TABLE users ADD COLUMN "dob_key_id" TEXT;
+ALTER TABLE users ADD COLUMN "birthday_index" TEXT;
+ALTER TABLE users ADD constraint users_dob_present
+    CHECK ("date_of_birth" IS NOT NULL OR "date_of_birth_enc" IS NOT NULL);
+
+CREATE INDEX users_dob_key_id_idx ON users (dob_key_id);
+CREATE INDEX users_birthday_index_idx ON users (birthday_index);
@@ -0,0 +1,6 @@
+-- version increases on every write of a user, from a sequence shared by all
+-- users so that a user re-created after a deletion gets a higher version
+-- than before. The cache only accepts values with a higher version than
+-- the one it holds.
+CREATE SEQUENCE users_version_seq;
+ALTER TABLE users ADD COLUMN "version" BIGINT NOT NULL DEFAULT nextval('users_version_seq');
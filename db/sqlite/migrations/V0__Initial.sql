@@ -0,0 +1,5 @@
+CREATE TABLE users (
+    "username" TEXT NOT NULL,
+    "date_of_birth" TIMESTAMP NOT NULL,
+    constraint users_pk primary key (username)
+);
@@ -0,0 +1,10 @@
+-- Receipts of GDPR erasures, see db/migrations/V1__Erasure_receipts.sql
+CREATE TABLE erasure_receipts (
+    "id" INTEGER PRIMARY KEY AUTOINCREMENT,
+    "subject_hash" TEXT NOT NULL,
+    "erased_at" TIMESTAMP NOT NULL,
+    "rows_deleted" INTEGER NOT NULL,
+    "events_deleted" INTEGER NOT NULL,
+    "prev_hash" TEXT NOT NULL,
+    "hash" TEXT NOT NULL
+);
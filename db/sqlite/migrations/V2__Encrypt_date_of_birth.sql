@@ -0,0 +1,19 @@
+-- Encrypted dates of birth, see db/migrations/V2__Encrypt_date_of_birth.sql.
+-- SQLite cannot drop a NOT NULL constraint or add a check constraint,
+-- so the table is rebuilt.
+CREATE TABLE users_new (
+    "username" TEXT NOT NULL,
+    "date_of_birth" TIMESTAMP,
+    "date_of_birth_enc" TEXT,
+    "dob_key_id" TEXT,
+    "birthday_index" TEXT,
+    constraint users_pk primary key (username),
+    constraint users_dob_present
+        CHECK ("date_of_birth" IS NOT NULL OR "date_of_birth_enc" IS NOT NULL)
+);
+INSERT INTO users_new ("username", "date_of_birth") SELECT "username", "date_of_birth" FROM users;
+DROP TABLE users;
+ALTER TABLE users_new RENAME TO users;
+
+CREATE INDEX users_dob_key_id_idx ON users (dob_key_id);
+CREATE INDEX users_birthday_index_idx ON users (birthday_index);
@@ -0,0 +1,8 @@
+-- User versions, see db/migrations/V3__User_versions.sql.
+-- SQLite has no sequences, the last version is kept in a table of one row.
+CREATE TABLE user_versions (
+    "version" INTEGER NOT NULL
+);
+INSERT INTO user_versions ("version") VALUES (0);
+
+ALTER TABLE users ADD COLUMN "version" INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,9 @@
+-- Fails while rows are encrypted, since they have no date_of_birth.
+CREATE TABLE users_old (
+    "username" TEXT NOT NULL,
+    "date_of_birth" TIMESTAMP NOT NULL,
+    constraint users_pk primary key (username)
+);
+INSERT INTO users_old ("username", "date_of_birth") SELECT "username", "date_of_birth" FROM users;
+DROP TABLE users;
+ALTER TABLE users_old RENAME TO users;
@@ -0,0 +1,9 @@
+-- Fails while rows are encrypted, since they have no date_of_birth.
+DROP INDEX users_birthday_index_idx;
+DROP INDEX users_dob_key_id_idx;
+
+ALTER TABLE users DROP constraint users_dob_present;
+ALTER TABLE users DROP COLUMN "birthday_index";
+ALTER TABLE users DROP COLUMN "dob_key_id";
+ALTER TABLE users DROP COLUMN "date_of_birth_enc";
+ALTER TABLE users ALTER COLUMN "date_of_birth" SET NOT NULL;
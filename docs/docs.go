@@ -0,0 +1,11 @@
+// Package docs embeds the OpenAPI definition of the users HTTP API.
+package docs
+
+import (
+	_ "embed"
+)
+
+// OpenAPISpec is the contents of swagger.yaml
+//
+//go:embed swagger.yaml
+var OpenAPISpec []byte
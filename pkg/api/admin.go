@@ -0,0 +1,53 @@
+package api
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+var (
+	ErrAdminDisabled     = errors.New("admin routes are disabled")
+	ErrAdminUnauthorized = errors.New("missing or invalid admin token")
+)
+
+type AdminConfig struct {
+	// AdminToken is the bearer token of the admin routes, which are disabled when it is empty
+	AdminToken string `mapstructure:"admin-token"`
+}
+
+// AdminAuthMiddleware restricts routes which expose or erase the data of any
+// user, such as data subject requests, to operators holding the admin token.
+// The routes respond 403 when no token is configured, and 401 to requests
+// without the token.
+type AdminAuthMiddleware struct {
+	tokenHash [sha256.Size]byte
+	enabled   bool
+}
+
+func NewAdminAuthMiddleware(cfg AdminConfig) *AdminAuthMiddleware {
+	return &AdminAuthMiddleware{
+		tokenHash: sha256.Sum256([]byte(cfg.AdminToken)),
+		enabled:   cfg.AdminToken != "",
+	}
+}
+
+func (mw *AdminAuthMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !mw.enabled {
+			writeJSONError(w, http.StatusForbidden, ErrAdminDisabled)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		// hashed so that the comparison takes the same time whatever the length of the token
+		tokenHash := sha256.Sum256([]byte(token))
+		if !ok || subtle.ConstantTimeCompare(tokenHash[:], mw.tokenHash[:]) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeJSONError(w, http.StatusUnauthorized, ErrAdminUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
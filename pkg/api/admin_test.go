@@ -0,0 +1,41 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminAuthMiddleware(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	cases := []struct {
+		name  string
+		token string
+		auth  string
+		want  int
+	}{
+		{"disabled", "", "Bearer ", http.StatusForbidden},
+		{"disabled with a token", "", "Bearer secret", http.StatusForbidden},
+		{"no token", "secret", "", http.StatusUnauthorized},
+		{"wrong token", "secret", "Bearer secreT", http.StatusUnauthorized},
+		{"not a bearer token", "secret", "Basic secret", http.StatusUnauthorized},
+		{"token", "secret", "Bearer secret", http.StatusOK},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			handler := NewAdminAuthMiddleware(AdminConfig{AdminToken: tc.token}).Handler(next)
+			r := httptest.NewRequest(http.MethodPost, "/v1/hello/apple/erase", nil)
+			if tc.auth != "" {
+				r.Header.Set("Authorization", tc.auth)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tc.want {
+				t.Fatalf("got = %v, want = %v", w.Code, tc.want)
+			}
+		})
+	}
+}
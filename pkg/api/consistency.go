@@ -0,0 +1,72 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/awhdesmond/user-service/pkg/common"
+)
+
+const (
+	// ReadPrimaryCookie holds the time, in Unix milliseconds, until which
+	// the reads of the client go to the primary
+	ReadPrimaryCookie = "users_svc_read_primary"
+)
+
+var (
+	DefaultReadYourWritesWindow = 5 * time.Second
+)
+
+type ReadYourWritesConfig struct {
+	// ReadYourWritesWindow is how long the reads of a client go to the
+	// primary after it wrote, and should exceed the replication lag
+	ReadYourWritesWindow time.Duration `mapstructure:"read-your-writes-window"`
+}
+
+// ReadYourWritesMiddleware lets clients read their own writes although reads
+// are served by replicas. Mutating requests set a cookie which expires after
+// the window, and the reads of requests which carry it go to the primary.
+type ReadYourWritesMiddleware struct {
+	window time.Duration
+}
+
+func NewReadYourWritesMiddleware(cfg ReadYourWritesConfig) *ReadYourWritesMiddleware {
+	window := cfg.ReadYourWritesWindow
+	if window <= 0 {
+		window = DefaultReadYourWritesWindow
+	}
+	return &ReadYourWritesMiddleware{window: window}
+}
+
+func (mw *ReadYourWritesMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		if isMutatingMethod(r.Method) {
+			until := now.Add(mw.window)
+			http.SetCookie(w, &http.Cookie{
+				Name:     ReadPrimaryCookie,
+				Value:    strconv.FormatInt(until.UnixMilli(), 10),
+				Path:     "/",
+				MaxAge:   int((mw.window + time.Second - 1) / time.Second),
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+			r = r.WithContext(common.WithPrimary(r.Context()))
+		} else if readsPrimary(r, now) {
+			r = r.WithContext(common.WithPrimary(r.Context()))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// readsPrimary reports whether the request carries a cookie which has not expired.
+// The expiry is checked as well as Max-Age, since clients may not enforce it.
+func readsPrimary(r *http.Request, now time.Time) bool {
+	cookie, err := r.Cookie(ReadPrimaryCookie)
+	if err != nil {
+		return false
+	}
+	until, err := strconv.ParseInt(cookie.Value, 10, 64)
+	return err == nil && now.UnixMilli() < until
+}
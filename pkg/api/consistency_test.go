@@ -0,0 +1,64 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/awhdesmond/user-service/pkg/common"
+)
+
+func TestReadYourWrites(t *testing.T) {
+	var readsPrimary bool
+	mw := NewReadYourWritesMiddleware(ReadYourWritesConfig{ReadYourWritesWindow: time.Minute})
+	handler := mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		readsPrimary = common.UsePrimary(r.Context())
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	send := func(method string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/v1/hello/apple", nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send(http.MethodPut)
+	if !readsPrimary {
+		t.Fatalf("got = %v, want = %v", readsPrimary, true)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != ReadPrimaryCookie || cookies[0].MaxAge != 60 {
+		t.Fatalf("got = %v, want = %v", cookies, ReadPrimaryCookie+" for 60s")
+	}
+
+	cases := []struct {
+		name    string
+		cookies []*http.Cookie
+		want    bool
+	}{
+		{"without cookie", nil, false},
+		{"after a write", cookies, true},
+		{"expired cookie", []*http.Cookie{{
+			Name:  ReadPrimaryCookie,
+			Value: strconv.FormatInt(time.Now().Add(-time.Second).UnixMilli(), 10),
+		}}, false},
+		{"invalid cookie", []*http.Cookie{{Name: ReadPrimaryCookie, Value: "forever"}}, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := send(http.MethodGet, tc.cookies...)
+			if readsPrimary != tc.want {
+				t.Fatalf("got = %v, want = %v", readsPrimary, tc.want)
+			}
+			if got := w.Header().Get("Set-Cookie"); got != "" {
+				t.Fatalf("got = %v, want = %v", got, "")
+			}
+		})
+	}
+}
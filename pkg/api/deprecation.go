@@ -0,0 +1,29 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// DeprecationMiddleware announces that a route is deprecated with the
+// Deprecation (RFC 9745) and Sunset (RFC 8594) headers, and links to
+// the same path under successorPrefix.
+type DeprecationMiddleware struct {
+	deprecatedAt    time.Time
+	sunsetAt        time.Time
+	successorPrefix string
+}
+
+func NewDeprecationMiddleware(deprecatedAt, sunsetAt time.Time, successorPrefix string) *DeprecationMiddleware {
+	return &DeprecationMiddleware{deprecatedAt, sunsetAt, successorPrefix}
+}
+
+func (mw *DeprecationMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", fmt.Sprintf("@%d", mw.deprecatedAt.Unix()))
+		w.Header().Set("Sunset", mw.sunsetAt.UTC().Format(http.TimeFormat))
+		w.Header().Add("Link", fmt.Sprintf(`<%s%s>; rel="successor-version"`, mw.successorPrefix, r.URL.Path))
+		next.ServeHTTP(w, r)
+	})
+}
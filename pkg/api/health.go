@@ -1,12 +1,20 @@
 package api
 
 import (
+	"encoding/json"
 	"net/http"
 	"sync/atomic"
 )
 
+const (
+	ReadyzStatusOK          = "ok"
+	ReadyzStatusDegraded    = "degraded"
+	ReadyzStatusUnavailable = "unavailable"
+)
+
 var (
-	healthy int32
+	healthy      int32
+	shuttingDown int32
 )
 
 func GetHealthy() *int32 {
@@ -24,3 +32,40 @@ func HealthzHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	w.WriteHeader(http.StatusServiceUnavailable)
 }
+
+// ReadinessCheck reports the health of a dependency, such as the cache,
+// without which the service runs degraded
+type ReadinessCheck struct {
+	Name  string
+	Check func() error
+}
+
+type readyzResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// NewReadyzHandler reports whether the instance should receive traffic. It
+// fails once the instance shuts down. Failing checks only degrade the status,
+// since every instance would fail them at once, e.g. during a Redis outage.
+func NewReadyzHandler(checks ...ReadinessCheck) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := readyzResponse{Status: ReadyzStatusOK, Checks: map[string]string{}}
+		for _, check := range checks {
+			resp.Checks[check.Name] = ReadyzStatusOK
+			if err := check.Check(); err != nil {
+				resp.Checks[check.Name] = err.Error()
+				resp.Status = ReadyzStatusDegraded
+			}
+		}
+
+		code := http.StatusOK
+		if atomic.LoadInt32(&shuttingDown) == 1 {
+			resp.Status = ReadyzStatusUnavailable
+			code = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
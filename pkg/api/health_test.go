@@ -0,0 +1,44 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestReadyzHandler(t *testing.T) {
+	var cacheErr error
+	handler := NewReadyzHandler(ReadinessCheck{Name: "cache", Check: func() error { return cacheErr }})
+
+	cases := []struct {
+		name         string
+		cacheErr     error
+		shuttingDown int32
+		wantCode     int
+		wantStatus   string
+	}{
+		{"healthy", nil, 0, http.StatusOK, ReadyzStatusOK},
+		{"cache unavailable", errors.New("cache is unavailable"), 0, http.StatusOK, ReadyzStatusDegraded},
+		{"shutting down", nil, 1, http.StatusServiceUnavailable, ReadyzStatusUnavailable},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cacheErr = tc.cacheErr
+			atomic.StoreInt32(&shuttingDown, tc.shuttingDown)
+			defer atomic.StoreInt32(&shuttingDown, 0)
+
+			w := httptest.NewRecorder()
+			handler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			var resp readyzResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatalf("got = %v, want = %v", err, nil)
+			}
+			if w.Code != tc.wantCode || resp.Status != tc.wantStatus {
+				t.Fatalf("got = %v, %v, want = %v, %v", w.Code, resp.Status, tc.wantCode, tc.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+const (
+	IdempotencyKeyHeader      = "Idempotency-Key"
+	IdempotencyClientHeader   = "Idempotency-Client-Id"
+	IdempotentReplayedHeader  = "Idempotent-Replayed"
+	maxIdempotencyKeyLength   = 255
+	rdbIdempotencyKeyTemplate = "user_service:idempotency:%s"
+)
+
+var (
+	DefaultIdempotencyTTL = 24 * time.Hour
+	// idempotencyLockTTL bounds how long a request which never completes,
+	// e.g. because the replica crashed, blocks its key
+	idempotencyLockTTL = time.Minute
+)
+
+var (
+	ErrIdempotencyKeyInvalid  = errors.New("idempotency key must be between 1 and 255 characters")
+	ErrIdempotencyCallerUnset = errors.New("idempotency key requires an Authorization or Idempotency-Client-Id header")
+	ErrIdempotencyKeyReused   = errors.New("idempotency key was already used for a different request")
+	ErrIdempotencyKeyInFlight = errors.New("a request with the same idempotency key is in progress")
+)
+
+type IdempotencyConfig struct {
+	// IdempotencyTTL is how long responses are kept for replays
+	IdempotencyTTL time.Duration `mapstructure:"idempotency-ttl"`
+}
+
+// idempotentResponse is stored in redis under the caller's key. It is
+// written without a response while the first request is in progress.
+type idempotentResponse struct {
+	Fingerprint string      `json:"fingerprint"`
+	Done        bool        `json:"done"`
+	StatusCode  int         `json:"statusCode,omitempty"`
+	Header      http.Header `json:"header,omitempty"`
+	Body        []byte      `json:"body,omitempty"`
+}
+
+// IdempotencyMiddleware replays the stored response of mutating requests
+// which repeat an Idempotency-Key, instead of performing them again.
+// Requests without the header are passed through.
+type IdempotencyMiddleware struct {
+	rdb    redis.UniversalClient
+	ttl    time.Duration
+	logger *zap.Logger
+}
+
+func NewIdempotencyMiddleware(rdb redis.UniversalClient, cfg IdempotencyConfig, logger *zap.Logger) *IdempotencyMiddleware {
+	ttl := cfg.IdempotencyTTL
+	if ttl <= 0 {
+		ttl = DefaultIdempotencyTTL
+	}
+	return &IdempotencyMiddleware{rdb: rdb, ttl: ttl, logger: logger}
+}
+
+func isMutatingMethod(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// callerID identifies the caller by its Authorization header, or else by
+// the ID it generated for itself. It is empty when the caller sends neither,
+// since callers sharing an IP address cannot be told apart.
+func callerID(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		return "auth:" + auth
+	}
+	if id := r.Header.Get(IdempotencyClientHeader); id != "" {
+		return "client:" + id
+	}
+	return ""
+}
+
+func sha256Hex(parts ...string) string {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (mw *IdempotencyMiddleware) rdbKey(caller, key string) string {
+	// hashed so that credentials are not stored in redis
+	return fmt.Sprintf(rdbIdempotencyKeyTemplate, sha256Hex(caller, key))
+}
+
+func (mw *IdempotencyMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" || !isMutatingMethod(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			writeJSONError(w, http.StatusBadRequest, ErrIdempotencyKeyInvalid)
+			return
+		}
+		caller := callerID(r)
+		if caller == "" {
+			writeJSONError(w, http.StatusBadRequest, ErrIdempotencyCallerUnset)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		fingerprint := sha256Hex(r.Method, r.URL.Path, string(body))
+		rdbKey := mw.rdbKey(caller, key)
+
+		// a key left locked by a client which went away expires after idempotencyLockTTL
+		ctx := r.Context()
+		lock, _ := json.Marshal(idempotentResponse{Fingerprint: fingerprint})
+		acquired, err := mw.rdb.SetNX(ctx, rdbKey, lock, idempotencyLockTTL).Result()
+		if err != nil {
+			mw.logger.Warn("idempotency key lock failed", zap.Error(err))
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !acquired {
+			mw.replay(ctx, w, rdbKey, fingerprint)
+			return
+		}
+
+		brw := newBufferedResponseWriter(w)
+		next.ServeHTTP(brw, r)
+		if brw.streaming || brw.statusCode >= http.StatusInternalServerError {
+			// server errors are not stored, so that the request can be retried
+			if err := mw.rdb.Del(ctx, rdbKey).Err(); err != nil {
+				mw.logger.Warn("idempotency key release failed", zap.Error(err))
+			}
+			if !brw.streaming {
+				brw.flushTo(w)
+			}
+			return
+		}
+
+		data, err := json.Marshal(idempotentResponse{
+			Fingerprint: fingerprint,
+			Done:        true,
+			StatusCode:  brw.statusCode,
+			Header:      brw.header,
+			Body:        brw.body.Bytes(),
+		})
+		if err == nil {
+			err = mw.rdb.Set(ctx, rdbKey, data, mw.ttl).Err()
+		}
+		if err != nil {
+			mw.logger.Warn("idempotent response store failed", zap.Error(err))
+		}
+		brw.flushTo(w)
+	})
+}
+
+// replay writes the stored response of the request holding rdbKey
+func (mw *IdempotencyMiddleware) replay(ctx context.Context, w http.ResponseWriter, rdbKey, fingerprint string) {
+	data, err := mw.rdb.Get(ctx, rdbKey).Bytes()
+	if errors.Is(err, redis.Nil) {
+		// released by a failed request in the meantime
+		writeJSONError(w, http.StatusConflict, ErrIdempotencyKeyInFlight)
+		return
+	}
+	if err != nil {
+		mw.logger.Warn("idempotent response read failed", zap.Error(err))
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	var resp idempotentResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if resp.Fingerprint != fingerprint {
+		writeJSONError(w, http.StatusUnprocessableEntity, ErrIdempotencyKeyReused)
+		return
+	}
+	if !resp.Done {
+		writeJSONError(w, http.StatusConflict, ErrIdempotencyKeyInFlight)
+		return
+	}
+
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.Header().Set(IdempotentReplayedHeader, "true")
+	w.WriteHeader(resp.StatusCode)
+	if _, err := w.Write(resp.Body); err != nil {
+		mw.logger.Warn("idempotent response replay failed", zap.Error(err))
+	}
+}
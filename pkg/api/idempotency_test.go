@@ -0,0 +1,220 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/awhdesmond/user-service/pkg/common"
+	"go.uber.org/zap"
+)
+
+func makeIdempotencyTestHandler(t *testing.T, handler http.HandlerFunc) http.Handler {
+	rdb, err := common.MakeRedisClient(common.TestRedisCfg)
+	if err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	t.Cleanup(func() {
+		ctx := context.Background()
+		keys, _ := rdb.Keys(ctx, fmt.Sprintf(rdbIdempotencyKeyTemplate, "*")).Result()
+		if len(keys) > 0 {
+			rdb.Del(ctx, keys...)
+		}
+	})
+	mw := NewIdempotencyMiddleware(rdb, IdempotencyConfig{IdempotencyTTL: time.Minute}, zap.NewNop())
+	return mw.Handler(handler)
+}
+
+func sendIdempotent(handler http.Handler, method, key, auth, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/v1/hello/apple", strings.NewReader(body))
+	if key != "" {
+		req.Header.Set(IdempotencyKeyHeader, key)
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestIdempotencyReplay(t *testing.T) {
+	var calls int32
+	handler := makeIdempotencyTestHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		writeJSON(w, http.StatusCreated, fmt.Sprintf(`{"call": %d}`, n))
+	})
+
+	first := sendIdempotent(handler, http.MethodPut, "key-1", "Bearer apple", `{"dateOfBirth": "2020-01-02"}`)
+	if first.Code != http.StatusCreated {
+		t.Fatalf("got = %v, want = %v", first.Code, http.StatusCreated)
+	}
+
+	replay := sendIdempotent(handler, http.MethodPut, "key-1", "Bearer apple", `{"dateOfBirth": "2020-01-02"}`)
+	if replay.Code != http.StatusCreated {
+		t.Fatalf("got = %v, want = %v", replay.Code, http.StatusCreated)
+	}
+	if replay.Body.String() != first.Body.String() {
+		t.Fatalf("got = %v, want = %v", replay.Body.String(), first.Body.String())
+	}
+	if got := replay.Header().Get("Content-Type"); got != "application/json; charset=utf-8" {
+		t.Fatalf("got = %v, want = %v", got, "application/json; charset=utf-8")
+	}
+	if got := replay.Header().Get(IdempotentReplayedHeader); got != "true" {
+		t.Fatalf("got = %v, want = %v", got, "true")
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Fatalf("got = %v, want = %v", got, 1)
+	}
+
+	// a different payload cannot reuse the key
+	w := sendIdempotent(handler, http.MethodPut, "key-1", "Bearer apple", `{"dateOfBirth": "2021-01-02"}`)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("got = %v, want = %v", w.Code, http.StatusUnprocessableEntity)
+	}
+	common.TestIsResponseErrorExpected(w, t, ErrIdempotencyKeyReused.Error())
+
+	// keys are scoped per caller
+	w = sendIdempotent(handler, http.MethodPut, "key-1", "Bearer other", `{"dateOfBirth": "2021-01-02"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got = %v, want = %v", w.Code, http.StatusCreated)
+	}
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Fatalf("got = %v, want = %v", got, 2)
+	}
+}
+
+func TestIdempotencyPassThrough(t *testing.T) {
+	var calls int32
+	handler := makeIdempotencyTestHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	cases := []struct {
+		name   string
+		method string
+		key    string
+	}{
+		{"without key", http.MethodPut, ""},
+		{"read", http.MethodGet, "key-2"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			before := atomic.LoadInt32(&calls)
+			sendIdempotent(handler, tc.method, tc.key, "", "")
+			sendIdempotent(handler, tc.method, tc.key, "", "")
+			if got := atomic.LoadInt32(&calls) - before; got != 2 {
+				t.Fatalf("got = %v, want = %v", got, 2)
+			}
+		})
+	}
+}
+
+func TestIdempotencyServerErrorsAreRetried(t *testing.T) {
+	var calls int32
+	handler := makeIdempotencyTestHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			writeJSON(w, http.StatusInternalServerError, `{"error": "unexpected database error"}`)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	w := sendIdempotent(handler, http.MethodDelete, "key-3", "Bearer apple", "")
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("got = %v, want = %v", w.Code, http.StatusInternalServerError)
+	}
+	w = sendIdempotent(handler, http.MethodDelete, "key-3", "Bearer apple", "")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("got = %v, want = %v", w.Code, http.StatusNoContent)
+	}
+	if w.Header().Get(IdempotentReplayedHeader) != "" {
+		t.Fatalf("got = %v, want = %v", w.Header().Get(IdempotentReplayedHeader), "")
+	}
+}
+
+func TestIdempotencyInFlight(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := makeIdempotencyTestHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- sendIdempotent(handler, http.MethodPut, "key-4", "Bearer apple", `{}`)
+	}()
+	<-started
+
+	w := sendIdempotent(handler, http.MethodPut, "key-4", "Bearer apple", `{}`)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("got = %v, want = %v", w.Code, http.StatusConflict)
+	}
+
+	close(release)
+	if w := <-done; w.Code != http.StatusNoContent {
+		t.Fatalf("got = %v, want = %v", w.Code, http.StatusNoContent)
+	}
+	w = sendIdempotent(handler, http.MethodPut, "key-4", "Bearer apple", `{}`)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("got = %v, want = %v", w.Code, http.StatusNoContent)
+	}
+}
+
+func TestIdempotencyKeyInvalid(t *testing.T) {
+	handler := makeIdempotencyTestHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	w := sendIdempotent(handler, http.MethodPut, strings.Repeat("k", maxIdempotencyKeyLength+1), "Bearer apple", `{}`)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("got = %v, want = %v", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestIdempotencyCaller(t *testing.T) {
+	var calls int32
+	handler := makeIdempotencyTestHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	send := func(clientID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodDelete, "/v1/hello/apple", nil)
+		req.Header.Set(IdempotencyKeyHeader, "key-5")
+		if clientID != "" {
+			req.Header.Set(IdempotencyClientHeader, clientID)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// callers sharing an IP address cannot be told apart
+	w := send("")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("got = %v, want = %v", w.Code, http.StatusBadRequest)
+	}
+	common.TestIsResponseErrorExpected(w, t, ErrIdempotencyCallerUnset.Error())
+
+	send("client-1")
+	w = send("client-1")
+	if got := w.Header().Get(IdempotentReplayedHeader); got != "true" {
+		t.Fatalf("got = %v, want = %v", got, "true")
+	}
+	// keys are scoped per client ID
+	w = send("client-2")
+	if got := w.Header().Get(IdempotentReplayedHeader); got != "" {
+		t.Fatalf("got = %v, want = %v", got, "")
+	}
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Fatalf("got = %v, want = %v", got, 2)
+	}
+}
@@ -0,0 +1,231 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/awhdesmond/user-service/pkg/common"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+	swaggerFiles "github.com/swaggo/files"
+	"github.com/vmihailenco/msgpack/v5"
+	"go.uber.org/zap"
+)
+
+const (
+	OpenAPIPath   = "/openapi.json"
+	SwaggerUIPath = "/docs/"
+)
+
+// swaggerInitializer replaces the initializer bundled with Swagger UI,
+// which points at the petstore example, with one that loads our spec.
+var swaggerInitializer = []byte(`window.onload = function() {
+  window.ui = SwaggerUIBundle({
+    url: "` + OpenAPIPath + `",
+    dom_id: '#swagger-ui',
+    deepLinking: true,
+    presets: [
+      SwaggerUIBundle.presets.apis,
+      SwaggerUIStandalonePreset
+    ],
+    plugins: [
+      SwaggerUIBundle.plugins.DownloadUrl
+    ],
+    layout: "StandaloneLayout"
+  });
+};
+`)
+
+func init() {
+	// bodies which the spec describes as plain strings
+	openapi3filter.RegisterBodyDecoder("text/calendar", openapi3filter.FileBodyDecoder)
+	openapi3filter.RegisterBodyDecoder("text/event-stream", openapi3filter.FileBodyDecoder)
+	openapi3filter.RegisterBodyDecoder(common.MediaTypeProtobuf, openapi3filter.FileBodyDecoder)
+	// MessagePack bodies are validated against the same schemas as JSON bodies
+	openapi3filter.RegisterBodyDecoder(common.MediaTypeMsgpack, msgpackBodyDecoder)
+}
+
+func msgpackBodyDecoder(
+	body io.Reader,
+	_ http.Header,
+	_ *openapi3.SchemaRef,
+	_ openapi3filter.EncodingFn,
+) (interface{}, error) {
+	var v interface{}
+	if err := msgpack.NewDecoder(body).Decode(&v); err != nil {
+		return nil, &openapi3filter.ParseError{Kind: openapi3filter.KindInvalidFormat, Cause: err}
+	}
+	// convert to the types that encoding/json would have produced
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, &openapi3filter.ParseError{Kind: openapi3filter.KindInvalidFormat, Cause: err}
+	}
+	var out interface{}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, &openapi3filter.ParseError{Kind: openapi3filter.KindInvalidFormat, Cause: err}
+	}
+	return out, nil
+}
+
+// registerJSONBodyDecoders decodes the structured +json media types of doc,
+// such as vendor media types, as JSON
+func registerJSONBodyDecoders(doc *openapi3.T) {
+	register := func(content openapi3.Content) {
+		for mediaType := range content {
+			if strings.HasSuffix(mediaType, "+json") && openapi3filter.RegisteredBodyDecoder(mediaType) == nil {
+				openapi3filter.RegisterBodyDecoder(mediaType, openapi3filter.RegisteredBodyDecoder("application/json"))
+			}
+		}
+	}
+	for _, item := range doc.Paths {
+		for _, op := range item.Operations() {
+			if op.RequestBody != nil && op.RequestBody.Value != nil {
+				register(op.RequestBody.Value.Content)
+			}
+			for _, resp := range op.Responses {
+				if resp.Value != nil {
+					register(resp.Value.Content)
+				}
+			}
+		}
+	}
+}
+
+type OpenAPIConfig struct {
+	// ValidateRequests rejects requests which do not match the spec with 400
+	ValidateRequests bool `mapstructure:"openapi-validate-requests"`
+	// ValidateResponses replaces responses which do not match the spec with 500.
+	// Responses are buffered, so it is meant for tests rather than production.
+	ValidateResponses bool `mapstructure:"openapi-validate-responses"`
+	// SwaggerUI serves Swagger UI at /docs/
+	SwaggerUI bool `mapstructure:"swagger-ui"`
+}
+
+// OpenAPI serves an OpenAPI definition and validates traffic against it
+type OpenAPI struct {
+	doc    *openapi3.T
+	json   []byte
+	router routers.Router
+	logger *zap.Logger
+}
+
+// NewOpenAPI loads and validates the YAML or JSON definition in spec
+func NewOpenAPI(spec []byte, logger *zap.Logger) (*OpenAPI, error) {
+	loader := openapi3.NewLoader()
+	doc, err := loader.LoadFromData(spec)
+	if err != nil {
+		return nil, fmt.Errorf("load openapi spec: %w", err)
+	}
+	if err := doc.Validate(loader.Context); err != nil {
+		return nil, fmt.Errorf("invalid openapi spec: %w", err)
+	}
+
+	registerJSONBodyDecoders(doc)
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	router, err := gorillamux.NewRouter(doc)
+	if err != nil {
+		return nil, err
+	}
+	return &OpenAPI{doc: doc, json: data, router: router, logger: logger}, nil
+}
+
+// SpecHandler serves the definition as JSON
+func (o *OpenAPI) SpecHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if _, err := w.Write(o.json); err != nil {
+		o.logger.Warn("error writing openapi spec", zap.Error(err))
+	}
+}
+
+// SwaggerUIHandler serves the bundled Swagger UI, to be mounted at SwaggerUIPath
+func (o *OpenAPI) SwaggerUIHandler() http.Handler {
+	files := http.StripPrefix(strings.TrimSuffix(SwaggerUIPath, "/"), http.FileServer(swaggerFiles.HTTP))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == SwaggerUIPath+"swagger-initializer.js" {
+			w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+			if _, err := w.Write(swaggerInitializer); err != nil {
+				o.logger.Warn("error writing swagger initializer", zap.Error(err))
+			}
+			return
+		}
+		files.ServeHTTP(w, r)
+	})
+}
+
+type OpenAPIValidationMiddleware struct {
+	openapi           *OpenAPI
+	validateRequests  bool
+	validateResponses bool
+}
+
+func NewOpenAPIValidationMiddleware(openapi *OpenAPI, cfg OpenAPIConfig) *OpenAPIValidationMiddleware {
+	return &OpenAPIValidationMiddleware{openapi, cfg.ValidateRequests, cfg.ValidateResponses}
+}
+
+// Handler checks requests, and optionally responses, of the operations
+// in the definition. Other routes are passed through untouched.
+func (mw *OpenAPIValidationMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, pathParams, err := mw.openapi.router.FindRoute(r)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		reqInput := &openapi3filter.RequestValidationInput{
+			Request:    r,
+			PathParams: pathParams,
+			Route:      route,
+			Options: &openapi3filter.Options{
+				AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+			},
+		}
+		if mw.validateRequests {
+			if err := openapi3filter.ValidateRequest(r.Context(), reqInput); err != nil {
+				writeJSONError(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+		if !mw.validateResponses {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		brw := newBufferedResponseWriter(w)
+		next.ServeHTTP(brw, r)
+		if brw.streaming {
+			// the body has already been sent
+			return
+		}
+
+		err = openapi3filter.ValidateResponse(context.Background(), &openapi3filter.ResponseValidationInput{
+			RequestValidationInput: reqInput,
+			Status:                 brw.statusCode,
+			Header:                 brw.header,
+			Body:                   io.NopCloser(bytes.NewReader(brw.body.Bytes())),
+			Options:                &openapi3filter.Options{IncludeResponseStatus: true},
+		})
+		if err != nil {
+			mw.openapi.logger.Error("response does not match the openapi spec",
+				zap.String("method", r.Method),
+				zap.String("path", route.Path),
+				zap.Int("statusCode", brw.statusCode),
+				zap.Error(err),
+			)
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		brw.flushTo(w)
+	})
+}
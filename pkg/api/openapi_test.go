@@ -0,0 +1,235 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/awhdesmond/user-service/docs"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+func makeOpenAPITestHandler(t *testing.T, cfg OpenAPIConfig, handler http.HandlerFunc) http.Handler {
+	openapi, err := NewOpenAPI(docs.OpenAPISpec, zap.NewNop())
+	if err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+
+	r := mux.NewRouter()
+	r.Use(NewOpenAPIValidationMiddleware(openapi, cfg).Handler)
+	r.HandleFunc(OpenAPIPath, openapi.SpecHandler)
+	r.PathPrefix(SwaggerUIPath).Handler(openapi.SwaggerUIHandler())
+	r.PathPrefix("/").Handler(handler)
+	return r
+}
+
+func writeJSON(w http.ResponseWriter, code int, body string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	fmt.Fprint(w, body)
+}
+
+func TestOpenAPISpecHandler(t *testing.T) {
+	handler := makeOpenAPITestHandler(t, OpenAPIConfig{}, nil)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, OpenAPIPath, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got = %v, want = %v", w.Code, http.StatusOK)
+	}
+
+	var spec struct {
+		OpenAPI string                 `json:"openapi"`
+		Paths   map[string]interface{} `json:"paths"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&spec); err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	if spec.OpenAPI != "3.0.3" {
+		t.Fatalf("got = %v, want = %v", spec.OpenAPI, "3.0.3")
+	}
+	if _, ok := spec.Paths["/hello/{username}"]; !ok {
+		t.Fatalf("got = %v, want = %v", ok, true)
+	}
+}
+
+func TestSwaggerUIHandler(t *testing.T) {
+	handler := makeOpenAPITestHandler(t, OpenAPIConfig{}, nil)
+
+	cases := []struct {
+		path     string
+		contains string
+	}{
+		{SwaggerUIPath, "swagger-ui"},
+		{SwaggerUIPath + "swagger-initializer.js", OpenAPIPath},
+		{SwaggerUIPath + "swagger-ui-bundle.js", "SwaggerUIBundle"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.path, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("got = %v, want = %v", w.Code, http.StatusOK)
+			}
+			if !strings.Contains(w.Body.String(), tc.contains) {
+				t.Fatalf("got = %v, want = %v", false, true)
+			}
+		})
+	}
+}
+
+func TestOpenAPIValidateRequests(t *testing.T) {
+	handler := makeOpenAPITestHandler(t, OpenAPIConfig{ValidateRequests: true}, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	cases := []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		body        string
+		want        int
+	}{
+		{"valid upsert", http.MethodPut, "/hello/apple", "application/json", `{"dateOfBirth": "2020-01-02"}`, http.StatusNoContent},
+		{"upsert with wrong type", http.MethodPut, "/hello/apple", "application/json", `{"dateOfBirth": 1}`, http.StatusBadRequest},
+		{"upsert without body", http.MethodPut, "/hello/apple", "application/json", ``, http.StatusBadRequest},
+		{"valid msgpack upsert", http.MethodPut, "/hello/apple", "application/msgpack", "\x81\xabdateOfBirth\xaa2020-01-02", http.StatusNoContent},
+		{"msgpack upsert with wrong type", http.MethodPut, "/hello/apple", "application/msgpack", "\x81\xabdateOfBirth\x01", http.StatusBadRequest},
+		{"protobuf upsert", http.MethodPut, "/hello/apple", "application/x-protobuf", "\x12\x0a2020-01-02", http.StatusNoContent},
+		{"unsupported content type", http.MethodPut, "/hello/apple", "text/plain", `2020-01-02`, http.StatusBadRequest},
+		{"valid days", http.MethodGet, "/birthdays?days=7", "", ``, http.StatusNoContent},
+		{"days out of range", http.MethodGet, "/birthdays?days=400", "", ``, http.StatusBadRequest},
+		{"days not a number", http.MethodGet, "/birthdays?days=week", "", ``, http.StatusBadRequest},
+		{"route not in spec", http.MethodGet, "/healthz", "", ``, http.StatusNoContent},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			if tc.contentType != "" {
+				req.Header.Set("Content-Type", tc.contentType)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code != tc.want {
+				t.Fatalf("got = %v, want = %v", w.Code, tc.want)
+			}
+		})
+	}
+}
+
+func TestOpenAPIValidateResponses(t *testing.T) {
+	cases := []struct {
+		name    string
+		path    string
+		handler http.HandlerFunc
+		want    int
+	}{
+		{
+			"valid response",
+			"/hello/apple",
+			func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, http.StatusOK, `{"message": "Hello, apple! Happy birthday!"}`)
+			},
+			http.StatusOK,
+		},
+		{
+			"valid error response",
+			"/hello/apple",
+			func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, http.StatusNotFound, `{"error": "user not found"}`)
+			},
+			http.StatusNotFound,
+		},
+		{
+			"wrong type",
+			"/hello/apple",
+			func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, http.StatusOK, `{"message": 1}`)
+			},
+			http.StatusInternalServerError,
+		},
+		{
+			"wrong content type",
+			"/hello/apple",
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				fmt.Fprint(w, "Hello, apple!")
+			},
+			http.StatusInternalServerError,
+		},
+		{
+			"error response without error",
+			"/hello/apple",
+			func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, http.StatusNotFound, `{}`)
+			},
+			http.StatusInternalServerError,
+		},
+		{
+			"vendor media type",
+			"/v1/hello/apple",
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/vnd.users.v2+json")
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `{"error": {"code": 404, "message": "user not found"}}`)
+			},
+			http.StatusNotFound,
+		},
+		{
+			"vendor media type with wrong shape",
+			"/v1/hello/apple",
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/vnd.users.v2+json")
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `{"error": "user not found"}`)
+			},
+			http.StatusInternalServerError,
+		},
+		{
+			"calendar",
+			"/birthdays.ics",
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+				fmt.Fprint(w, "BEGIN:VCALENDAR\r\nEND:VCALENDAR\r\n")
+			},
+			http.StatusOK,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			handler := makeOpenAPITestHandler(t, OpenAPIConfig{ValidateResponses: true}, tc.handler)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.path, nil))
+			if w.Code != tc.want {
+				t.Fatalf("got = %v, want = %v", w.Code, tc.want)
+			}
+		})
+	}
+}
+
+func TestOpenAPIValidateResponsesStreaming(t *testing.T) {
+	handler := makeOpenAPITestHandler(t, OpenAPIConfig{ValidateResponses: true}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "retry: 3000\n\n")
+		w.(http.Flusher).Flush()
+		fmt.Fprint(w, ": keep-alive\n\n")
+	})
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/events", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got = %v, want = %v", w.Code, http.StatusOK)
+	}
+	if !w.Flushed {
+		t.Fatalf("got = %v, want = %v", w.Flushed, true)
+	}
+	want := "retry: 3000\n\n: keep-alive\n\n"
+	if w.Body.String() != want {
+		t.Fatalf("got = %v, want = %v", w.Body.String(), want)
+	}
+}
@@ -2,9 +2,13 @@ package api
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
 	"errors"
 	"net"
 	"net/http"
+
+	"github.com/awhdesmond/user-service/pkg/common"
 )
 
 type wrappedResponseWriter struct {
@@ -29,6 +33,17 @@ func (wrw *wrappedResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error)
 	return h.Hijack()
 }
 
+func (wrw *wrappedResponseWriter) Flush() {
+	if f, ok := wrw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap allows http.ResponseController to reach the underlying ResponseWriter
+func (wrw *wrappedResponseWriter) Unwrap() http.ResponseWriter {
+	return wrw.ResponseWriter
+}
+
 type WrappedReponseWriterMiddleware struct{}
 
 func NewWrappedReponseWriterMiddleware() *WrappedReponseWriterMiddleware {
@@ -41,3 +56,65 @@ func (mw *WrappedReponseWriterMiddleware) Handler(next http.Handler) http.Handle
 		next.ServeHTTP(wrw, r)
 	})
 }
+
+// bufferedResponseWriter holds back the response until the middleware has inspected it.
+// Handlers which flush, such as event streams, are passed through as is.
+type bufferedResponseWriter struct {
+	w          http.ResponseWriter
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+	streaming  bool
+}
+
+func newBufferedResponseWriter(w http.ResponseWriter) *bufferedResponseWriter {
+	return &bufferedResponseWriter{w: w, header: http.Header{}, statusCode: http.StatusOK}
+}
+
+func (brw *bufferedResponseWriter) Header() http.Header {
+	if brw.streaming {
+		return brw.w.Header()
+	}
+	return brw.header
+}
+
+func (brw *bufferedResponseWriter) WriteHeader(code int) {
+	if brw.streaming {
+		brw.w.WriteHeader(code)
+		return
+	}
+	brw.statusCode = code
+}
+
+func (brw *bufferedResponseWriter) Write(b []byte) (int, error) {
+	if brw.streaming {
+		return brw.w.Write(b)
+	}
+	return brw.body.Write(b)
+}
+
+func (brw *bufferedResponseWriter) Flush() {
+	if !brw.streaming {
+		brw.flushTo(brw.w)
+		brw.streaming = true
+	}
+	if f, ok := brw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (brw *bufferedResponseWriter) flushTo(w http.ResponseWriter) {
+	for k, v := range brw.header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(brw.statusCode)
+	w.Write(brw.body.Bytes())
+}
+
+func writeJSONError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(common.GenericJSON{"error": err.Error()}); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
@@ -10,6 +10,8 @@ import (
 	"time"
 
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
 )
 
 var (
@@ -40,6 +42,12 @@ func SetupSignalHandler() (stopCh <-chan struct{}) {
 	return stop
 }
 
+// Closer is a resource released on shutdown, such as a store
+// which drains its queue
+type Closer interface {
+	Close(ctx context.Context) error
+}
+
 type Shutdown struct {
 	logger                *zap.Logger
 	serverShutdownTimeout time.Duration
@@ -54,16 +62,37 @@ func NewShutdown(logger *zap.Logger) (*Shutdown, error) {
 	return srv, nil
 }
 
-func (s *Shutdown) Graceful(stopCh <-chan struct{}, httpServer *http.Server) {
-	ctx := context.Background()
+// CloseOnShutdown closes closer as soon as httpServer starts shutting down,
+// for resources which hold requests open, such as the event broker whose
+// server-sent event streams never go idle and would otherwise delay the
+// shutdown until the timeout
+func (s *Shutdown) CloseOnShutdown(httpServer *http.Server, closer Closer) {
+	httpServer.RegisterOnShutdown(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), s.serverShutdownTimeout)
+		defer cancel()
+		if err := closer.Close(ctx); err != nil {
+			s.logger.Warn("graceful close failed", zap.Error(err))
+		}
+	})
+}
 
+func (s *Shutdown) Graceful(
+	stopCh <-chan struct{},
+	httpServer *http.Server,
+	grpcServer *grpc.Server,
+	grpcHealth *health.Server,
+	closers ...Closer,
+) {
 	// wait for SIGTERM or SIGINT
 	<-stopCh
-	ctx, cancel := context.WithTimeout(ctx, s.serverShutdownTimeout)
-	defer cancel()
 
 	// all calls to /healthz and /readyz will fail from now on
 	atomic.StoreInt32(GetHealthy(), 0)
+	atomic.StoreInt32(&shuttingDown, 1)
+	// all gRPC health checks will report NOT_SERVING from now on
+	if grpcHealth != nil {
+		grpcHealth.Shutdown()
+	}
 
 	// close cache pool
 	s.logger.Info("Shutting down server", zap.Duration("timeout", s.serverShutdownTimeout))
@@ -72,10 +101,44 @@ func (s *Shutdown) Graceful(stopCh <-chan struct{}, httpServer *http.Server) {
 	// the readiness check interval must be lower than the timeout
 	time.Sleep(s.serverShutdownTimeout)
 
+	ctx, cancel := context.WithTimeout(context.Background(), s.serverShutdownTimeout)
+	defer cancel()
+
 	// determine if the http server was started
 	if httpServer != nil {
 		if err := httpServer.Shutdown(ctx); err != nil {
 			s.logger.Warn("HTTP server graceful shutdown failed", zap.Error(err))
 		}
 	}
+
+	// determine if the grpc server was started
+	if grpcServer != nil {
+		s.stopGRPC(ctx, grpcServer)
+	}
+
+	// the servers no longer queue work, drain what they queued
+	closeCtx, closeCancel := context.WithTimeout(context.Background(), s.serverShutdownTimeout)
+	defer closeCancel()
+	for _, closer := range closers {
+		if err := closer.Close(closeCtx); err != nil {
+			s.logger.Warn("graceful close failed", zap.Error(err))
+		}
+	}
+}
+
+// stopGRPC waits for the pending RPCs until ctx is done, e.g. for streams
+// which do not end by themselves, then closes their connections
+func (s *Shutdown) stopGRPC(ctx context.Context, grpcServer *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		s.logger.Warn("gRPC server graceful shutdown timed out")
+		grpcServer.Stop()
+		<-stopped
+	}
 }
@@ -0,0 +1,87 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type closerFunc func(ctx context.Context) error
+
+func (f closerFunc) Close(ctx context.Context) error {
+	return f(ctx)
+}
+
+func TestGraceful(t *testing.T) {
+	defer atomic.StoreInt32(&healthy, 1)
+	defer atomic.StoreInt32(&shuttingDown, 0)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	srv := &http.Server{Handler: http.NotFoundHandler()}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(lis) }()
+
+	var closedAfterServer bool
+	closer := closerFunc(func(ctx context.Context) error {
+		// the server no longer accepts requests which would queue work
+		_, err := http.Get("http://" + lis.Addr().String())
+		closedAfterServer = err != nil
+		return nil
+	})
+
+	sd := &Shutdown{logger: zap.NewNop(), serverShutdownTimeout: 10 * time.Millisecond}
+	stopCh := make(chan struct{})
+	close(stopCh)
+	sd.Graceful(stopCh, srv, nil, nil, closer)
+
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		t.Fatalf("got = %v, want = %v", err, http.ErrServerClosed)
+	}
+	if !closedAfterServer {
+		t.Fatalf("got = %v, want = %v", "closed before the server stopped", "closed after the server stopped")
+	}
+}
+
+func TestCloseOnShutdown(t *testing.T) {
+	defer atomic.StoreInt32(&healthy, 1)
+	defer atomic.StoreInt32(&shuttingDown, 0)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	// a stream which only ends once its broker is closed
+	streamEnd := make(chan struct{})
+	streaming := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		close(streaming)
+		<-streamEnd
+	})}
+	go srv.Serve(lis)
+
+	go http.Get("http://" + lis.Addr().String())
+	<-streaming
+
+	sd := &Shutdown{logger: zap.NewNop(), serverShutdownTimeout: time.Second}
+	sd.CloseOnShutdown(srv, closerFunc(func(ctx context.Context) error {
+		close(streamEnd)
+		return nil
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), sd.serverShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+}
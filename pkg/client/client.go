@@ -0,0 +1,324 @@
+// Package client implements users.Service over the users HTTP API,
+// so that it can be swapped in for the local service.
+package client
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/awhdesmond/user-service/pkg/api"
+	"github.com/awhdesmond/user-service/pkg/users"
+	"github.com/go-kit/kit/endpoint"
+	kithttp "github.com/go-kit/kit/transport/http"
+)
+
+var (
+	DefaultTimeout    = 5 * time.Second
+	DefaultMaxRetries = 3
+	DefaultBackoff    = 100 * time.Millisecond
+	DefaultMaxBackoff = 2 * time.Second
+)
+
+type Config struct {
+	// BaseURL of the users API, e.g. http://localhost:8080
+	BaseURL string
+	// Timeout of each attempt
+	Timeout time.Duration
+	// MaxRetries of requests which failed with a 5xx response or a transport error.
+	// A negative value disables retries.
+	MaxRetries int
+	// Backoff is the delay before the first retry. It doubles after every retry,
+	// up to MaxBackoff, and is jittered.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// HTTPClient defaults to http.DefaultClient
+	HTTPClient *http.Client
+	// AdminToken is sent as a bearer token with Export and Erase,
+	// which the server restricts to operators
+	AdminToken string
+}
+
+type client struct {
+	read              endpoint.Endpoint
+	upsert            endpoint.Endpoint
+	delete            endpoint.Endpoint
+	list              endpoint.Endpoint
+	upcoming          endpoint.Endpoint
+	birthdayCalendar  endpoint.Endpoint
+	birthdaysCalendar endpoint.Endpoint
+	export            endpoint.Endpoint
+	erase             endpoint.Endpoint
+}
+
+// New returns a users.Service backed by the users HTTP API at cfg.BaseURL.
+// Zero values in cfg are replaced by their defaults.
+func New(cfg Config) (users.Service, error) {
+	tgt, err := url.Parse(cfg.BaseURL)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	if cfg.MaxRetries < 0 {
+		cfg.MaxRetries = 0
+	} else if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = DefaultMaxRetries
+	}
+	if cfg.Backoff <= 0 {
+		cfg.Backoff = DefaultBackoff
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = DefaultMaxBackoff
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = http.DefaultClient
+	}
+
+	pin := &readPrimaryPin{}
+	opts := []kithttp.ClientOption{
+		kithttp.SetClient(cfg.HTTPClient),
+		kithttp.ClientBefore(setIdempotencyKey(randomHex()), pin.set),
+		kithttp.ClientAfter(pin.save),
+	}
+	adminOpts := append([]kithttp.ClientOption{kithttp.ClientBefore(setAdminToken(cfg.AdminToken))}, opts...)
+	mw := endpoint.Chain(
+		retryMiddleware(cfg.MaxRetries, cfg.Backoff, cfg.MaxBackoff),
+		timeoutMiddleware(cfg.Timeout),
+	)
+
+	return &client{
+		read: mw(kithttp.NewClient(
+			http.MethodGet, tgt, encodeReadRequest, decodeReadResponse, opts...,
+		).Endpoint()),
+		upsert: mw(kithttp.NewClient(
+			http.MethodPut, tgt, encodeUpsertRequest, decodeUpsertResponse, opts...,
+		).Endpoint()),
+		delete: mw(kithttp.NewClient(
+			http.MethodDelete, tgt, encodeDeleteRequest, decodeDeleteResponse, opts...,
+		).Endpoint()),
+		list: mw(kithttp.NewClient(
+			http.MethodGet, tgt, encodeListRequest, decodeListResponse, opts...,
+		).Endpoint()),
+		upcoming: mw(kithttp.NewClient(
+			http.MethodGet, tgt, encodeUpcomingRequest, decodeUpcomingResponse, opts...,
+		).Endpoint()),
+		birthdayCalendar: mw(kithttp.NewClient(
+			http.MethodGet, tgt, encodeBirthdayCalendarRequest, decodeCalendarResponse, opts...,
+		).Endpoint()),
+		birthdaysCalendar: mw(kithttp.NewClient(
+			http.MethodGet, tgt, encodeBirthdaysCalendarRequest, decodeCalendarResponse, opts...,
+		).Endpoint()),
+		export: mw(kithttp.NewClient(
+			http.MethodGet, tgt, encodeExportRequest, decodeExportResponse, adminOpts...,
+		).Endpoint()),
+		erase: mw(kithttp.NewClient(
+			http.MethodPost, tgt, encodeEraseRequest, decodeEraseResponse, adminOpts...,
+		).Endpoint()),
+	}, nil
+}
+
+// unwrapErr returns the typed users error carried by a response error
+func unwrapErr(err error) error {
+	var respErr *responseError
+	if errors.As(err, &respErr) {
+		return respErr.err
+	}
+	return err
+}
+
+func (c *client) Upsert(ctx context.Context, username, dob string) error {
+	_, err := c.upsert(withIdempotencyKey(ctx), users.UpsertRequest{Username: username, DoB: dob})
+	return unwrapErr(err)
+}
+
+func (c *client) Read(ctx context.Context, username string) (string, error) {
+	resp, err := c.read(ctx, users.ReadRequest{Username: username})
+	if err != nil {
+		return "", unwrapErr(err)
+	}
+	return resp.(users.ReadResponse).Message, nil
+}
+
+func (c *client) Delete(ctx context.Context, username string) error {
+	_, err := c.delete(withIdempotencyKey(ctx), users.DeleteRequest{Username: username})
+	return unwrapErr(err)
+}
+
+func (c *client) List(ctx context.Context) ([]users.User, error) {
+	resp, err := c.list(ctx, users.ListRequest{})
+	if err != nil {
+		return nil, unwrapErr(err)
+	}
+	return resp.(users.ListResponse).Users, nil
+}
+
+func (c *client) Upcoming(ctx context.Context, days int) ([]users.UpcomingBirthday, error) {
+	resp, err := c.upcoming(ctx, users.UpcomingRequest{Days: days})
+	if err != nil {
+		return nil, unwrapErr(err)
+	}
+	return resp.(users.UpcomingResponse).Birthdays, nil
+}
+
+func (c *client) BirthdayCalendar(ctx context.Context, username string) (string, error) {
+	resp, err := c.birthdayCalendar(ctx, users.CalendarRequest{Username: username})
+	if err != nil {
+		return "", unwrapErr(err)
+	}
+	return resp.(users.CalendarResponse).Calendar, nil
+}
+
+func (c *client) BirthdaysCalendar(ctx context.Context) (string, error) {
+	resp, err := c.birthdaysCalendar(ctx, users.CalendarRequest{})
+	if err != nil {
+		return "", unwrapErr(err)
+	}
+	return resp.(users.CalendarResponse).Calendar, nil
+}
+
+func (c *client) Export(ctx context.Context, username string) (users.UserExport, error) {
+	resp, err := c.export(ctx, users.ExportRequest{Username: username})
+	if err != nil {
+		return users.UserExport{}, unwrapErr(err)
+	}
+	return *resp.(users.ExportResponse).Export, nil
+}
+
+func (c *client) Erase(ctx context.Context, username string) (users.ErasureReceipt, error) {
+	resp, err := c.erase(withIdempotencyKey(ctx), users.EraseRequest{Username: username})
+	if err != nil {
+		return users.ErasureReceipt{}, unwrapErr(err)
+	}
+	return *resp.(users.EraseResponse).Receipt, nil
+}
+
+type idempotencyKeyCtxKey struct{}
+
+// withIdempotencyKey generates the key which all attempts of a write share,
+// so that the server performs a retried write only once
+func withIdempotencyKey(ctx context.Context) context.Context {
+	key := randomHex()
+	if key == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, idempotencyKeyCtxKey{}, key)
+}
+
+// setIdempotencyKey sends the key of the write along with the ID of the
+// client, which scopes the key on the server when no Authorization is sent
+func setIdempotencyKey(clientID string) kithttp.RequestFunc {
+	return func(ctx context.Context, r *http.Request) context.Context {
+		if key, ok := ctx.Value(idempotencyKeyCtxKey{}).(string); ok && clientID != "" {
+			r.Header.Set(api.IdempotencyKeyHeader, key)
+			r.Header.Set(api.IdempotencyClientHeader, clientID)
+		}
+		return ctx
+	}
+}
+
+// randomHex returns 16 random bytes in hex, or an empty string when the
+// system's random source fails
+func randomHex() string {
+	b := make([]byte, 16)
+	if _, err := crand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+func setAdminToken(token string) kithttp.RequestFunc {
+	return func(ctx context.Context, r *http.Request) context.Context {
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		return ctx
+	}
+}
+
+// readPrimaryPin sends back the api.ReadPrimaryCookie of the last write
+// until it expires, so that the client reads its own writes when the
+// server reads from replicas. It does not need a cookie jar.
+type readPrimaryPin struct {
+	mu     sync.Mutex
+	cookie *http.Cookie
+	until  time.Time
+}
+
+func (pin *readPrimaryPin) save(ctx context.Context, resp *http.Response) context.Context {
+	for _, c := range resp.Cookies() {
+		if c.Name == api.ReadPrimaryCookie {
+			pin.mu.Lock()
+			pin.cookie, pin.until = c, time.Now().Add(time.Duration(c.MaxAge)*time.Second)
+			pin.mu.Unlock()
+		}
+	}
+	return ctx
+}
+
+func (pin *readPrimaryPin) set(ctx context.Context, r *http.Request) context.Context {
+	pin.mu.Lock()
+	defer pin.mu.Unlock()
+	if pin.cookie != nil && time.Now().Before(pin.until) {
+		r.AddCookie(&http.Cookie{Name: pin.cookie.Name, Value: pin.cookie.Value})
+	}
+	return ctx
+}
+
+// timeoutMiddleware bounds each attempt by timeout
+func timeoutMiddleware(timeout time.Duration) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			return next(ctx, request)
+		}
+	}
+}
+
+// retryMiddleware retries requests which failed with a 5xx response or a
+// transport error, with jittered exponential backoff between attempts.
+func retryMiddleware(maxRetries int, backoff, maxBackoff time.Duration) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			delay := backoff
+			for attempt := 0; ; attempt++ {
+				resp, err := next(ctx, request)
+				if err == nil || attempt >= maxRetries || !isRetryable(ctx, err) {
+					return resp, err
+				}
+
+				// full jitter
+				sleep := time.Duration(rand.Int63n(int64(delay) + 1))
+				select {
+				case <-time.After(sleep):
+				case <-ctx.Done():
+					return nil, err
+				}
+				delay *= 2
+				if delay > maxBackoff {
+					delay = maxBackoff
+				}
+			}
+		}
+	}
+}
+
+func isRetryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		// the caller gave up
+		return false
+	}
+	var respErr *responseError
+	if errors.As(err, &respErr) {
+		return respErr.statusCode >= http.StatusInternalServerError
+	}
+	return true
+}
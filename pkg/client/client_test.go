@@ -0,0 +1,176 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/awhdesmond/user-service/pkg/api"
+	"github.com/awhdesmond/user-service/pkg/common"
+	"github.com/awhdesmond/user-service/pkg/users"
+)
+
+// stubService returns canned responses without a database
+type stubService struct {
+	users.Service
+}
+
+func (stubService) Read(_ context.Context, username string) (string, error) {
+	if username == "grape" {
+		return "", users.ErrUserNotFound
+	}
+	return "Hello, " + username + "! Happy birthday!", nil
+}
+
+func (stubService) Upsert(_ context.Context, _, dob string) error {
+	if dob != "2000-01-02" {
+		return users.ErrDoBInvalid
+	}
+	return nil
+}
+
+func (stubService) Delete(_ context.Context, username string) error {
+	return nil
+}
+
+func newTestClient(t *testing.T, handler http.Handler) users.Service {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	svc, err := New(Config{BaseURL: srv.URL, Backoff: time.Millisecond})
+	if err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	return svc
+}
+
+func TestClient(t *testing.T) {
+	svc := newTestClient(t, users.MakeHandler(stubService{}))
+	ctx := context.Background()
+
+	msg, err := svc.Read(ctx, "apple")
+	if err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	if msg != "Hello, apple! Happy birthday!" {
+		t.Fatalf("got = %v, want = %v", msg, "Hello, apple! Happy birthday!")
+	}
+
+	if err := svc.Upsert(ctx, "apple", "2000-01-02"); err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	if err := svc.Delete(ctx, "apple"); err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+}
+
+func TestClientTypedErrors(t *testing.T) {
+	svc := newTestClient(t, users.MakeHandler(stubService{}))
+	ctx := context.Background()
+
+	if _, err := svc.Read(ctx, "grape"); err != users.ErrUserNotFound {
+		t.Fatalf("got = %v, want = %v", err, users.ErrUserNotFound)
+	}
+	if err := svc.Upsert(ctx, "apple", "abcd"); err != users.ErrDoBInvalid {
+		t.Fatalf("got = %v, want = %v", err, users.ErrDoBInvalid)
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	var attempts int32
+	keys := map[string]bool{}
+	clientIDs := map[string]bool{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys[r.Header.Get(api.IdempotencyKeyHeader)] = true
+		clientIDs[r.Header.Get(api.IdempotencyClientHeader)] = true
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		users.MakeHandler(stubService{}).ServeHTTP(w, r)
+	})
+	svc := newTestClient(t, handler)
+
+	if err := svc.Upsert(context.Background(), "apple", "2000-01-02"); err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	if got := atomic.LoadInt32(&attempts); got != 3 {
+		t.Fatalf("got = %v, want = %v", got, 3)
+	}
+	// every attempt carries the same idempotency key
+	if len(keys) != 1 || keys[""] {
+		t.Fatalf("got = %v, want = %v", keys, "one idempotency key")
+	}
+	// which is scoped by the client ID, since no Authorization is sent
+	if len(clientIDs) != 1 || clientIDs[""] {
+		t.Fatalf("got = %v, want = %v", clientIDs, "one client ID")
+	}
+}
+
+func TestClientDoesNotRetryClientErrors(t *testing.T) {
+	var attempts int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		users.MakeHandler(stubService{}).ServeHTTP(w, r)
+	})
+	svc := newTestClient(t, handler)
+
+	if _, err := svc.Read(context.Background(), "grape"); err != users.ErrUserNotFound {
+		t.Fatalf("got = %v, want = %v", err, users.ErrUserNotFound)
+	}
+	if got := atomic.LoadInt32(&attempts); got != 1 {
+		t.Fatalf("got = %v, want = %v", got, 1)
+	}
+}
+
+func TestClientReadsItsWrites(t *testing.T) {
+	var readsPrimary []bool
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			readsPrimary = append(readsPrimary, common.UsePrimary(r.Context()))
+		}
+		users.MakeHandler(stubService{}).ServeHTTP(w, r)
+	})
+	mw := api.NewReadYourWritesMiddleware(api.ReadYourWritesConfig{ReadYourWritesWindow: time.Minute})
+	svc := newTestClient(t, mw.Handler(handler))
+	ctx := context.Background()
+
+	svc.Read(ctx, "apple")
+	if err := svc.Upsert(ctx, "apple", "2000-01-02"); err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	svc.Read(ctx, "apple")
+	if len(readsPrimary) != 2 || readsPrimary[0] || !readsPrimary[1] {
+		t.Fatalf("got = %v, want = %v", readsPrimary, []bool{false, true})
+	}
+}
+
+func (stubService) Erase(_ context.Context, username string) (users.ErasureReceipt, error) {
+	return users.ErasureReceipt{ID: 1, SubjectHash: "subject"}, nil
+}
+
+func TestClientAdminToken(t *testing.T) {
+	handler := api.NewAdminAuthMiddleware(api.AdminConfig{AdminToken: "secret"}).Handler(users.MakeHandler(stubService{}))
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	ctx := context.Background()
+
+	svc, err := New(Config{BaseURL: srv.URL, AdminToken: "secret"})
+	if err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	if receipt, err := svc.Erase(ctx, "apple"); err != nil || receipt.ID != 1 {
+		t.Fatalf("got = %v, %v, want = %v", receipt, err, "receipt 1")
+	}
+
+	svc, err = New(Config{BaseURL: srv.URL})
+	if err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	if _, err := svc.Erase(ctx, "apple"); err != api.ErrAdminUnauthorized {
+		t.Fatalf("got = %v, want = %v", err, api.ErrAdminUnauthorized)
+	}
+}
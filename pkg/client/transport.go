@@ -0,0 +1,236 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/awhdesmond/user-service/pkg/api"
+	"github.com/awhdesmond/user-service/pkg/common"
+	"github.com/awhdesmond/user-service/pkg/users"
+)
+
+// knownErrors are decoded from error responses back into the typed errors
+var knownErrors = []error{
+	users.ErrUsernameIsEmpty,
+	users.ErrUsernameContainsNonLetters,
+	users.ErrDoBFutureUsed,
+	users.ErrDoBTooOld,
+	users.ErrDoBInvalid,
+	users.ErrUserNotFound,
+	users.ErrUnexpectedDatabaseError,
+	users.ErrCacheUnavailable,
+	users.ErrEventIDInvalid,
+	users.ErrDaysInvalid,
+	common.ErrInvalidJSONBody,
+	common.ErrInvalidBody,
+	common.ErrEndpointReqMismatch,
+	api.ErrAdminDisabled,
+	api.ErrAdminUnauthorized,
+}
+
+// responseError is returned by the decoders for non-2xx responses.
+// The status code decides whether the request is retried.
+type responseError struct {
+	statusCode int
+	err        error
+}
+
+func (e *responseError) Error() string {
+	return e.err.Error()
+}
+
+func (e *responseError) Unwrap() error {
+	return e.err
+}
+
+func errFromMessage(msg string) error {
+	for _, err := range knownErrors {
+		if err.Error() == msg {
+			return err
+		}
+	}
+	return errors.New(msg)
+}
+
+func decodeError(r *http.Response) error {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return &responseError{r.StatusCode, err}
+	}
+
+	res := struct {
+		Err string `json:"error"`
+	}{}
+	if err := json.Unmarshal(body, &res); err != nil || res.Err == "" {
+		msg := strings.TrimSpace(string(body))
+		if msg == "" {
+			msg = http.StatusText(r.StatusCode)
+		}
+		return &responseError{r.StatusCode, fmt.Errorf("unexpected status %d: %s", r.StatusCode, msg)}
+	}
+	return &responseError{r.StatusCode, errFromMessage(res.Err)}
+}
+
+// apiPath sets the request path to path under the /v1 API
+func apiPath(r *http.Request, path string) {
+	r.URL.Path = strings.TrimSuffix(r.URL.Path, "/") + users.APIV1Prefix + path
+}
+
+// usernamePath sets the request path to /v1/hello/{username} followed by suffix
+func usernamePath(r *http.Request, username, suffix string) {
+	apiPath(r, "/hello/"+username+suffix)
+}
+
+func encodeReadRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(users.ReadRequest)
+	usernamePath(r, req.Username, "")
+	return nil
+}
+
+func decodeReadResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode != http.StatusOK {
+		return nil, decodeError(r)
+	}
+	var resp users.ReadResponse
+	if err := json.NewDecoder(r.Body).Decode(&resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func encodeUpsertRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(users.UpsertRequest)
+	usernamePath(r, req.Username, "")
+
+	data, err := json.Marshal(common.GenericJSON{"dateOfBirth": req.DoB})
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json; charset=utf-8")
+	r.ContentLength = int64(len(data))
+	r.Body = io.NopCloser(bytes.NewReader(data))
+	// allows the transport to resend the body on retries
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	return nil
+}
+
+func decodeUpsertResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode != http.StatusNoContent {
+		return nil, decodeError(r)
+	}
+	return users.UpsertResponse{}, nil
+}
+
+func encodeDeleteRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(users.DeleteRequest)
+	usernamePath(r, req.Username, "")
+	return nil
+}
+
+func decodeDeleteResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode != http.StatusNoContent {
+		return nil, decodeError(r)
+	}
+	return users.DeleteResponse{}, nil
+}
+
+func encodeListRequest(_ context.Context, r *http.Request, _ interface{}) error {
+	apiPath(r, "/hello")
+	return nil
+}
+
+func decodeListResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode != http.StatusOK {
+		return nil, decodeError(r)
+	}
+	resp := users.ListResponse{Users: []users.User{}}
+	if err := json.NewDecoder(r.Body).Decode(&resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func encodeUpcomingRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(users.UpcomingRequest)
+	apiPath(r, "/birthdays")
+	q := r.URL.Query()
+	q.Set(users.URLQueryDays, strconv.Itoa(req.Days))
+	r.URL.RawQuery = q.Encode()
+	return nil
+}
+
+func decodeUpcomingResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode != http.StatusOK {
+		return nil, decodeError(r)
+	}
+	resp := users.UpcomingResponse{Birthdays: []users.UpcomingBirthday{}}
+	if err := json.NewDecoder(r.Body).Decode(&resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func encodeBirthdayCalendarRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(users.CalendarRequest)
+	usernamePath(r, req.Username, "/birthday.ics")
+	return nil
+}
+
+func encodeBirthdaysCalendarRequest(_ context.Context, r *http.Request, _ interface{}) error {
+	apiPath(r, "/birthdays.ics")
+	return nil
+}
+
+func decodeCalendarResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode != http.StatusOK {
+		return nil, decodeError(r)
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	return users.CalendarResponse{Calendar: string(body)}, nil
+}
+
+func encodeExportRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(users.ExportRequest)
+	usernamePath(r, req.Username, "/export")
+	return nil
+}
+
+func decodeExportResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode != http.StatusOK {
+		return nil, decodeError(r)
+	}
+	resp := users.ExportResponse{Export: &users.UserExport{}}
+	if err := json.NewDecoder(r.Body).Decode(&resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func encodeEraseRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(users.EraseRequest)
+	usernamePath(r, req.Username, "/erase")
+	return nil
+}
+
+func decodeEraseResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode != http.StatusOK {
+		return nil, decodeError(r)
+	}
+	resp := users.EraseResponse{Receipt: &users.ErasureReceipt{}}
+	if err := json.NewDecoder(r.Body).Decode(&resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
@@ -0,0 +1,129 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	kithttp "github.com/go-kit/kit/transport/http"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	MediaTypeJSON     = "application/json"
+	MediaTypeProtobuf = "application/x-protobuf"
+	MediaTypeMsgpack  = "application/msgpack"
+)
+
+// MediaTypes which EncodeErrorFactory and the users transport can negotiate, JSON first
+var MediaTypes = []string{MediaTypeJSON, MediaTypeProtobuf, MediaTypeMsgpack}
+
+type AcceptedMediaType struct {
+	MediaType string
+	Q         float64
+}
+
+// ParseAccept returns the media types of an Accept header, most preferred first.
+// Media types with q=0 and malformed media types are left out.
+func ParseAccept(accept string) []AcceptedMediaType {
+	accepted := []AcceptedMediaType{}
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q > 0 {
+			accepted = append(accepted, AcceptedMediaType{mediaType, q})
+		}
+	}
+	sort.SliceStable(accepted, func(i, j int) bool {
+		return accepted[i].Q > accepted[j].Q
+	})
+	return accepted
+}
+
+// NegotiateMediaType returns the offer most preferred by accept,
+// or the first offer if accept does not match any of them.
+func NegotiateMediaType(accept string, offers ...string) string {
+	for _, a := range ParseAccept(accept) {
+		for _, offer := range offers {
+			if a.MediaType == offer {
+				return offer
+			}
+		}
+		if a.MediaType == "*/*" || a.MediaType == "application/*" {
+			return offers[0]
+		}
+	}
+	return offers[0]
+}
+
+// MediaType returns the media type of a Content-Type header without its parameters
+func MediaType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return mediaType
+}
+
+// RequestAccept returns the Accept header put in ctx by kithttp.PopulateRequestContext
+func RequestAccept(ctx context.Context) string {
+	accept, _ := ctx.Value(kithttp.ContextKeyRequestAccept).(string)
+	return accept
+}
+
+// EncodeProtobuf writes m as the body of a protobuf response
+func EncodeProtobuf(w http.ResponseWriter, code int, m proto.Message) error {
+	data, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", MediaTypeProtobuf)
+	w.WriteHeader(code)
+	_, err = w.Write(data)
+	return err
+}
+
+// EncodeMsgpack writes v as the body of a MessagePack response.
+// Fields are named after their json tags, so that the shape matches the JSON response.
+func EncodeMsgpack(w http.ResponseWriter, code int, v interface{}) error {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", MediaTypeMsgpack)
+	w.WriteHeader(code)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// DecodeMsgpack reads a MessagePack body into v, matching keys to json tags
+func DecodeMsgpack(r io.Reader, v interface{}) error {
+	dec := msgpack.NewDecoder(r)
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+
+// DecodeProtobuf reads a protobuf body into m
+func DecodeProtobuf(r io.Reader, m proto.Message) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return proto.Unmarshal(data, m)
+}
@@ -1,13 +1,21 @@
 package common
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/redis/go-redis/v9"
 	"github.com/upper/db/v4"
 	postgresqladp "github.com/upper/db/v4/adapter/postgresql"
+	sqliteadp "github.com/upper/db/v4/adapter/sqlite"
+	"go.uber.org/zap"
 )
 
 type PostgresSQLConfig struct {
@@ -16,6 +24,112 @@ type PostgresSQLConfig struct {
 	Database string `mapstructure:"postgres-database"`
 	Username string `mapstructure:"postgres-username"`
 	Password string `mapstructure:"postgres-password"`
+	// ReplicaHosts are the host[:port] of read replicas, which share the
+	// database and the credentials of the primary
+	ReplicaHosts []string `mapstructure:"postgres-replica-hosts"`
+
+	// The pool settings default to db.DefaultSettings when they are 0
+	MaxOpenConns    int           `mapstructure:"postgres-max-open-conns"`
+	MaxIdleConns    int           `mapstructure:"postgres-max-idle-conns"`
+	ConnMaxLifetime time.Duration `mapstructure:"postgres-conn-max-lifetime"`
+	ConnMaxIdleTime time.Duration `mapstructure:"postgres-conn-max-idle-time"`
+
+	// SSLMode is one of the libpq sslmode values, prefer when it is empty.
+	// verify-full checks the server certificate and its hostname.
+	SSLMode string `mapstructure:"postgres-sslmode"`
+	// SSLRootCert is the CA bundle which the server certificate is checked against
+	SSLRootCert string `mapstructure:"postgres-sslrootcert"`
+	// SSLCert and SSLKey are the client certificate, when the server requires one
+	SSLCert string `mapstructure:"postgres-sslcert"`
+	SSLKey  string `mapstructure:"postgres-sslkey"`
+
+	// ApplicationName identifies the connections in pg_stat_activity
+	ApplicationName string `mapstructure:"postgres-application-name"`
+	// StatementTimeout aborts the queries which run longer. It is disabled when 0.
+	StatementTimeout time.Duration `mapstructure:"postgres-statement-timeout"`
+}
+
+var (
+	ErrPostgresConfigInvalid = errors.New("invalid postgres config")
+
+	postgresSSLModes = []string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"}
+)
+
+// Validate checks the settings of cfg, and that its certificate files can be loaded,
+// so that a misconfiguration fails on startup rather than on the first query.
+func (c PostgresSQLConfig) Validate() error {
+	invalid := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%w: %s", ErrPostgresConfigInvalid, fmt.Sprintf(format, args...))
+	}
+
+	if c.MaxOpenConns < 0 || c.MaxIdleConns < 0 || c.ConnMaxLifetime < 0 || c.ConnMaxIdleTime < 0 {
+		return invalid("pool settings must not be negative")
+	}
+	if c.MaxOpenConns > 0 && c.MaxIdleConns > c.MaxOpenConns {
+		return invalid("max idle connections %d exceed max open connections %d", c.MaxIdleConns, c.MaxOpenConns)
+	}
+	if c.StatementTimeout < 0 || c.StatementTimeout%time.Millisecond != 0 {
+		return invalid("statement timeout %v must be a whole number of milliseconds", c.StatementTimeout)
+	}
+
+	validMode := c.SSLMode == ""
+	for _, mode := range postgresSSLModes {
+		validMode = validMode || c.SSLMode == mode
+	}
+	if !validMode {
+		return invalid("sslmode %q must be one of %s", c.SSLMode, strings.Join(postgresSSLModes, ", "))
+	}
+	if c.SSLMode == "disable" && (c.SSLRootCert != "" || c.SSLCert != "") {
+		return invalid("certificates are set but sslmode is disable")
+	}
+
+	for k, v := range c.options() {
+		// the adapter escapes spaces in a way pgx does not unescape
+		if strings.ContainsAny(v, " \t") {
+			return invalid("%s %q must not contain spaces", k, v)
+		}
+	}
+
+	if c.SSLRootCert != "" {
+		data, err := os.ReadFile(c.SSLRootCert)
+		if err != nil {
+			return invalid("sslrootcert: %v", err)
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(data) {
+			return invalid("sslrootcert %s has no PEM certificate", c.SSLRootCert)
+		}
+	}
+	if (c.SSLCert == "") != (c.SSLKey == "") {
+		return invalid("sslcert and sslkey must be set together")
+	}
+	if c.SSLCert != "" {
+		if _, err := tls.LoadX509KeyPair(c.SSLCert, c.SSLKey); err != nil {
+			return invalid("sslcert: %v", err)
+		}
+	}
+	return nil
+}
+
+// options are the connection parameters of cfg other than the address and credentials
+func (c PostgresSQLConfig) options() map[string]string {
+	opts := map[string]string{}
+	params := map[string]string{
+		"sslmode":          c.SSLMode,
+		"sslrootcert":      c.SSLRootCert,
+		"sslcert":          c.SSLCert,
+		"sslkey":           c.SSLKey,
+		"application_name": c.ApplicationName,
+	}
+	for k, v := range params {
+		if v != "" {
+			opts[k] = v
+		}
+	}
+	if c.StatementTimeout > 0 {
+		// sent as a runtime parameter, so that it applies to every connection of the pool
+		opts["statement_timeout"] = strconv.FormatInt(c.StatementTimeout.Milliseconds(), 10)
+	}
+	return opts
 }
 
 func (c PostgresSQLConfig) Hostname() string {
@@ -25,12 +139,18 @@ func (c PostgresSQLConfig) Hostname() string {
 	return fmt.Sprintf("%s:%v", c.Host, c.Port)
 }
 
+// MakePostgresDBSession validates cfg and opens a session with its pool, TLS
+// and connection parameters.
 func MakePostgresDBSession(cfg PostgresSQLConfig) (db.Session, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
 	settings := postgresqladp.ConnectionURL{
 		User:     cfg.Username,
 		Password: cfg.Password,
 		Host:     cfg.Hostname(),
 		Database: cfg.Database,
+		Options:  cfg.options(),
 	}
 
 	session, err := postgresqladp.Open(settings)
@@ -39,14 +159,85 @@ func MakePostgresDBSession(cfg PostgresSQLConfig) (db.Session, error) {
 	}
 
 	db.LC().SetLevel(db.LogLevelError)
-	session.SetMaxIdleConns(db.DefaultSettings.MaxIdleConns())
-	session.SetMaxOpenConns(db.DefaultSettings.MaxOpenConns())
-	session.SetConnMaxLifetime(db.DefaultSettings.ConnMaxLifetime())
-	session.SetConnMaxIdleTime(db.DefaultSettings.ConnMaxIdleTime())
+	if cfg.MaxIdleConns == 0 {
+		cfg.MaxIdleConns = db.DefaultSettings.MaxIdleConns()
+	}
+	if cfg.MaxOpenConns == 0 {
+		cfg.MaxOpenConns = db.DefaultSettings.MaxOpenConns()
+	}
+	if cfg.ConnMaxLifetime == 0 {
+		cfg.ConnMaxLifetime = db.DefaultSettings.ConnMaxLifetime()
+	}
+	if cfg.ConnMaxIdleTime == 0 {
+		cfg.ConnMaxIdleTime = db.DefaultSettings.ConnMaxIdleTime()
+	}
+	session.SetMaxIdleConns(cfg.MaxIdleConns)
+	session.SetMaxOpenConns(cfg.MaxOpenConns)
+	session.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	session.SetConnMaxIdleTime(cfg.ConnMaxIdleTime)
 
 	return session, nil
 }
 
+type SQLiteConfig struct {
+	// Path of the database file
+	Path string `mapstructure:"sqlite-path"`
+}
+
+// MakeSQLiteDBSession opens the SQLite database at cfg.Path. It uses a single
+// connection, since SQLite serialises writes anyway, so that transactions
+// never fail with SQLITE_BUSY. The driver needs cgo.
+func MakeSQLiteDBSession(cfg SQLiteConfig) (db.Session, error) {
+	settings := sqliteadp.ConnectionURL{
+		Database: cfg.Path,
+		Options:  map[string]string{"_foreign_keys": "1"},
+	}
+
+	session, err := sqliteadp.Open(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	db.LC().SetLevel(db.LogLevelError)
+	session.SetMaxOpenConns(1)
+	return session, nil
+}
+
+// MakePostgresReplicaSessions opens a session per replica of cfg.ReplicaHosts.
+// Replica hosts without a port use the port of the primary. Replicas which
+// cannot be opened are logged and skipped, since the primary serves their reads.
+func MakePostgresReplicaSessions(cfg PostgresSQLConfig, logger *zap.Logger) []db.Session {
+	sessions := []db.Session{}
+	for _, host := range cfg.ReplicaHosts {
+		replicaCfg := cfg
+		replicaCfg.Host = host
+		if strings.Contains(host, ":") {
+			replicaCfg.Port = ""
+		}
+		session, err := MakePostgresDBSession(replicaCfg)
+		if err != nil {
+			logger.Warn("skipping replica", zap.String("host", host), zap.Error(err))
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+type primaryCtxKey struct{}
+
+// WithPrimary makes the reads of ctx go to the primary rather than to a
+// replica, e.g. so that a caller reads its own writes despite replication lag
+func WithPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryCtxKey{}, true)
+}
+
+// UsePrimary reports whether the reads of ctx must go to the primary
+func UsePrimary(ctx context.Context) bool {
+	usePrimary, _ := ctx.Value(primaryCtxKey{}).(bool)
+	return usePrimary
+}
+
 func IsDBErrorNoRows(err error) bool {
 	if err == nil {
 		return false
@@ -56,56 +247,189 @@ func IsDBErrorNoRows(err error) bool {
 
 // Redis
 type RedisCfg struct {
+	// URI of a standalone server, or of a node of a cluster when ClusterMode is set.
+	// rediss:// URIs connect with TLS. It must be empty in Sentinel mode.
 	URI         string `mapstructure:"redis-uri"`
 	Password    string `mapstructure:"redis-password"`
 	ClusterMode string `mapstructure:"redis-cluster-mode"`
+
+	// SentinelMasterName enables Sentinel mode, in which the master is looked up
+	// through SentinelAddrs, the host:port of the sentinels
+	SentinelMasterName string   `mapstructure:"redis-sentinel-master-name"`
+	SentinelAddrs      []string `mapstructure:"redis-sentinel-addrs"`
+	SentinelPassword   string   `mapstructure:"redis-sentinel-password"`
+
+	// DB overrides the database of the URI when it is not 0. Cluster mode only has database 0.
+	DB int `mapstructure:"redis-db"`
+
+	// The pool settings and timeouts default to those of go-redis when they are 0
+	PoolSize     int           `mapstructure:"redis-pool-size"`
+	MinIdleConns int           `mapstructure:"redis-min-idle-conns"`
+	PoolTimeout  time.Duration `mapstructure:"redis-pool-timeout"`
+	DialTimeout  time.Duration `mapstructure:"redis-dial-timeout"`
+	ReadTimeout  time.Duration `mapstructure:"redis-read-timeout"`
+	WriteTimeout time.Duration `mapstructure:"redis-write-timeout"`
+
+	// TLS connects with TLS, as a rediss:// URI does. The server certificates are
+	// verified against TLSCACert, or the system roots when it is empty, and the
+	// hostname of each node unless TLSServerName is set.
+	TLS           bool   `mapstructure:"redis-tls"`
+	TLSCACert     string `mapstructure:"redis-tls-ca-cert"`
+	TLSServerName string `mapstructure:"redis-tls-server-name"`
+	// TLSCert and TLSKey are the client certificate, when the server requires one
+	TLSCert string `mapstructure:"redis-tls-cert"`
+	TLSKey  string `mapstructure:"redis-tls-key"`
+}
+
+var ErrRedisConfigInvalid = errors.New("invalid redis config")
+
+// Enabled reports whether cfg points at a Redis server
+func (c RedisCfg) Enabled() bool {
+	return c.URI != "" || c.SentinelMasterName != ""
 }
 
-func redisOptsToUnivOpts(opts *redis.Options, password string) *redis.UniversalOptions {
-	return &redis.UniversalOptions{
-		Addrs:    []string{opts.Addr},
-		Password: password,
-		DB:       opts.DB,
+// Validate checks the settings of cfg, and that its certificate files can be loaded,
+// so that a misconfiguration fails on startup rather than on the first command.
+func (c RedisCfg) Validate() error {
+	invalid := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%w: %s", ErrRedisConfigInvalid, fmt.Sprintf(format, args...))
 	}
+
+	if c.PoolSize < 0 || c.MinIdleConns < 0 || c.PoolTimeout < 0 ||
+		c.DialTimeout < 0 || c.ReadTimeout < 0 || c.WriteTimeout < 0 {
+		return invalid("pool settings and timeouts must not be negative")
+	}
+	if c.PoolSize > 0 && c.MinIdleConns > c.PoolSize {
+		return invalid("min idle connections %d exceed pool size %d", c.MinIdleConns, c.PoolSize)
+	}
+	if c.DB < 0 {
+		return invalid("db %d must not be negative", c.DB)
+	}
+
+	tlsEnabled := c.TLS
+	if c.SentinelMasterName != "" {
+		if c.URI != "" || c.ClusterMode != "" {
+			return invalid("sentinel mode cannot be combined with a uri or cluster mode")
+		}
+		if len(c.SentinelAddrs) == 0 {
+			return invalid("sentinel mode needs the addresses of the sentinels")
+		}
+	} else {
+		if len(c.SentinelAddrs) > 0 || c.SentinelPassword != "" {
+			return invalid("sentinel addresses are set but the sentinel master name is not")
+		}
+		opts, err := redis.ParseURL(c.URI)
+		if err != nil {
+			return invalid("uri: %v", err)
+		}
+		if c.ClusterMode != "" && (opts.DB != 0 || c.DB != 0) {
+			return invalid("cluster mode only has db 0")
+		}
+		tlsEnabled = tlsEnabled || opts.TLSConfig != nil
+	}
+
+	if !tlsEnabled && (c.TLSCACert != "" || c.TLSCert != "" || c.TLSServerName != "") {
+		return invalid("tls settings are set but tls is not enabled")
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return invalid("tls cert and tls key must be set together")
+	}
+	if _, err := c.tlsConfig(); err != nil {
+		return invalid("%v", err)
+	}
+	return nil
 }
 
-// makeRedisClusterClient creates a Redis Cluster client.
-// Need to use cluster client for AWS Elasticache with a single configuration URL
-// See: https://stackoverflow.com/questions/73907312/i-want-to-connect-to-elasticcache-for-redis-in-which-cluster-mode-is-enabled-i
-func makeRedisClusterClient(opts *redis.Options, password string) *redis.ClusterClient {
-	return redis.NewClusterClient(&redis.ClusterOptions{
-		Addrs:    []string{opts.Addr},
-		Password: password,
+// tlsConfig loads the CA and the client certificate of cfg
+func (c RedisCfg) tlsConfig() (*tls.Config, error) {
+	// the server name is left empty so that go-redis verifies the hostname
+	// of each node it dials, e.g. the nodes of a cluster
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: c.TLSServerName,
+	}
+	if c.TLSCACert != "" {
+		data, err := os.ReadFile(c.TLSCACert)
+		if err != nil {
+			return nil, fmt.Errorf("tls ca cert: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("tls ca cert %s has no PEM certificate", c.TLSCACert)
+		}
+	}
+	if c.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("tls cert: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
 
-		TLSConfig: &tls.Config{
-			InsecureSkipVerify: true,
-		},
+// options are the settings shared by the clients of every mode
+func (c RedisCfg) options() (*redis.UniversalOptions, error) {
+	opts := &redis.UniversalOptions{
+		MasterName:       c.SentinelMasterName,
+		Addrs:            c.SentinelAddrs,
+		Password:         c.Password,
+		SentinelPassword: c.SentinelPassword,
+		DB:               c.DB,
 
-		PoolSize:     10,
-		MinIdleConns: 10,
+		PoolSize:     c.PoolSize,
+		MinIdleConns: c.MinIdleConns,
+		PoolTimeout:  c.PoolTimeout,
+		DialTimeout:  c.DialTimeout,
+		ReadTimeout:  c.ReadTimeout,
+		WriteTimeout: c.WriteTimeout,
+	}
 
-		ReadOnly:       false,
-		RouteRandomly:  false,
-		RouteByLatency: false,
-	})
+	tlsEnabled := c.TLS
+	if c.URI != "" {
+		uriOpts, err := redis.ParseURL(c.URI)
+		if err != nil {
+			return nil, err
+		}
+		opts.Addrs = []string{uriOpts.Addr}
+		opts.Username = uriOpts.Username
+		if opts.Password == "" {
+			opts.Password = uriOpts.Password
+		}
+		if opts.DB == 0 {
+			opts.DB = uriOpts.DB
+		}
+		tlsEnabled = tlsEnabled || uriOpts.TLSConfig != nil
+	}
+	if tlsEnabled {
+		tlsCfg, err := c.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		opts.TLSConfig = tlsCfg
+	}
+	return opts, nil
 }
 
-// MakeRedisClient creates a redis client for connection to redis cluster.
-// It supports creating cluster client if RedisCfg.ClusterMode is non-empty string,
-// else it creates a universal client which determines the underlying mode using
-// the number of addresses provided.
+// MakeRedisClient validates cfg and creates a client of its mode: a failover client
+// when RedisCfg.SentinelMasterName is set, a cluster client when RedisCfg.ClusterMode
+// is non-empty, e.g. for AWS Elasticache with a single configuration URL, or else a
+// client of a standalone server.
 func MakeRedisClient(cfg RedisCfg) (redis.UniversalClient, error) {
-	opts, err := redis.ParseURL(cfg.URI)
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	opts, err := cfg.options()
 	if err != nil {
 		return nil, err
 	}
 
-	if cfg.ClusterMode != "" {
-		// Use cluster mode, make cluster client
-		return makeRedisClusterClient(opts, cfg.Password), nil
+	switch {
+	case cfg.SentinelMasterName != "":
+		return redis.NewFailoverClient(opts.Failover()), nil
+	case cfg.ClusterMode != "":
+		return redis.NewClusterClient(opts.Cluster()), nil
+	default:
+		return redis.NewClient(opts.Simple()), nil
 	}
-
-	// Else, make universal client
-	rdb := redis.NewUniversalClient(redisOptsToUnivOpts(opts, cfg.Password))
-	return rdb, nil
 }
@@ -0,0 +1,207 @@
+package common
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+)
+
+const (
+	keySize = 32
+	// tokenSeparator separates the key ID, the wrapped data key
+	// and the ciphertext of a token. Key IDs must not contain it.
+	tokenSeparator = ":"
+)
+
+var (
+	ErrKeyringInvalid     = errors.New("keyring must have a primary key and 32 byte keys")
+	ErrKeyNotFound        = errors.New("encryption key not found in keyring")
+	ErrCiphertextInvalid  = errors.New("invalid ciphertext")
+	ErrEncryptionDisabled = errors.New("encryption is disabled")
+)
+
+type KeyringConfig struct {
+	// KeyringFile is the path of the keyring. Encryption is disabled when it is empty.
+	KeyringFile string `mapstructure:"keyring-file"`
+}
+
+// keyringFile is the JSON layout of the keyring file. Keys are base64 encoded.
+type keyringFile struct {
+	Primary  string            `json:"primary"`
+	Keys     map[string]string `json:"keys"`
+	IndexKey string            `json:"indexKey"`
+}
+
+// Keyring encrypts values with envelope encryption. Every value is
+// encrypted with a new AES-256-GCM data key, which is in turn encrypted
+// with the primary key encryption key of the keyring.
+//
+// Keys other than the primary key are only used to decrypt values
+// encrypted before a rotation.
+type Keyring struct {
+	primary  string
+	keys     map[string][]byte
+	indexKey []byte
+}
+
+// NewKeyring returns a keyring which encrypts with keys[primary].
+// The index key is used for blind indexes and cannot be rotated.
+func NewKeyring(primary string, keys map[string][]byte, indexKey []byte) (*Keyring, error) {
+	if _, ok := keys[primary]; !ok || len(indexKey) != keySize {
+		return nil, ErrKeyringInvalid
+	}
+	for id, key := range keys {
+		if id == "" || strings.Contains(id, tokenSeparator) || len(key) != keySize {
+			return nil, ErrKeyringInvalid
+		}
+	}
+	return &Keyring{primary: primary, keys: keys, indexKey: indexKey}, nil
+}
+
+// LoadKeyring reads a keyring file such as
+//
+//	{"primary": "2026-10", "keys": {"2026-10": "<base64>"}, "indexKey": "<base64>"}
+//
+// It returns a nil keyring when cfg has no keyring file.
+func LoadKeyring(cfg KeyringConfig) (*Keyring, error) {
+	if cfg.KeyringFile == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(cfg.KeyringFile)
+	if err != nil {
+		return nil, err
+	}
+	var f keyringFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+
+	keys := map[string][]byte{}
+	for id, encoded := range f.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, ErrKeyringInvalid
+		}
+		keys[id] = key
+	}
+	indexKey, err := base64.StdEncoding.DecodeString(f.IndexKey)
+	if err != nil {
+		return nil, ErrKeyringInvalid
+	}
+	return NewKeyring(f.Primary, keys, indexKey)
+}
+
+// PrimaryKeyID is the ID of the key new values are encrypted with
+func (k *Keyring) PrimaryKeyID() string {
+	return k.primary
+}
+
+func seal(key, plaintext, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(plaintext)+gcm.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func open(key, sealed, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, ErrCiphertextInvalid
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, aad)
+	if err != nil {
+		return nil, ErrCiphertextInvalid
+	}
+	return plaintext, nil
+}
+
+// Encrypt returns a token of the form <key ID>:<wrapped data key>:<ciphertext>.
+// aad is authenticated but not encrypted, e.g. the ID of the record the value
+// belongs to, so that a token copied to another record fails to decrypt.
+func (k *Keyring) Encrypt(plaintext, aad []byte) (string, error) {
+	dataKey := make([]byte, keySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+	wrapped, err := seal(k.keys[k.primary], dataKey, []byte(k.primary))
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := seal(dataKey, plaintext, aad)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join([]string{
+		k.primary,
+		base64.RawStdEncoding.EncodeToString(wrapped),
+		base64.RawStdEncoding.EncodeToString(ciphertext),
+	}, tokenSeparator), nil
+}
+
+// Decrypt decrypts a token returned by Encrypt with the same aad
+func (k *Keyring) Decrypt(token string, aad []byte) ([]byte, error) {
+	parts := strings.Split(token, tokenSeparator)
+	if len(parts) != 3 {
+		return nil, ErrCiphertextInvalid
+	}
+	key, ok := k.keys[parts[0]]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	wrapped, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrCiphertextInvalid
+	}
+	ciphertext, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrCiphertextInvalid
+	}
+
+	dataKey, err := open(key, wrapped, []byte(parts[0]))
+	if err != nil {
+		return nil, err
+	}
+	return open(dataKey, ciphertext, aad)
+}
+
+// TokenKeyID returns the ID of the key a token was encrypted with
+func TokenKeyID(token string) (string, error) {
+	id, _, ok := strings.Cut(token, tokenSeparator)
+	if !ok {
+		return "", ErrCiphertextInvalid
+	}
+	return id, nil
+}
+
+// BlindIndex returns a keyed hash of value, which can be looked up
+// with equality without storing value in plaintext
+func (k *Keyring) BlindIndex(value string) string {
+	mac := hmac.New(sha256.New, k.indexKey)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,75 @@
+package common
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, keySize)
+}
+
+func TestKeyringRoundTrip(t *testing.T) {
+	old, err := NewKeyring("old", map[string][]byte{"old": testKey(1)}, testKey(9))
+	if err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	rotated, err := NewKeyring("new", map[string][]byte{"old": testKey(1), "new": testKey(2)}, testKey(9))
+	if err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+
+	token, err := old.Encrypt([]byte("2000-01-02"), []byte("apple"))
+	if err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	if id, _ := TokenKeyID(token); id != "old" {
+		t.Fatalf("got = %v, want = %v", id, "old")
+	}
+
+	// a rotated keyring still decrypts values encrypted with the old key
+	plaintext, err := rotated.Decrypt(token, []byte("apple"))
+	if err != nil || string(plaintext) != "2000-01-02" {
+		t.Fatalf("got = %v, %v, want = %v", string(plaintext), err, "2000-01-02")
+	}
+
+	newToken, _ := rotated.Encrypt([]byte("2000-01-02"), []byte("apple"))
+	if id, _ := TokenKeyID(newToken); id != "new" {
+		t.Fatalf("got = %v, want = %v", id, "new")
+	}
+	if _, err := old.Decrypt(newToken, []byte("apple")); err != ErrKeyNotFound {
+		t.Fatalf("got = %v, want = %v", err, ErrKeyNotFound)
+	}
+	if _, err := rotated.Decrypt(token, []byte("pear")); err != ErrCiphertextInvalid {
+		t.Fatalf("got = %v, want = %v", err, ErrCiphertextInvalid)
+	}
+	if old.BlindIndex("01-02") != rotated.BlindIndex("01-02") {
+		t.Fatalf("got = %v, want = %v", rotated.BlindIndex("01-02"), old.BlindIndex("01-02"))
+	}
+}
+
+func TestLoadKeyring(t *testing.T) {
+	if k, err := LoadKeyring(KeyringConfig{}); k != nil || err != nil {
+		t.Fatalf("got = %v, %v, want = %v, %v", k, err, nil, nil)
+	}
+
+	path := filepath.Join(t.TempDir(), "keyring.json")
+	key := base64.StdEncoding.EncodeToString(testKey(1))
+	data := `{"primary": "2026-10", "keys": {"2026-10": "` + key + `"}, "indexKey": "` + key + `"}`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	k, err := LoadKeyring(KeyringConfig{KeyringFile: path})
+	if err != nil || k.PrimaryKeyID() != "2026-10" {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+
+	data = `{"primary": "2027-01", "keys": {"2026-10": "` + key + `"}, "indexKey": "` + key + `"}`
+	os.WriteFile(path, []byte(data), 0o600)
+	if _, err := LoadKeyring(KeyringConfig{KeyringFile: path}); err != ErrKeyringInvalid {
+		t.Fatalf("got = %v, want = %v", err, ErrKeyringInvalid)
+	}
+}
@@ -5,7 +5,13 @@ import (
 	"go.uber.org/zap/zapcore"
 )
 
+// InitZap builds a logger which redacts PII with DefaultRedactionPolicy
 func InitZap(logLevel string) (*zap.Logger, error) {
+	return InitZapWithPolicy(logLevel, DefaultRedactionPolicy)
+}
+
+// InitZapWithPolicy builds a logger which redacts PII with policy
+func InitZapWithPolicy(logLevel string, policy RedactionPolicy) (*zap.Logger, error) {
 	level := zap.NewAtomicLevelAt(zapcore.InfoLevel)
 	switch logLevel {
 	case "debug":
@@ -47,5 +53,5 @@ func InitZap(logLevel string) (*zap.Logger, error) {
 		OutputPaths:      []string{"stdout"},
 		ErrorOutputPaths: []string{"stdout"},
 	}
-	return zapCfg.Build()
+	return zapCfg.Build(zap.WrapCore(NewRedactingCore(policy)))
 }
@@ -0,0 +1,353 @@
+package common
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/upper/db/v4"
+)
+
+const (
+	migrationsDir = "migrations"
+	undoDir       = "undo"
+
+	// schemaMigrationsTable records the versions applied by the Migrator
+	schemaMigrationsTable = "schema_migrations"
+	// flywayHistoryTable records the versions applied by Flyway, which
+	// the Migrator adopts when it runs on a database migrated by Flyway
+	flywayHistoryTable = "flyway_schema_history"
+)
+
+var (
+	ErrMigrationNameInvalid  = errors.New("migration names must be V<version>__<description>.sql or U<version>__<description>.sql")
+	ErrMigrationIrreversible = errors.New("migration has no undo script")
+	ErrNoMigrationApplied    = errors.New("no migration has been applied")
+	ErrSchemaOutdated        = errors.New("database schema is older than the server expects, run `server migrate up`")
+
+	migrationNamePattern = regexp.MustCompile(`^([VU])(\d+)__(\w+)\.sql$`)
+)
+
+// Migration is a schema change. Down is empty when it cannot be undone.
+type Migration struct {
+	Version     int
+	Description string
+	Up          string
+	Down        string
+}
+
+// MigrationStatus is a migration along with when it was applied
+type MigrationStatus struct {
+	Migration
+	// AppliedAt is nil when the migration is pending
+	AppliedAt *time.Time
+}
+
+type appliedMigration struct {
+	Version     int       `db:"version"`
+	Description string    `db:"description"`
+	AppliedAt   time.Time `db:"applied_at"`
+}
+
+type flywayMigration struct {
+	Version     string    `db:"version"`
+	Description string    `db:"description"`
+	InstalledOn time.Time `db:"installed_on"`
+}
+
+// LoadMigrations reads the migrations of fsys, such as db.Postgres, ordered by version.
+// Migrations are in the migrations directory and their undo scripts in the undo directory.
+func LoadMigrations(fsys fs.FS) ([]Migration, error) {
+	byVersion := map[int]*Migration{}
+	for _, dir := range []string{migrationsDir, undoDir} {
+		entries, err := fs.ReadDir(fsys, dir)
+		if err != nil && !(dir == undoDir && errors.Is(err, fs.ErrNotExist)) {
+			return nil, err
+		}
+		for _, entry := range entries {
+			m := migrationNamePattern.FindStringSubmatch(entry.Name())
+			if m == nil || (m[1] == "V") != (dir == migrationsDir) {
+				return nil, fmt.Errorf("%w: %s", ErrMigrationNameInvalid, path.Join(dir, entry.Name()))
+			}
+			data, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+			if err != nil {
+				return nil, err
+			}
+
+			version, _ := strconv.Atoi(m[2])
+			migration, ok := byVersion[version]
+			switch {
+			case dir == migrationsDir && ok:
+				return nil, fmt.Errorf("%w: duplicate version %d", ErrMigrationNameInvalid, version)
+			case dir == migrationsDir:
+				byVersion[version] = &Migration{
+					Version:     version,
+					Description: strings.ReplaceAll(m[3], "_", " "),
+					Up:          string(data),
+				}
+			case !ok:
+				return nil, fmt.Errorf("%w: undo script of unknown version %d", ErrMigrationNameInvalid, version)
+			default:
+				migration.Down = string(data)
+			}
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Migrator applies migrations to a Postgres or SQLite database and records
+// their versions in the schema_migrations table. Each migration runs in a
+// transaction along with the update of schema_migrations.
+type Migrator struct {
+	sess       db.Session
+	migrations []Migration
+}
+
+func NewMigrator(sess db.Session, fsys fs.FS) (*Migrator, error) {
+	migrations, err := LoadMigrations(fsys)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{sess: sess, migrations: migrations}, nil
+}
+
+// Latest is the version of the last migration, i.e. the version the server expects
+func (m *Migrator) Latest() int {
+	if len(m.migrations) == 0 {
+		return -1
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+func tableExists(sess db.Session, table string) (bool, error) {
+	ok, err := sess.Collection(table).Exists()
+	if errors.Is(err, db.ErrCollectionDoesNotExist) {
+		return false, nil
+	}
+	return ok, err
+}
+
+// applied reads the applied migrations by version. The versions applied by
+// Flyway are used when the Migrator has not recorded any.
+func (m *Migrator) applied(ctx context.Context) (map[int]appliedMigration, error) {
+	sess := m.sess.WithContext(ctx)
+	applied := map[int]appliedMigration{}
+
+	ok, err := tableExists(sess, schemaMigrationsTable)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		rows := []appliedMigration{}
+		if err := sess.SQL().SelectFrom(schemaMigrationsTable).All(&rows); err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			applied[row.Version] = row
+		}
+		if len(applied) > 0 {
+			return applied, nil
+		}
+	}
+
+	if ok, err = tableExists(sess, flywayHistoryTable); err != nil || !ok {
+		return applied, err
+	}
+	rows := []flywayMigration{}
+	err = sess.SQL().
+		Select("version", "description", "installed_on").
+		From(flywayHistoryTable).
+		Where("success AND version IS NOT NULL").
+		All(&rows)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		version, err := strconv.Atoi(row.Version)
+		if err != nil {
+			return nil, fmt.Errorf("flyway version %q: %w", row.Version, err)
+		}
+		applied[version] = appliedMigration{Version: version, Description: row.Description, AppliedAt: row.InstalledOn}
+	}
+	return applied, nil
+}
+
+// Version is the last applied version, or -1 when no migration has been applied
+func (m *Migrator) Version(ctx context.Context) (int, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return 0, err
+	}
+	version := -1
+	for v := range applied {
+		if v > version {
+			version = v
+		}
+	}
+	return version, nil
+}
+
+// Status lists every migration, and when it was applied
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]MigrationStatus, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		status := MigrationStatus{Migration: migration}
+		if a, ok := applied[migration.Version]; ok {
+			appliedAt := a.AppliedAt
+			status.AppliedAt = &appliedAt
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// Check returns ErrSchemaOutdated when a migration has not been applied.
+// A schema newer than the server expects is accepted, so that the
+// database can be migrated before the servers are rolled out.
+func (m *Migrator) Check(ctx context.Context) error {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return err
+	}
+	for _, migration := range m.migrations {
+		if _, ok := applied[migration.Version]; !ok {
+			return fmt.Errorf("%w: version %d (%s) is not applied, the server expects version %d",
+				ErrSchemaOutdated, migration.Version, migration.Description, m.Latest())
+		}
+	}
+	return nil
+}
+
+// execScript runs a migration script, which may have several statements
+func execScript(ctx context.Context, tx db.Session, script string) error {
+	execer, ok := tx.Driver().(interface {
+		ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	})
+	if !ok {
+		return fmt.Errorf("unexpected driver %T", tx.Driver())
+	}
+	// without arguments, the drivers run every statement of the script
+	_, err := execer.ExecContext(ctx, script)
+	return err
+}
+
+// adopt creates the schema_migrations table, and records the versions
+// applied by Flyway in it the first time. It returns the applied migrations.
+func (m *Migrator) adopt(ctx context.Context) (map[int]appliedMigration, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sess := m.sess.WithContext(ctx)
+	_, err = sess.SQL().Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			"version" INTEGER NOT NULL,
+			"description" TEXT NOT NULL,
+			"applied_at" TIMESTAMP NOT NULL,
+			constraint schema_migrations_pk primary key (version)
+		)
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := sess.Collection(schemaMigrationsTable).Find().Count()
+	if err != nil || n > 0 {
+		return applied, err
+	}
+	for _, a := range applied {
+		if _, err := sess.Collection(schemaMigrationsTable).Insert(a); err != nil {
+			return nil, err
+		}
+	}
+	return applied, nil
+}
+
+// Up applies the pending migrations in order, and returns them.
+// It adopts the versions applied by Flyway the first time it runs.
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	applied, err := m.adopt(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	done := []Migration{}
+	for _, migration := range m.migrations {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+		err := m.sess.WithContext(ctx).Tx(func(tx db.Session) error {
+			if err := execScript(ctx, tx, migration.Up); err != nil {
+				return err
+			}
+			_, err := tx.Collection(schemaMigrationsTable).Insert(appliedMigration{
+				Version:     migration.Version,
+				Description: migration.Description,
+				AppliedAt:   time.Now().UTC(),
+			})
+			return err
+		})
+		if err != nil {
+			return done, fmt.Errorf("migration %d (%s): %w", migration.Version, migration.Description, err)
+		}
+		done = append(done, migration)
+	}
+	return done, nil
+}
+
+// Down undoes the last applied migration, and returns it
+func (m *Migrator) Down(ctx context.Context) (Migration, error) {
+	applied, err := m.adopt(ctx)
+	if err != nil {
+		return Migration{}, err
+	}
+	version := -1
+	for v := range applied {
+		if v > version {
+			version = v
+		}
+	}
+	if version < 0 {
+		return Migration{}, ErrNoMigrationApplied
+	}
+
+	var migration Migration
+	for _, mi := range m.migrations {
+		if mi.Version == version {
+			migration = mi
+		}
+	}
+	if migration.Down == "" {
+		return Migration{}, fmt.Errorf("%w: version %d", ErrMigrationIrreversible, version)
+	}
+
+	err = m.sess.WithContext(ctx).Tx(func(tx db.Session) error {
+		if err := execScript(ctx, tx, migration.Down); err != nil {
+			return err
+		}
+		_, err := tx.SQL().DeleteFrom(schemaMigrationsTable).Where("version = ?", version).Exec()
+		return err
+	})
+	if err != nil {
+		return Migration{}, fmt.Errorf("migration %d (%s): %w", migration.Version, migration.Description, err)
+	}
+	return migration, nil
+}
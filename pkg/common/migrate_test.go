@@ -0,0 +1,149 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	dbmigrations "github.com/awhdesmond/user-service/db"
+	"github.com/upper/db/v4"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := LoadMigrations(dbmigrations.Postgres)
+	if err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	for i, m := range migrations {
+		if m.Version != i || m.Up == "" || m.Down == "" {
+			t.Fatalf("got = %v, want = %v", m, "consecutive versions with undo scripts")
+		}
+	}
+	if migrations[0].Description != "Initial" {
+		t.Fatalf("got = %v, want = %v", migrations[0].Description, "Initial")
+	}
+
+	cases := []struct {
+		name string
+		fsys fstest.MapFS
+	}{
+		{
+			name: "invalid name",
+			fsys: fstest.MapFS{"migrations/V1_Missing_underscore.sql": {}},
+		},
+		{
+			name: "duplicate version",
+			fsys: fstest.MapFS{"migrations/V1__A.sql": {}, "migrations/V01__B.sql": {}},
+		},
+		{
+			name: "undo script of unknown version",
+			fsys: fstest.MapFS{"migrations/V1__A.sql": {}, "undo/U2__B.sql": {}},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := LoadMigrations(tt.fsys); !errors.Is(err, ErrMigrationNameInvalid) {
+				t.Fatalf("got = %v, want = %v", err, ErrMigrationNameInvalid)
+			}
+		})
+	}
+}
+
+func testMigrator(t *testing.T) (db.Session, *Migrator) {
+	sess, err := MakeSQLiteDBSession(SQLiteConfig{Path: filepath.Join(t.TempDir(), "users.db")})
+	if err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	migrator, err := NewMigrator(sess, dbmigrations.SQLite)
+	if err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	return sess, migrator
+}
+
+func TestMigrator(t *testing.T) {
+	ctx := context.Background()
+	_, migrator := testMigrator(t)
+
+	if err := migrator.Check(ctx); !errors.Is(err, ErrSchemaOutdated) {
+		t.Fatalf("got = %v, want = %v", err, ErrSchemaOutdated)
+	}
+	if _, err := migrator.Down(ctx); err != ErrNoMigrationApplied {
+		t.Fatalf("got = %v, want = %v", err, ErrNoMigrationApplied)
+	}
+
+	done, err := migrator.Up(ctx)
+	if err != nil || len(done) != migrator.Latest()+1 {
+		t.Fatalf("got = %v, %v, want = %v", len(done), err, migrator.Latest()+1)
+	}
+	if err := migrator.Check(ctx); err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	if done, _ = migrator.Up(ctx); len(done) != 0 {
+		t.Fatalf("got = %v, want = %v", done, "no pending migration")
+	}
+
+	undone, err := migrator.Down(ctx)
+	if err != nil || undone.Version != migrator.Latest() {
+		t.Fatalf("got = %v, %v, want = %v", undone.Version, err, migrator.Latest())
+	}
+	if err := migrator.Check(ctx); !errors.Is(err, ErrSchemaOutdated) {
+		t.Fatalf("got = %v, want = %v", err, ErrSchemaOutdated)
+	}
+	statuses, err := migrator.Status(ctx)
+	if err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	if last := statuses[len(statuses)-1]; last.AppliedAt != nil || statuses[0].AppliedAt == nil {
+		t.Fatalf("got = %v, want = %v", statuses, "only the last migration pending")
+	}
+
+	if done, err = migrator.Up(ctx); err != nil || len(done) != 1 {
+		t.Fatalf("got = %v, %v, want = %v", len(done), err, 1)
+	}
+}
+
+func TestMigratorAdoptsFlyway(t *testing.T) {
+	ctx := context.Background()
+	sess, migrator := testMigrator(t)
+
+	// a database migrated by Flyway up to version 1
+	_, err := sess.SQL().Exec(`
+		CREATE TABLE flyway_schema_history (
+			installed_rank INTEGER NOT NULL,
+			version TEXT,
+			description TEXT NOT NULL,
+			installed_on TIMESTAMP NOT NULL,
+			success BOOLEAN NOT NULL
+		)
+	`)
+	if err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	for _, m := range migrator.migrations[:2] {
+		if err := execScript(ctx, sess, m.Up); err != nil {
+			t.Fatalf("got = %v, want = %v", err, nil)
+		}
+		_, err := sess.SQL().Exec(
+			`INSERT INTO flyway_schema_history VALUES (?, ?, ?, CURRENT_TIMESTAMP, 1)`,
+			m.Version+1, m.Version, m.Description,
+		)
+		if err != nil {
+			t.Fatalf("got = %v, want = %v", err, nil)
+		}
+	}
+
+	if version, err := migrator.Version(ctx); err != nil || version != 1 {
+		t.Fatalf("got = %v, %v, want = %v", version, err, 1)
+	}
+	done, err := migrator.Up(ctx)
+	if err != nil || len(done) != migrator.Latest()-1 || done[0].Version != 2 {
+		t.Fatalf("got = %v, %v, want = %v", done, err, "versions from 2 applied")
+	}
+	n, err := sess.Collection(schemaMigrationsTable).Find().Count()
+	if err != nil || n != uint64(migrator.Latest()+1) {
+		t.Fatalf("got = %v, %v, want = %v", n, err, migrator.Latest()+1)
+	}
+}
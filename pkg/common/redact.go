@@ -0,0 +1,249 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	RedactionOff  = "off"
+	RedactionMask = "mask"
+	RedactionHash = "hash"
+
+	redactedMask = "***"
+	// redactedHashPrefix marks hashed values, which are the first
+	// 8 bytes of an HMAC-SHA256 so that log lines can be correlated
+	redactedHashPrefix = "h:"
+)
+
+var (
+	// DefaultRedactionFields are the names of the log fields, query parameters
+	// and table columns whose values are PII
+	DefaultRedactionFields = []string{"username", "dateOfBirth", "date_of_birth", "dob", "prefix"}
+	// DefaultRedactionPaths are the routes whose {parameters} are PII
+	DefaultRedactionPaths = []string{"/hello/{username}"}
+
+	datePattern = regexp.MustCompile(`\b\d{4}-\d{2}-\d{2}(T[0-9:.]+(Z|[+-]\d{2}:\d{2})?)?\b`)
+	urlPattern  = regexp.MustCompile(`/[^\s"'()\[\]{},]*`)
+	// e.g. the detail of a Postgres unique violation: Key (username)=(apple)
+	columnValuePattern = regexp.MustCompile(`\(([\w, ]+)\)=\(([^)]*)\)`)
+)
+
+// RedactionPolicy decides how PII is removed from logs
+type RedactionPolicy struct {
+	// Mode is off, mask or hash. Hashed values can be correlated across log lines.
+	Mode string `mapstructure:"log-redaction"`
+	// Key of the hashes. Hashes are only comparable between processes sharing the key.
+	// A random key is used when it is empty.
+	Key string `mapstructure:"log-redaction-key"`
+	// Fields are the names of log fields, query parameters and columns whose values are redacted
+	Fields []string `mapstructure:"log-redaction-fields"`
+	// Paths are route patterns such as /hello/{username}, whose parameters are
+	// redacted from URLs. They also match under a prefix such as /v1.
+	Paths []string `mapstructure:"log-redaction-paths"`
+}
+
+// DefaultRedactionPolicy hashes the default fields and paths with a random key
+var DefaultRedactionPolicy = RedactionPolicy{
+	Mode:   RedactionHash,
+	Fields: DefaultRedactionFields,
+	Paths:  DefaultRedactionPaths,
+}
+
+// Redactor removes PII from strings according to a RedactionPolicy
+type Redactor struct {
+	mode   string
+	key    []byte
+	fields map[string]bool
+	paths  [][]string
+}
+
+func NewRedactor(policy RedactionPolicy) *Redactor {
+	r := &Redactor{mode: policy.Mode, key: []byte(policy.Key), fields: map[string]bool{}}
+	if r.mode == "" {
+		r.mode = RedactionHash
+	}
+	if len(r.key) == 0 {
+		r.key = make([]byte, 32)
+		rand.Read(r.key)
+	}
+	for _, f := range policy.Fields {
+		r.fields[f] = true
+	}
+	for _, p := range policy.Paths {
+		r.paths = append(r.paths, strings.Split(strings.Trim(p, "/"), "/"))
+	}
+	return r
+}
+
+// Value masks or hashes a PII value
+func (r *Redactor) Value(v string) string {
+	switch r.mode {
+	case RedactionOff:
+		return v
+	case RedactionMask:
+		return redactedMask
+	}
+	mac := hmac.New(sha256.New, r.key)
+	mac.Write([]byte(v))
+	return redactedHashPrefix + hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// IsPII reports whether the values of a field are redacted
+func (r *Redactor) IsPII(field string) bool {
+	return r.fields[field]
+}
+
+// URL redacts the path parameters and the PII query parameters of a URL or path.
+// URLs without PII are returned unchanged.
+func (r *Redactor) URL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+
+	changed := false
+	segments := strings.Split(u.Path, "/")
+	for _, pattern := range r.paths {
+		for start := 0; start+len(pattern) <= len(segments); start++ {
+			if !r.matchPath(pattern, segments[start:start+len(pattern)]) {
+				continue
+			}
+			for i, p := range pattern {
+				if strings.HasPrefix(p, "{") {
+					segments[start+i] = r.Value(segments[start+i])
+					changed = true
+				}
+			}
+		}
+	}
+
+	query := u.Query()
+	for k, vs := range query {
+		if r.fields[k] {
+			for i := range vs {
+				vs[i] = r.Value(vs[i])
+			}
+			changed = true
+		}
+	}
+
+	if !changed {
+		return rawURL
+	}
+	// replaced in place, so that the rest of the URL is logged as it was
+	out := strings.Replace(rawURL, u.EscapedPath(), strings.Join(segments, "/"), 1)
+	if u.RawQuery != "" {
+		out = strings.Replace(out, "?"+u.RawQuery, "?"+query.Encode(), 1)
+	}
+	return out
+}
+
+func (r *Redactor) matchPath(pattern, segments []string) bool {
+	for i, p := range pattern {
+		if strings.HasPrefix(p, "{") && segments[i] == "" ||
+			!strings.HasPrefix(p, "{") && p != segments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// String redacts the dates, URLs and column values of free text such as error messages
+func (r *Redactor) String(s string) string {
+	if r.mode == RedactionOff {
+		return s
+	}
+	s = columnValuePattern.ReplaceAllStringFunc(s, func(m string) string {
+		sub := columnValuePattern.FindStringSubmatch(m)
+		for _, col := range strings.Split(sub[1], ",") {
+			if r.fields[strings.TrimSpace(col)] {
+				return fmt.Sprintf("(%s)=(%s)", sub[1], r.Value(sub[2]))
+			}
+		}
+		return m
+	})
+	s = datePattern.ReplaceAllStringFunc(s, r.Value)
+	return urlPattern.ReplaceAllStringFunc(s, r.URL)
+}
+
+// Field redacts a log field. Fields named after PII are redacted whatever their type,
+// other string-like fields are redacted as free text.
+func (r *Redactor) Field(f zapcore.Field) zapcore.Field {
+	if r.mode == RedactionOff {
+		return f
+	}
+	if r.fields[f.Key] {
+		return zapcore.Field{Key: f.Key, Type: zapcore.StringType, String: r.Value(fieldString(f))}
+	}
+	switch f.Type {
+	case zapcore.StringType:
+		f.String = r.String(f.String)
+	case zapcore.ByteStringType:
+		return zapcore.Field{Key: f.Key, Type: zapcore.StringType, String: r.String(string(f.Interface.([]byte)))}
+	case zapcore.ErrorType:
+		if err, ok := f.Interface.(error); ok {
+			return zapcore.Field{Key: f.Key, Type: zapcore.StringType, String: r.String(err.Error())}
+		}
+	case zapcore.StringerType:
+		if s, ok := f.Interface.(fmt.Stringer); ok {
+			return zapcore.Field{Key: f.Key, Type: zapcore.StringType, String: r.String(s.String())}
+		}
+	}
+	return f
+}
+
+// fieldString renders the value of a field, so that it can be hashed whatever its type
+func fieldString(f zapcore.Field) string {
+	enc := zapcore.NewMapObjectEncoder()
+	f.AddTo(enc)
+	return fmt.Sprint(enc.Fields[f.Key])
+}
+
+// redactingCore redacts the message and the fields of the entries
+// before they reach the wrapped core
+type redactingCore struct {
+	zapcore.Core
+	redactor *Redactor
+}
+
+// NewRedactingCore wraps cores with the redaction policy, for zap.WrapCore
+func NewRedactingCore(policy RedactionPolicy) func(zapcore.Core) zapcore.Core {
+	redactor := NewRedactor(policy)
+	return func(core zapcore.Core) zapcore.Core {
+		return &redactingCore{Core: core, redactor: redactor}
+	}
+}
+
+func (c *redactingCore) fields(fields []zapcore.Field) []zapcore.Field {
+	out := make([]zapcore.Field, len(fields))
+	for i, f := range fields {
+		out[i] = c.redactor.Field(f)
+	}
+	return out
+}
+
+func (c *redactingCore) With(fields []zapcore.Field) zapcore.Core {
+	return &redactingCore{Core: c.Core.With(c.fields(fields)), redactor: c.redactor}
+}
+
+func (c *redactingCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	// let the wrapped core, e.g. a sampler, decide whether the entry is written
+	if c.Core.Check(ent, nil) == nil {
+		return ce
+	}
+	return ce.AddCore(ent, c)
+}
+
+func (c *redactingCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	ent.Message = c.redactor.String(ent.Message)
+	return c.Core.Write(ent, c.fields(fields))
+}
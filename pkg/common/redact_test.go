@@ -0,0 +1,86 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestRedactorURL(t *testing.T) {
+	r := NewRedactor(RedactionPolicy{Mode: RedactionMask, Fields: DefaultRedactionFields, Paths: DefaultRedactionPaths})
+
+	cases := []struct {
+		name string
+		url  string
+		want string
+	}{
+		{name: "path parameter", url: "/hello/apple", want: "/hello/***"},
+		{name: "versioned", url: "/v1/hello/apple/export", want: "/v1/hello/***/export"},
+		{name: "no parameter", url: "/v1/hello", want: "/v1/hello"},
+		{name: "query", url: "/v1/events?prefix=ap&x=1", want: "/v1/events?prefix=%2A%2A%2A&x=1"},
+		{name: "absolute", url: "http://localhost:8080/hello/apple", want: "http://localhost:8080/hello/***"},
+		{name: "empty parameter", url: "/hello/", want: "/hello/"},
+		{name: "unchanged", url: "//localhost:6379/10", want: "//localhost:6379/10"},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := r.URL(tt.url); got != tt.want {
+				t.Fatalf("got = %v, want = %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactorString(t *testing.T) {
+	r := NewRedactor(RedactionPolicy{Mode: RedactionMask, Fields: DefaultRedactionFields, Paths: DefaultRedactionPaths})
+
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{
+			in:   `duplicate key: Key (username)=(apple) on GET /hello/apple with 2000-01-02`,
+			want: `duplicate key: Key (username)=(***) on GET /hello/*** with ***`,
+		},
+		{
+			in:   `{URI:redis://localhost:6379/10 Paths:[/hello/{username}]}`,
+			want: `{URI:redis://localhost:6379/10 Paths:[/hello/{username}]}`,
+		},
+	}
+	for _, tt := range cases {
+		if got := r.String(tt.in); got != tt.want {
+			t.Fatalf("got = %v, want = %v", got, tt.want)
+		}
+	}
+}
+
+func TestRedactingCore(t *testing.T) {
+	var buf bytes.Buffer
+	core := zapcore.NewCore(
+		zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()),
+		zapcore.AddSync(&buf),
+		zapcore.DebugLevel,
+	)
+	policy := RedactionPolicy{Mode: RedactionHash, Key: "k", Fields: DefaultRedactionFields, Paths: DefaultRedactionPaths}
+	logger := zap.New(NewRedactingCore(policy)(core))
+
+	logger.With(zap.String("username", "apple")).Info(
+		"request",
+		zap.String("uri", "/v1/hello/apple"),
+		zap.Error(errors.New("born on 2000-01-02")),
+	)
+
+	out := buf.String()
+	if strings.Contains(out, "apple") || strings.Contains(out, "2000-01-02") {
+		t.Fatalf("got = %v, want = %v", out, "no PII")
+	}
+	// hashes of the same value can be correlated
+	hashed := NewRedactor(policy).Value("apple")
+	if strings.Count(out, hashed) != 2 {
+		t.Fatalf("got = %v, want = %v", out, hashed+" twice")
+	}
+}
@@ -2,11 +2,16 @@ package common
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"testing"
+
+	dbmigrations "github.com/awhdesmond/user-service/db"
+	"github.com/upper/db/v4"
 )
 
 func GetPostgresTestDb() string {
@@ -28,9 +33,26 @@ var (
 	TestRedisCfg = RedisCfg{
 		URI: "redis://localhost:6379/10",
 	}
-	TruncateAllTablesSQL = `TRUNCATE TABLE users;`
+	TruncateAllTablesSQL = `TRUNCATE TABLE users, erasure_receipts;`
 )
 
+// TestMakeSQLiteDBSession creates a SQLite database in dir, e.g. t.TempDir(),
+// with every migration applied
+func TestMakeSQLiteDBSession(dir string) (db.Session, error) {
+	sess, err := MakeSQLiteDBSession(SQLiteConfig{Path: filepath.Join(dir, "users.db")})
+	if err != nil {
+		return nil, err
+	}
+	migrator, err := NewMigrator(sess, dbmigrations.SQLite)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := migrator.Up(context.Background()); err != nil {
+		return nil, err
+	}
+	return sess, nil
+}
+
 func TestSendReq(req interface{}, path, method string, handler http.Handler) *httptest.ResponseRecorder {
 	var httpReq *http.Request
 	if req != nil {
@@ -5,29 +5,63 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
+
+	"github.com/awhdesmond/user-service/pkg/common/pb"
 )
 
 var (
-	ErrInvalidJSONBody     = errors.New("common.ErrInvalidJSONBody")
-	ErrEndpointReqMismatch = errors.New("common.ErrEndpointReqMismatch")
+	ErrInvalidJSONBody      = errors.New("common.ErrInvalidJSONBody")
+	ErrInvalidBody          = errors.New("common.ErrInvalidBody")
+	ErrEndpointReqMismatch  = errors.New("common.ErrEndpointReqMismatch")
+	ErrStreamingUnsupported = errors.New("common.ErrStreamingUnsupported")
 )
 
+// errStatusCode falls back to a generic status code when errToCode
+// does not know about err
+func errStatusCode(errToCode func(error) int, err error) int {
+	code := errToCode(err)
+	if code >= 0 {
+		return code
+	}
+	switch err {
+	case ErrInvalidJSONBody, ErrInvalidBody:
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// EncodeErrorFactory encodes errors as {"error": "<message>"}, in JSON unless
+// the Accept header in ctx asks for protobuf or MessagePack
 func EncodeErrorFactory(errToCode func(error) int) func(context.Context, error, http.ResponseWriter) {
 	return func(ctx context.Context, err error, w http.ResponseWriter) {
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		code := errToCode(err)
+		code := errStatusCode(errToCode, err)
 
-		if code < 0 {
-			switch err {
-			case ErrInvalidJSONBody:
-				w.WriteHeader(http.StatusBadRequest)
-			default:
-				w.WriteHeader(http.StatusInternalServerError)
-			}
-		} else {
+		var encErr error
+		switch NegotiateMediaType(RequestAccept(ctx), MediaTypes...) {
+		case MediaTypeProtobuf:
+			encErr = EncodeProtobuf(w, code, &pb.Error{Error: err.Error()})
+		case MediaTypeMsgpack:
+			encErr = EncodeMsgpack(w, code, GenericJSON{"error": err.Error()})
+		default:
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
 			w.WriteHeader(code)
+			encErr = json.NewEncoder(w).Encode(GenericJSON{"error": err.Error()})
 		}
-		if err := json.NewEncoder(w).Encode(GenericJSON{"error": err.Error()}); err != nil {
+		if encErr != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}
+}
+
+// EncodeErrorObjectFactory encodes errors as {"error": {"code": <status code>, "message": "<message>"}}
+func EncodeErrorObjectFactory(errToCode func(error) int, contentType string) func(context.Context, error, http.ResponseWriter) {
+	return func(ctx context.Context, err error, w http.ResponseWriter) {
+		code := errStatusCode(errToCode, err)
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(code)
+		body := GenericJSON{"error": GenericJSON{"code": code, "message": err.Error()}}
+		if err := json.NewEncoder(w).Encode(body); err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 		}
 	}
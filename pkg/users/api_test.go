@@ -5,9 +5,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/awhdesmond/user-service/docs"
+	"github.com/awhdesmond/user-service/pkg/api"
 	"github.com/awhdesmond/user-service/pkg/common"
 	"github.com/google/go-cmp/cmp"
 	"github.com/redis/go-redis/v9"
@@ -16,7 +20,7 @@ import (
 )
 
 const (
-	apiPrefix = "/hello"
+	apiPrefix = APIV1Prefix + "/hello"
 )
 
 var (
@@ -26,10 +30,13 @@ var (
 	}
 )
 
+// apiTestSuite runs against the store of backend, Postgres by default.
+// The SQLite store runs without Redis, and the memory store without sess.
 type apiTestSuite struct {
 	suite.Suite
 
-	pgSess  db.Session
+	backend string
+	sess    db.Session
 	rdb     redis.UniversalClient
 	store   Store
 	svc     Service
@@ -38,27 +45,46 @@ type apiTestSuite struct {
 
 func (ts *apiTestSuite) SetupSuite() {
 	logger, _ := common.InitZap("debug")
-	pgSess, err := common.MakePostgresDBSession(common.TestPgCfg)
-	if err != nil {
-		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	switch ts.backend {
+	case StoreBackendMemory:
+		ts.store = NewMemoryStore(NewMemoryEventBroker(), logger)
+	case StoreBackendSQLite:
+		sess, err := common.TestMakeSQLiteDBSession(ts.T().TempDir())
+		if err != nil {
+			ts.T().Fatalf("got = %v, want = %v", err, nil)
+		}
+		ts.sess = sess
+		ts.store = NewSQLiteStore(sess, nil, NewMemoryEventBroker(), StoreConfig{}, logger)
+	default:
+		pgSess, err := common.MakePostgresDBSession(common.TestPgCfg)
+		if err != nil {
+			ts.T().Fatalf("got = %v, want = %v", err, nil)
+		}
+		rdb, err := common.MakeRedisClient(common.TestRedisCfg)
+		if err != nil {
+			ts.T().Fatalf("got = %v, want = %v", err, nil)
+		}
+		ts.sess = pgSess
+		ts.rdb = rdb
+		ts.store = NewStore(pgSess, rdb, NewRedisEventBroker(rdb, logger), StoreConfig{}, logger)
 	}
-	rdb, err := common.MakeRedisClient(common.TestRedisCfg)
+	ts.svc = NewService(ts.store, testTimeFn)
+
+	// responses which drift from the spec fail with 500
+	openapi, err := api.NewOpenAPI(docs.OpenAPISpec, logger)
 	if err != nil {
 		ts.T().Fatalf("got = %v, want = %v", err, nil)
 	}
-
-	store := NewStore(pgSess, rdb, logger)
-	svc := NewService(store, testTimeFn)
-
-	ts.pgSess = pgSess
-	ts.rdb = rdb
-	ts.store = store
-	ts.svc = svc
-	ts.handler = MakeHandler(ts.svc)
+	validationMW := api.NewOpenAPIValidationMiddleware(openapi, api.OpenAPIConfig{ValidateResponses: true})
+	ts.handler = validationMW.Handler(MakeHandler(ts.svc))
 }
 
 func (ts *apiTestSuite) TearDownSuite() {
-	_, err := ts.pgSess.SQL().Exec(common.TruncateAllTablesSQL)
+	if ts.backend != "" {
+		// the databases of the other backends are not shared
+		return
+	}
+	_, err := ts.sess.SQL().Exec(common.TruncateAllTablesSQL)
 	if err != nil {
 		ts.T().Log(err)
 	}
@@ -74,6 +100,14 @@ func TestUpsertApiTestSuite(t *testing.T) {
 	suite.Run(t, new(UpsertApiTestSuite))
 }
 
+func TestUpsertApiTestSuiteMemory(t *testing.T) {
+	suite.Run(t, &UpsertApiTestSuite{apiTestSuite{backend: StoreBackendMemory}})
+}
+
+func TestUpsertApiTestSuiteSQLite(t *testing.T) {
+	suite.Run(t, &UpsertApiTestSuite{apiTestSuite{backend: StoreBackendSQLite}})
+}
+
 func (ts *UpsertApiTestSuite) Test() {
 	cases := []struct {
 		name     string
@@ -234,6 +268,14 @@ func TestReadApiTestSuite(t *testing.T) {
 	suite.Run(t, new(ReadApiTestSuite))
 }
 
+func TestReadApiTestSuiteMemory(t *testing.T) {
+	suite.Run(t, &ReadApiTestSuite{apiTestSuite{backend: StoreBackendMemory}})
+}
+
+func TestReadApiTestSuiteSQLite(t *testing.T) {
+	suite.Run(t, &ReadApiTestSuite{apiTestSuite{backend: StoreBackendSQLite}})
+}
+
 func (ts *ReadApiTestSuite) Test() {
 	// NOTE: we need to handle this edge case
 	// in order for the test to always work in both leap and non-leap years.
@@ -297,6 +339,242 @@ func (ts *ReadApiTestSuite) Test() {
 	}
 }
 
+func (ts *ReadApiTestSuite) TestCalendar() {
+	cases := []struct {
+		name string
+		path string
+		want []string
+	}{
+		{
+			name: "single user",
+			path: fmt.Sprintf("%s/%s/birthday.ics", apiPrefix, "apple"),
+			want: []string{"UID:birthday-apple@user-service"},
+		},
+		{
+			name: "all users",
+			path: APIV1Prefix + "/birthdays.ics",
+			want: []string{
+				"UID:birthday-apple@user-service",
+				"UID:birthday-mango@user-service",
+				"UID:birthday-pear@user-service",
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		tt := tt
+		ts.T().Run(tt.name, func(t *testing.T) {
+			w := common.TestSendReq(nil, tt.path, http.MethodGet, ts.handler)
+
+			// status code should be HTTP 200
+			if w.Code != http.StatusOK {
+				t.Fatalf("got = %v, want = %v", w.Code, http.StatusOK)
+			}
+			if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/calendar") {
+				t.Fatalf("got = %v, want = %v", ct, "text/calendar")
+			}
+
+			body := w.Body.String()
+			for _, want := range tt.want {
+				if !strings.Contains(body, want) {
+					t.Fatalf("got = %v, want = %v", body, want)
+				}
+			}
+		})
+	}
+}
+
+func (ts *ReadApiTestSuite) TestDelete() {
+	if err := ts.svc.Upsert(context.Background(), "plum", "2000-01-01"); err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+
+	path := fmt.Sprintf("%s/%s", apiPrefix, "plum")
+	w := common.TestSendReq(nil, path, http.MethodDelete, ts.handler)
+	if w.Code != http.StatusNoContent {
+		ts.T().Fatalf("got = %v, want = %v", w.Code, http.StatusNoContent)
+	}
+
+	w = common.TestSendReq(nil, path, http.MethodGet, ts.handler)
+	common.TestIsResponseErrorExpected(w, ts.T(), ErrUserNotFound.Error())
+
+	w = common.TestSendReq(nil, path, http.MethodDelete, ts.handler)
+	common.TestIsResponseErrorExpected(w, ts.T(), ErrUserNotFound.Error())
+}
+
+func (ts *ReadApiTestSuite) TestExportAndErase() {
+	ctx := context.Background()
+	if err := ts.svc.Upsert(ctx, "quince", "2000-01-01"); err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+
+	export, err := ts.svc.Export(ctx, "quince")
+	if err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+	// only the Postgres store runs with Redis
+	if export.User == nil || export.Cache == nil && ts.rdb != nil || len(export.Events) == 0 {
+		ts.T().Fatalf("got = %v, want = %v", export, "row, cache entry and events")
+	}
+
+	path := fmt.Sprintf("%s/%s/erase", apiPrefix, "quince")
+	w := common.TestSendReq(nil, path, http.MethodPost, ts.handler)
+	if w.Code != http.StatusOK {
+		ts.T().Fatalf("got = %v, want = %v", w.Code, http.StatusOK)
+	}
+	var resp EraseResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+	if resp.Receipt.RowsDeleted != 1 || resp.Receipt.EventsDeleted != len(export.Events) {
+		ts.T().Fatalf("got = %v, want = %v", resp.Receipt, "one row and every event deleted")
+	}
+
+	if _, err := ts.svc.Export(ctx, "quince"); err != ErrUserNotFound {
+		ts.T().Fatalf("got = %v, want = %v", err, ErrUserNotFound)
+	}
+
+	var receipts []ErasureReceipt
+	if ts.backend == StoreBackendMemory {
+		receipts = ts.store.(*memoryStore).receipts
+	} else if receipts, err = ListErasureReceipts(ctx, ts.sess); err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+	if err := VerifyErasureReceipts(receipts); err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+}
+
+func (ts *ReadApiTestSuite) TestEncryption() {
+	if ts.backend != "" {
+		ts.T().Skip("keys are only rotated in Postgres")
+	}
+	ctx := context.Background()
+	keyring := testKeyring(ts.T())
+	logger, _ := common.InitZap("debug")
+	admin := NewCacheAdmin(ts.rdb, logger)
+
+	before, err := ts.store.Read(ctx, "mango")
+	if err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+	// wait for the write-behind of the read to reach redis
+	time.Sleep(100 * time.Millisecond)
+	cached, err := admin.Inspect(ctx, before.Username)
+	if err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+
+	n, err := ReencryptUsers(ctx, ts.sess, keyring, admin, 2)
+	if err != nil || n < 3 {
+		ts.T().Fatalf("got = %v, %v, want = %v", n, err, "at least 3 users re-encrypted")
+	}
+	if _, err := admin.Inspect(ctx, before.Username); err != ErrNotCached {
+		ts.T().Fatalf("got = %v, want = %v", err, ErrNotCached)
+	}
+	versionRow, err := ts.sess.SQL().QueryRow(`SELECT version FROM users WHERE username = ?`, before.Username)
+	var version int64
+	if err == nil {
+		err = versionRow.Scan(&version)
+	}
+	if err != nil || version <= cached.Version {
+		ts.T().Fatalf("got = %v, %v, want = %v", version, err, "a version above the cached one")
+	}
+	row, err := ts.sess.SQL().QueryRow(`SELECT count(*) FROM users WHERE date_of_birth IS NOT NULL`)
+	var plaintext int
+	if err == nil {
+		err = row.Scan(&plaintext)
+	}
+	if err != nil || plaintext != 0 {
+		ts.T().Fatalf("got = %v, %v, want = %v", plaintext, err, 0)
+	}
+
+	encStore := NewStore(ts.sess, ts.rdb, NewRedisEventBroker(ts.rdb, logger), StoreConfig{Keyring: keyring}, logger)
+	today := testTimeFn()
+	usrs, err := encStore.ListByBirthday(ctx, today, today)
+	if err != nil || len(usrs) != 1 || usrs[0].Username != "mango" {
+		ts.T().Fatalf("got = %v, %v, want = %v", usrs, err, "mango")
+	}
+
+	// write the users back in plaintext for the other tests
+	usrs, err = encStore.List(ctx)
+	if err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+	for _, u := range usrs {
+		if err := ts.store.Upsert(ctx, u.Username, u.DoB); err != nil {
+			ts.T().Fatalf("got = %v, want = %v", err, nil)
+		}
+	}
+}
+
+func (ts *ReadApiTestSuite) TestUpcoming() {
+	w := common.TestSendReq(nil, APIV1Prefix+"/birthdays?days=40", http.MethodGet, ts.handler)
+	if w.Code != http.StatusOK {
+		ts.T().Fatalf("got = %v, want = %v", w.Code, http.StatusOK)
+	}
+
+	var resp UpcomingResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+
+	got := []string{}
+	for _, b := range resp.Birthdays {
+		got = append(got, fmt.Sprintf("%s:%d", b.Username, b.DaysToBirthday))
+	}
+	want := []string{"mango:0", "pear:32"}
+	if !cmp.Equal(got, want) {
+		ts.T().Fatalf("got = %v, want = %v", got, want)
+	}
+
+	w = common.TestSendReq(nil, APIV1Prefix+"/birthdays?days=400", http.MethodGet, ts.handler)
+	common.TestIsResponseErrorExpected(w, ts.T(), ErrDaysInvalid.Error())
+}
+
+func (ts *ReadApiTestSuite) TestVersions() {
+	cases := []struct {
+		name     string
+		path     string
+		wantBody string
+	}{
+		{
+			name:     "read",
+			path:     fmt.Sprintf("%s/%s", apiPrefix, "mango"),
+			wantBody: `{"data":{"message":"Hello, mango! Happy birthday!"}}`,
+		},
+		{
+			name:     "upcoming",
+			path:     APIV1Prefix + "/birthdays?days=0",
+			wantBody: `{"data":[{"username":"mango",`,
+		},
+		{
+			name:     "deprecated alias",
+			path:     "/hello/mango",
+			wantBody: `{"data":{"message":"Hello, mango! Happy birthday!"}}`,
+		},
+	}
+
+	for _, tt := range cases {
+		ts.Run(tt.name, func() {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.Header.Set("Accept", MediaTypeV2)
+			w := httptest.NewRecorder()
+			ts.handler.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				ts.T().Fatalf("got = %v, want = %v", w.Code, http.StatusOK)
+			}
+			if got := w.Header().Get("Content-Type"); got != MediaTypeV2 {
+				ts.T().Fatalf("got = %v, want = %v", got, MediaTypeV2)
+			}
+			if got := strings.TrimSpace(w.Body.String()); !strings.HasPrefix(got, tt.wantBody) {
+				ts.T().Fatalf("got = %v, want = %v", got, tt.wantBody)
+			}
+		})
+	}
+}
+
 func (ts *ReadApiTestSuite) TestErrors() {
 	cases := []struct {
 		name     string
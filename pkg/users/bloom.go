@@ -0,0 +1,246 @@
+package users
+
+import (
+	"context"
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+const (
+	bloomFalsePositiveRate = 0.01
+	// bloomMinCapacity leaves room for the users created until the next rebuild
+	bloomMinCapacity = 1024
+)
+
+// bloomFilter is a set of strings without false negatives
+type bloomFilter struct {
+	bits []uint64
+	m    uint64
+	k    uint64
+}
+
+// newBloomFilter sizes a filter for n strings and bloomFalsePositiveRate
+func newBloomFilter(n int) *bloomFilter {
+	if n < bloomMinCapacity {
+		n = bloomMinCapacity
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(bloomFalsePositiveRate) / (math.Ln2 * math.Ln2)))
+	k := uint64(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &bloomFilter{bits: make([]uint64, (m+63)/64), m: m, k: k}
+}
+
+// locations derives the k bits of s from two halves of its FNV-1a hash
+func (f *bloomFilter) locations(s string) []uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return f.probes(h.Sum64())
+}
+
+// probes steps from the lower half of sum by its upper half, which is
+// forced odd so that a zero upper half does not probe the same bit k times
+func (f *bloomFilter) probes(sum uint64) []uint64 {
+	h1, h2 := sum&math.MaxUint32, sum>>32|1
+
+	locs := make([]uint64, f.k)
+	for i := range locs {
+		locs[i] = (h1 + uint64(i)*h2) % f.m
+	}
+	return locs
+}
+
+func (f *bloomFilter) add(s string) {
+	for _, loc := range f.locations(s) {
+		f.bits[loc/64] |= 1 << (loc % 64)
+	}
+}
+
+func (f *bloomFilter) mayContain(s string) bool {
+	for _, loc := range f.locations(s) {
+		if f.bits[loc/64]&(1<<(loc%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// usernameFilter is a Bloom filter of the existing usernames, so that
+// usernames which do not exist are rejected without querying the DB.
+// Usernames cannot be removed from the filter, so it is rebuilt from
+// the DB periodically. Every username may exist until it is first built,
+// while it is out of sync with the usernames published by other replicas,
+// and when it was not rebuilt for longer than maxAge, so that it never
+// rejects a username which exists for long.
+type usernameFilter struct {
+	mu     sync.RWMutex
+	filter *bloomFilter
+	// pending are the usernames added while the filter is rebuilt
+	pending    []string
+	rebuilding bool
+
+	builtAt time.Time
+	maxAge  time.Duration
+	// synced is false from a resync until the next rebuild which started after it
+	synced bool
+	epoch  uint64
+	// awaitResync is true until the first resync, when the filter is watched
+	awaitResync bool
+	// resyncs asks for a rebuild
+	resyncs chan struct{}
+}
+
+// newUsernameFilter returns a filter which does not reject usernames once it was
+// not rebuilt for maxAge. A watched filter is only in sync from its first resync.
+func newUsernameFilter(maxAge time.Duration, watched bool) *usernameFilter {
+	return &usernameFilter{
+		maxAge:      maxAge,
+		awaitResync: watched,
+		resyncs:     make(chan struct{}, 1),
+	}
+}
+
+// mayContain is false when the username does not exist. It is true when the filter is nil.
+func (f *usernameFilter) mayContain(username string) bool {
+	if f == nil {
+		return true
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.filter == nil || !f.synced || f.maxAge > 0 && time.Since(f.builtAt) > f.maxAge {
+		return true
+	}
+	return f.filter.mayContain(username)
+}
+
+// resync trusts the filter again only after the next rebuild, e.g. once the
+// subscription to the usernames of other replicas is established again after
+// messages may have been missed, and asks for that rebuild.
+func (f *usernameFilter) resync() {
+	f.mu.Lock()
+	f.epoch++
+	f.synced, f.awaitResync = false, false
+	f.mu.Unlock()
+
+	select {
+	case f.resyncs <- struct{}{}:
+	default:
+	}
+}
+
+// add records a username which exists. It does nothing when the filter is nil.
+func (f *usernameFilter) add(username string) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.filter != nil {
+		f.filter.add(username)
+	}
+	if f.rebuilding {
+		f.pending = append(f.pending, username)
+	}
+}
+
+// rebuild replaces the filter by one of the usernames returned by list.
+// The usernames added while list runs are kept.
+func (f *usernameFilter) rebuild(list func() ([]string, error)) error {
+	f.mu.Lock()
+	f.rebuilding, f.pending = true, nil
+	epoch := f.epoch
+	f.mu.Unlock()
+
+	usernames, err := list()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	pending := f.pending
+	f.rebuilding, f.pending = false, nil
+	if err != nil {
+		return err
+	}
+	filter := newBloomFilter(2 * (len(usernames) + len(pending)))
+	for _, username := range append(usernames, pending...) {
+		filter.add(username)
+	}
+	f.filter = filter
+	f.builtAt = time.Now()
+	// the usernames published during a resync which happened meanwhile may be missing
+	f.synced = epoch == f.epoch && !f.awaitResync
+	return nil
+}
+
+// listUsernames reads every username from the primary, which does not lag
+// behind the usernames added to the filter by upserts
+func (store *store) listUsernames(ctx context.Context) ([]string, error) {
+	rows := []struct {
+		Username string `db:"username"`
+	}{}
+	err := store.sess.WithContext(ctx).SQL().Select("username").From(dbtable).All(&rows)
+	if err != nil {
+		return nil, err
+	}
+	usernames := make([]string, 0, len(rows))
+	for _, row := range rows {
+		usernames = append(usernames, row.Username)
+	}
+	return usernames, nil
+}
+
+// rebuildUsernameFilter builds the Bloom filter of usernames, and rebuilds
+// it every interval so that deleted usernames are dropped from it, and on resync.
+func (store *store) rebuildUsernameFilter(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		err := store.usernames.rebuild(func() ([]string, error) {
+			return store.listUsernames(ctx)
+		})
+		if err != nil {
+			store.logger.Warn("bloom filter error", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-store.usernames.resyncs:
+		}
+	}
+}
+
+// watchUsernames adds the usernames upserted by other replicas to the Bloom
+// filter, from the invalidations they publish. The filter is resynced every
+// time the subscription is established, including after a reconnection, so
+// that the invalidations missed while disconnected from Redis are recovered.
+func (store *store) watchUsernames(ctx context.Context, rdb redis.UniversalClient) {
+	sub := rdb.Subscribe(ctx, rdbInvalidationChannel)
+	defer sub.Close()
+
+	ch := sub.ChannelWithSubscriptions()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			switch msg := msg.(type) {
+			case *redis.Subscription:
+				if msg.Kind == "subscribe" {
+					store.usernames.resync()
+				}
+			case *redis.Message:
+				store.usernames.add(msg.Payload)
+			}
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package users
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBloomFilter(t *testing.T) {
+	f := newBloomFilter(10000)
+	for i := 0; i < 10000; i++ {
+		f.add(fmt.Sprintf("user%d", i))
+	}
+	for i := 0; i < 10000; i++ {
+		if !f.mayContain(fmt.Sprintf("user%d", i)) {
+			t.Fatalf("got = %v, want = %v", false, true)
+		}
+	}
+
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if f.mayContain(fmt.Sprintf("stranger%d", i)) {
+			falsePositives++
+		}
+	}
+	if rate := float64(falsePositives) / 10000; rate > 2*bloomFalsePositiveRate {
+		t.Fatalf("got = %v, want = %v", rate, bloomFalsePositiveRate)
+	}
+}
+
+func TestBloomFilterProbes(t *testing.T) {
+	f := newBloomFilter(10000)
+	// a hash whose upper half is zero still sets k different bits
+	locs := map[uint64]bool{}
+	for _, loc := range f.probes(42) {
+		locs[loc] = true
+	}
+	if len(locs) != int(f.k) {
+		t.Fatalf("got = %v, want = %v", len(locs), f.k)
+	}
+}
+
+func TestUsernameFilter(t *testing.T) {
+	var disabled *usernameFilter
+	disabled.add("apple")
+	if !disabled.mayContain("banana") {
+		t.Fatalf("got = %v, want = %v", false, true)
+	}
+
+	f := &usernameFilter{}
+	if !f.mayContain("banana") {
+		t.Fatalf("got = %v, want = %v", false, "every username before the first build")
+	}
+
+	// usernames added during a rebuild are kept
+	err := f.rebuild(func() ([]string, error) {
+		f.add("cherry")
+		return []string{"apple"}, nil
+	})
+	if err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	if !f.mayContain("apple") || !f.mayContain("cherry") {
+		t.Fatalf("got = %v, want = %v", false, true)
+	}
+	if f.mayContain("banana") {
+		t.Fatalf("got = %v, want = %v", true, false)
+	}
+
+	// a failed rebuild keeps the previous filter
+	errList := errors.New("db error")
+	if err := f.rebuild(func() ([]string, error) { return nil, errList }); err != errList {
+		t.Fatalf("got = %v, want = %v", err, errList)
+	}
+	if !f.mayContain("apple") {
+		t.Fatalf("got = %v, want = %v", false, true)
+	}
+}
+
+func TestUsernameFilterSync(t *testing.T) {
+	list := func() ([]string, error) { return []string{"apple"}, nil }
+
+	// a watched filter rejects usernames once it was resynced and rebuilt
+	f := newUsernameFilter(time.Minute, true)
+	if err := f.rebuild(list); err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	if !f.mayContain("banana") {
+		t.Fatalf("got = %v, want = %v", false, "every username before the first resync")
+	}
+	f.resync()
+	if !f.mayContain("banana") {
+		t.Fatalf("got = %v, want = %v", false, "every username until rebuilt")
+	}
+	select {
+	case <-f.resyncs:
+	default:
+		t.Fatalf("got = %v, want = %v", "no rebuild", "a rebuild")
+	}
+	if err := f.rebuild(list); err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	if f.mayContain("banana") {
+		t.Fatalf("got = %v, want = %v", true, false)
+	}
+
+	// a resync during a rebuild needs another rebuild
+	err := f.rebuild(func() ([]string, error) {
+		f.resync()
+		return list()
+	})
+	if err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	if !f.mayContain("banana") {
+		t.Fatalf("got = %v, want = %v", false, "every username until rebuilt")
+	}
+
+	// a filter which was not rebuilt for maxAge no longer rejects usernames
+	f = newUsernameFilter(10*time.Millisecond, false)
+	if err := f.rebuild(list); err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	if f.mayContain("banana") {
+		t.Fatalf("got = %v, want = %v", true, false)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if !f.mayContain("banana") {
+		t.Fatalf("got = %v, want = %v", false, "every username once stale")
+	}
+}
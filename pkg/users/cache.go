@@ -0,0 +1,544 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+	"github.com/sony/gobreaker"
+	"go.uber.org/zap"
+)
+
+const (
+	cacheTierLocal = "local"
+	cacheTierRedis = "redis"
+
+	cacheResultHit      = "hit"
+	cacheResultMiss     = "miss"
+	cacheResultNotFound = "not_found"
+	// cacheResultUnavailable counts lookups which failed, or were not sent
+	// to Redis because the circuit breaker is open
+	cacheResultUnavailable = "unavailable"
+
+	// rdbInvalidationChannel is the Redis pub/sub channel used to evict
+	// usernames from the local cache of every replica.
+	rdbInvalidationChannel = "user_service:invalidations"
+
+	// rdbNotFoundValue is cached for usernames which do not exist
+	rdbNotFoundValue = "not-found"
+
+	// notFoundVersion is the version of the usernames found missing by reads.
+	// It does not replace any value, since versions of users are 0 or more:
+	// SQLite rows written before versions were added have version 0.
+	notFoundVersion int64 = -1
+)
+
+var (
+	errCacheMiss        = errors.New("cache miss")
+	ErrNotCached        = errors.New("user is not cached")
+	ErrCacheUnavailable = errors.New("cache is unavailable")
+
+	// cacheTTLJitter spreads the expiry of users cached at the same time
+	// over a fraction of DefaultCacheTTL, so that they do not expire at once
+	cacheTTLJitter = 0.1
+	// earlyRefreshDelta approximates how long it takes to read a user from the
+	// database. Users are refreshed early with a probability which grows as
+	// their remaining TTL in Redis shrinks towards it.
+	earlyRefreshDelta = time.Second
+
+	// cacheBreakerFailures consecutive Redis errors open the circuit breaker,
+	// which lets a request through again after cacheBreakerTimeout
+	cacheBreakerFailures uint32 = 5
+	cacheBreakerTimeout         = 10 * time.Second
+
+	cacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "cache",
+		Name:      "requests_total",
+		Help:      "cache lookups partitioned by tier and result",
+	}, []string{"tier", "result"})
+	cacheStaleWrites = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: "cache",
+		Name:      "stale_writes_total",
+		Help:      "writes to redis which were skipped because it holds a newer version",
+	})
+	cacheBreakerState = prometheus.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "cache",
+		Name:      "circuit_breaker_state",
+		Help:      "state of the circuit breaker around redis: 0 closed, 1 half-open, 2 open",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(cacheRequests, cacheStaleWrites, cacheBreakerState)
+}
+
+// rdbCompareAndSet sets KEYS[1] to ARGV[2] for ARGV[3] milliseconds unless
+// it holds a version higher than ARGV[1]. Values are prefixed with their
+// version, values without version are version 0. It returns 1 when it set the key.
+var rdbCompareAndSet = redis.NewScript(`
+local cur = redis.call("GET", KEYS[1])
+if cur then
+	local version = tonumber(string.match(cur, "^(-?%d+):") or "0")
+	if version > tonumber(ARGV[1]) then
+		return 0
+	end
+end
+redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+return 1
+`)
+
+// cache is a two-tier cache of users. The first tier is an optional
+// in-process LRU with a short TTL, the second tier is Redis. Without
+// Redis, e.g. for a single SQLite replica, only the first tier is used.
+//
+// Local entries are evicted on every replica through Redis pub/sub whenever
+// a user changes. Messages published while a replica is disconnected from
+// Redis are lost, so the local TTL bounds how long a replica can serve stale data.
+//
+// Usernames which do not exist are cached as well, for a shorter TTL, so that
+// requests for random usernames do not all reach the database. In the local
+// tier, they are cached as a User without username.
+//
+// Values in Redis carry the version of the user they were read or written
+// with, and are only replaced by values of the same or a higher version, so
+// that a slow write of a value read before an upsert or a deletion cannot
+// move the cache back.
+//
+// Redis is called through a circuit breaker, so that a Redis outage degrades
+// the cache instead of failing requests: lookups miss, and writes return
+// ErrCacheUnavailable once the DB is already written. The users whose writes
+// did not reach Redis may be stale there, and are evicted once it recovers.
+type cache struct {
+	rdb         redis.UniversalClient
+	breaker     *gobreaker.CircuitBreaker
+	local       *expirable.LRU[string, User]
+	notFoundTTL time.Duration
+	envelope    envelope
+	logger      *zap.Logger
+
+	mu sync.Mutex
+	// dirty are the usernames to evict from Redis once it recovers
+	dirty     map[string]bool
+	repairing bool
+}
+
+// newCache returns a cache which listens for invalidations from other replicas
+// until ctx is done when it has a local tier.
+func newCache(ctx context.Context, rdb redis.UniversalClient, cfg StoreConfig, logger *zap.Logger) *cache {
+	notFoundTTL := cfg.NotFoundCacheTTL
+	if notFoundTTL <= 0 {
+		notFoundTTL = DefaultNotFoundCacheTTL
+	}
+	c := &cache{rdb: rdb, notFoundTTL: notFoundTTL, envelope: newEnvelope(cfg), logger: logger, dirty: map[string]bool{}}
+	if rdb != nil {
+		c.breaker = gobreaker.NewCircuitBreaker(gobreaker.Settings{
+			Name:    "cache",
+			Timeout: cacheBreakerTimeout,
+			ReadyToTrip: func(counts gobreaker.Counts) bool {
+				return counts.ConsecutiveFailures >= cacheBreakerFailures
+			},
+			OnStateChange: func(_ string, from, to gobreaker.State) {
+				cacheBreakerState.Set(float64(to))
+				logger.Warn("cache circuit breaker", zap.Stringer("from", from), zap.Stringer("to", to))
+			},
+			IsSuccessful: func(err error) bool {
+				return err == nil || errors.Is(err, redis.Nil)
+			},
+		})
+	}
+	if cfg.LocalCacheSize > 0 {
+		ttl := cfg.LocalCacheTTL
+		if ttl <= 0 {
+			ttl = DefaultLocalCacheTTL
+		}
+		c.local = expirable.NewLRU[string, User](cfg.LocalCacheSize, nil, ttl)
+		if rdb != nil {
+			go c.subscribeInvalidations(ctx)
+		}
+	}
+	return c
+}
+
+func (c *cache) rdbUserKey(username string) string {
+	return fmt.Sprintf("user_service:v%d:username:%s", cacheSchemaVersion, username)
+}
+
+// get looks the user up in the local tier, then in Redis.
+// It returns errCacheMiss when neither tier has the user, ErrUserNotFound
+// when the user is cached as not found, and whether a user found in
+// Redis should be refreshed early.
+func (c *cache) get(ctx context.Context, username string) (User, bool, error) {
+	if c.local != nil {
+		if usr, ok := c.local.Get(username); ok && usr.Username == "" {
+			cacheRequests.WithLabelValues(cacheTierLocal, cacheResultNotFound).Inc()
+			return User{}, false, ErrUserNotFound
+		} else if ok {
+			cacheRequests.WithLabelValues(cacheTierLocal, cacheResultHit).Inc()
+			return usr, false, nil
+		}
+		cacheRequests.WithLabelValues(cacheTierLocal, cacheResultMiss).Inc()
+	}
+	if c.rdb == nil {
+		return User{}, false, errCacheMiss
+	}
+
+	rdbUserKey := c.rdbUserKey(username)
+	var getCmd *redis.StringCmd
+	var ttlCmd *redis.DurationCmd
+	err := c.do(func() error {
+		pipe := c.rdb.Pipeline()
+		getCmd = pipe.Get(ctx, rdbUserKey)
+		ttlCmd = pipe.PTTL(ctx, rdbUserKey)
+		_, err := pipe.Exec(ctx)
+		return err
+	})
+	if errors.Is(err, redis.Nil) {
+		cacheRequests.WithLabelValues(cacheTierRedis, cacheResultMiss).Inc()
+		return User{}, false, errCacheMiss
+	}
+	if err != nil {
+		// read through to the db while redis is unavailable
+		cacheRequests.WithLabelValues(cacheTierRedis, cacheResultUnavailable).Inc()
+		return User{}, false, errCacheMiss
+	}
+
+	_, value := splitVersion(getCmd.Val())
+	if value == rdbNotFoundValue {
+		cacheRequests.WithLabelValues(cacheTierRedis, cacheResultNotFound).Inc()
+		if c.local != nil {
+			c.local.Add(username, User{})
+		}
+		return User{}, false, ErrUserNotFound
+	}
+
+	usr, err := c.envelope.decode(username, value)
+	if err != nil {
+		// dirty data in cache, refetch from db
+		c.do(func() error { return c.rdb.Del(ctx, rdbUserKey).Err() })
+		cacheRequests.WithLabelValues(cacheTierRedis, cacheResultMiss).Inc()
+		return User{}, false, errCacheMiss
+	}
+
+	cacheRequests.WithLabelValues(cacheTierRedis, cacheResultHit).Inc()
+	c.setLocal(usr)
+	return usr, refreshEarly(ttlCmd.Val(), earlyRefreshDelta, 1-rand.Float64()), nil
+}
+
+// do calls Redis through the circuit breaker. It returns ErrCacheUnavailable
+// when the breaker rejects the call, and otherwise the error of fn, which is
+// logged unless it is redis.Nil.
+func (c *cache) do(fn func() error) error {
+	_, err := c.breaker.Execute(func() (interface{}, error) {
+		return nil, fn()
+	})
+	switch {
+	case errors.Is(err, gobreaker.ErrOpenState), errors.Is(err, gobreaker.ErrTooManyRequests):
+		return ErrCacheUnavailable
+	case err != nil && !errors.Is(err, redis.Nil):
+		c.logger.Error("cache error", zap.Error(err))
+		return err
+	}
+	c.repairLater()
+	return err
+}
+
+// health returns ErrCacheUnavailable unless the circuit breaker is closed
+func (c *cache) health() error {
+	if c.breaker != nil && c.breaker.State() != gobreaker.StateClosed {
+		return ErrCacheUnavailable
+	}
+	return nil
+}
+
+// markDirty records that Redis may hold a stale value of the user
+func (c *cache) markDirty(usernames ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, username := range usernames {
+		c.dirty[username] = true
+	}
+}
+
+// repairLater starts a repair unless nothing is dirty or a repair is running
+func (c *cache) repairLater() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.dirty) == 0 || c.repairing {
+		return
+	}
+	c.repairing = true
+	go c.repair(context.Background())
+}
+
+// repair evicts the dirty users from Redis and from the local tier of every
+// replica. The users which could not be evicted stay dirty.
+func (c *cache) repair(ctx context.Context) {
+	c.mu.Lock()
+	usernames := make([]string, 0, len(c.dirty))
+	for username := range c.dirty {
+		usernames = append(usernames, username)
+	}
+	c.dirty = map[string]bool{}
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		c.repairing = false
+		c.mu.Unlock()
+	}()
+	for i, username := range usernames {
+		err := c.do(func() error {
+			pipe := c.rdb.Pipeline()
+			pipe.Del(ctx, c.rdbUserKey(username))
+			pipe.Publish(ctx, rdbInvalidationChannel, username)
+			_, err := pipe.Exec(ctx)
+			return err
+		})
+		if err != nil {
+			c.markDirty(usernames[i:]...)
+			return
+		}
+	}
+	c.logger.Info("cache repaired", zap.Int("users", len(usernames)))
+}
+
+// refreshEarly implements probabilistic early expiration (XFetch): an entry
+// is refreshed when ttl <= -delta * ln(r) for a uniform r in (0, 1], which
+// happens with probability exp(-ttl/delta). Replicas hence rarely refresh an
+// entry long before it expires, and seldom all miss it at the same time.
+func refreshEarly(ttl, delta time.Duration, r float64) bool {
+	if ttl < 0 {
+		// the key has no expiry, or expired since it was read
+		return false
+	}
+	return float64(ttl) <= -float64(delta)*math.Log(r)
+}
+
+// cacheTTL is DefaultCacheTTL with up to cacheTTLJitter added
+func cacheTTL() time.Duration {
+	return DefaultCacheTTL + time.Duration(rand.Float64()*cacheTTLJitter*float64(DefaultCacheTTL))
+}
+
+// setLocal saves the user to the local tier only.
+func (c *cache) setLocal(usr User) {
+	if c.local != nil {
+		c.local.Add(usr.Username, usr)
+	}
+}
+
+// splitVersion splits a value of Redis into its version and the value itself
+func splitVersion(value string) (int64, string) {
+	prefix, rest, ok := strings.Cut(value, ":")
+	if !ok {
+		return 0, value
+	}
+	version, err := strconv.ParseInt(prefix, 10, 64)
+	if err != nil {
+		// e.g. encrypted values written without version
+		return 0, value
+	}
+	return version, rest
+}
+
+// compareAndSet saves the value of the user unless Redis holds a newer
+// version, and reports whether it did.
+func (c *cache) compareAndSet(ctx context.Context, username string, version int64, value string, ttl time.Duration) (bool, error) {
+	key := c.rdbUserKey(username)
+	value = strconv.FormatInt(version, 10) + ":" + value
+	n, err := rdbCompareAndSet.Run(ctx, c.rdb, []string{key}, version, value, ttl.Milliseconds()).Int()
+	if err != nil {
+		return false, err
+	}
+	if n == 0 {
+		cacheStaleWrites.Inc()
+	}
+	return n == 1, nil
+}
+
+// set saves the user to Redis, unless Redis holds a newer version of it, and
+// to the local tier. The user is dirty when Redis could not be written.
+func (c *cache) set(ctx context.Context, usr User, version int64) error {
+	if c.rdb == nil {
+		c.setLocal(usr)
+		return nil
+	}
+	data, err := c.envelope.encode(usr)
+	if err != nil {
+		c.logger.Error("redis marshal error", zap.Error(err))
+		return err
+	}
+	var ok bool
+	err = c.do(func() (err error) {
+		ok, err = c.compareAndSet(ctx, usr.Username, version, data, cacheTTL())
+		return err
+	})
+	if err != nil {
+		c.markDirty(usr.Username)
+		return ErrCacheUnavailable
+	}
+	if ok {
+		c.setLocal(usr)
+	}
+	return nil
+}
+
+// setNotFound caches that the user does not exist, with the version of its
+// deletion or notFoundVersion when it was found missing by a read. The latter
+// does not replace a user cached meanwhile, e.g. by an upsert which committed
+// after the user was found missing. The user is dirty when Redis could not be written.
+func (c *cache) setNotFound(ctx context.Context, username string, version int64) error {
+	if c.rdb == nil {
+		if c.local != nil && (version > notFoundVersion || !c.local.Contains(username)) {
+			c.local.Add(username, User{})
+		}
+		return nil
+	}
+	var ok bool
+	err := c.do(func() (err error) {
+		ok, err = c.compareAndSet(ctx, username, version, rdbNotFoundValue, c.notFoundTTL)
+		return err
+	})
+	if err != nil {
+		if c.local != nil {
+			c.local.Remove(username)
+		}
+		c.markDirty(username)
+		return ErrCacheUnavailable
+	}
+	if ok && c.local != nil {
+		c.local.Add(username, User{})
+	}
+	return nil
+}
+
+// del removes the user from Redis and from the local tier. The user is
+// dirty when Redis could not be written.
+func (c *cache) del(ctx context.Context, username string) error {
+	if c.local != nil {
+		c.local.Remove(username)
+	}
+	if c.rdb == nil {
+		return nil
+	}
+	err := c.do(func() error {
+		return c.rdb.Del(ctx, c.rdbUserKey(username)).Err()
+	})
+	if err != nil {
+		c.markDirty(username)
+		return ErrCacheUnavailable
+	}
+	return nil
+}
+
+// invalidate evicts the user from the local tier of every replica.
+// It must be called after the new value has been written to Redis.
+func (c *cache) invalidate(ctx context.Context, username string) error {
+	if c.local != nil {
+		c.local.Remove(username)
+	}
+	if c.rdb == nil {
+		return nil
+	}
+	err := c.do(func() error {
+		return c.rdb.Publish(ctx, rdbInvalidationChannel, username).Err()
+	})
+	if err != nil {
+		// the repair publishes the invalidation again
+		c.markDirty(username)
+		return ErrCacheUnavailable
+	}
+	return nil
+}
+
+// subscribeInvalidations evicts usernames published on rdbInvalidationChannel
+// from the local tier until ctx is done.
+func (c *cache) subscribeInvalidations(ctx context.Context) {
+	sub := c.rdb.Subscribe(ctx, rdbInvalidationChannel)
+	defer sub.Close()
+
+	ch := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			c.local.Remove(msg.Payload)
+		}
+	}
+}
+
+// inspect returns the value cached in Redis for the user, or ErrNotCached.
+func (c *cache) inspect(ctx context.Context, username string) (CacheEntry, error) {
+	if c.rdb == nil {
+		return CacheEntry{}, ErrNotCached
+	}
+	key := c.rdbUserKey(username)
+
+	var getCmd *redis.StringCmd
+	var ttlCmd *redis.DurationCmd
+	err := c.do(func() error {
+		pipe := c.rdb.Pipeline()
+		getCmd = pipe.Get(ctx, key)
+		ttlCmd = pipe.PTTL(ctx, key)
+		_, err := pipe.Exec(ctx)
+		return err
+	})
+	if errors.Is(err, redis.Nil) {
+		return CacheEntry{}, ErrNotCached
+	}
+	if err != nil {
+		return CacheEntry{}, ErrCacheUnavailable
+	}
+	version, value := splitVersion(getCmd.Val())
+	format, value := describeEnvelope(value)
+	return CacheEntry{Key: key, TTL: ttlCmd.Val(), Version: version, Format: format, Value: value}, nil
+}
+
+// CacheEntry describes the value cached in Redis for a user
+type CacheEntry struct {
+	Key     string        `json:"key"`
+	TTL     time.Duration `json:"ttl"`
+	Version int64         `json:"version"`
+	// Format is empty for users cached as not found
+	Format string `json:"format,omitempty"`
+	// Value is base64 encoded when the format is binary
+	Value string `json:"value"`
+}
+
+// CacheAdmin inspects and evicts cached users for operational tooling.
+type CacheAdmin interface {
+	Inspect(ctx context.Context, username string) (CacheEntry, error)
+	// Evict removes the user from Redis and from the local cache of every replica.
+	Evict(ctx context.Context, username string) error
+}
+
+type cacheAdmin struct {
+	cache *cache
+}
+
+func NewCacheAdmin(rdb redis.UniversalClient, logger *zap.Logger) CacheAdmin {
+	return &cacheAdmin{newCache(context.Background(), rdb, StoreConfig{}, logger.Named(loggerName))}
+}
+
+func (a *cacheAdmin) Inspect(ctx context.Context, username string) (CacheEntry, error) {
+	return a.cache.inspect(ctx, username)
+}
+
+func (a *cacheAdmin) Evict(ctx context.Context, username string) error {
+	if err := a.cache.del(ctx, username); err != nil {
+		return err
+	}
+	return a.cache.invalidate(ctx, username)
+}
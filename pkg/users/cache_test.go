@@ -0,0 +1,474 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/awhdesmond/user-service/pkg/common"
+	"github.com/google/go-cmp/cmp"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/suite"
+	"go.uber.org/zap"
+)
+
+type cacheTestSuite struct {
+	suite.Suite
+
+	rdb redis.UniversalClient
+}
+
+func (ts *cacheTestSuite) SetupSuite() {
+	rdb, err := common.MakeRedisClient(common.TestRedisCfg)
+	if err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+	ts.rdb = rdb
+}
+
+func (ts *cacheTestSuite) TearDownSuite() {
+	ts.rdb.FlushDB(context.TODO())
+}
+
+func TestCacheTestSuite(t *testing.T) {
+	suite.Run(t, new(cacheTestSuite))
+}
+
+func (ts *cacheTestSuite) TestInvalidationSubscriptionStops() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cfg := StoreConfig{LocalCacheSize: 10, LocalCacheTTL: time.Minute}
+	c := newCache(ctx, ts.rdb, cfg, zap.NewNop())
+	// wait for the invalidation subscription to be established
+	time.Sleep(100 * time.Millisecond)
+
+	usr := User{Username: "lime", DoB: time.Date(2000, 1, 2, 0, 0, 0, 0, time.UTC)}
+	c.setLocal(usr)
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+
+	// another replica invalidates the user
+	other := newCache(context.Background(), ts.rdb, StoreConfig{}, zap.NewNop())
+	if err := other.invalidate(context.Background(), usr.Username); err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// the cache no longer listens once its context is done
+	if _, ok := c.local.Get(usr.Username); !ok {
+		ts.T().Fatalf("got = %v, want = %v", ok, true)
+	}
+}
+
+func (ts *cacheTestSuite) TestCrossReplicaInvalidation() {
+	logger, _ := common.InitZap("debug")
+	cfg := StoreConfig{LocalCacheSize: 10, LocalCacheTTL: time.Minute}
+
+	// two replicas sharing the same redis
+	replicaA := newCache(context.Background(), ts.rdb, cfg, logger)
+	replicaB := newCache(context.Background(), ts.rdb, cfg, logger)
+	// wait for the invalidation subscriptions to be established
+	time.Sleep(100 * time.Millisecond)
+
+	ctx := context.Background()
+	old := User{Username: "kiwi", DoB: time.Date(2000, 1, 2, 0, 0, 0, 0, time.UTC)}
+	if err := replicaA.set(ctx, old, 1); err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+
+	// populate replica B's local tier from redis
+	if _, _, err := replicaB.get(ctx, old.Username); err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+	if _, ok := replicaB.local.Get(old.Username); !ok {
+		ts.T().Fatalf("got = %v, want = %v", ok, true)
+	}
+
+	updated := User{Username: "kiwi", DoB: time.Date(2001, 2, 3, 0, 0, 0, 0, time.UTC)}
+	if err := replicaA.set(ctx, updated, 2); err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+	if err := replicaA.invalidate(ctx, updated.Username); err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	usr, _, err := replicaB.get(ctx, updated.Username)
+	if err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+	if !cmp.Equal(usr, updated) {
+		ts.T().Fatalf("got = %v, want = %v", usr, updated)
+	}
+}
+
+func (ts *cacheTestSuite) TestEncryption() {
+	logger, _ := common.InitZap("debug")
+	c := newCache(context.Background(), ts.rdb, StoreConfig{Keyring: testKeyring(ts.T())}, logger)
+
+	ctx := context.Background()
+	usr := User{Username: "fig", DoB: time.Date(2000, 1, 2, 0, 0, 0, 0, time.UTC)}
+	if err := c.set(ctx, usr, 1); err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+
+	_, value := splitVersion(ts.rdb.Get(ctx, c.rdbUserKey(usr.Username)).Val())
+	if format, _ := describeEnvelope(value); format != "json+enc" || strings.Contains(value, "2000") {
+		ts.T().Fatalf("got = %v, want = %v", value, "encrypted value")
+	}
+
+	got, _, err := c.get(ctx, usr.Username)
+	if err != nil || !cmp.Equal(got, usr) {
+		ts.T().Fatalf("got = %v, %v, want = %v", got, err, usr)
+	}
+
+	// without the keyring the value is a miss, so the user is read from the db
+	plain := newCache(context.Background(), ts.rdb, StoreConfig{}, logger)
+	if _, _, err := plain.get(ctx, usr.Username); err != errCacheMiss {
+		ts.T().Fatalf("got = %v, want = %v", err, errCacheMiss)
+	}
+}
+
+func (ts *cacheTestSuite) TestNotFound() {
+	logger, _ := common.InitZap("debug")
+	c := newCache(context.Background(), ts.rdb, StoreConfig{LocalCacheSize: 10, NotFoundCacheTTL: time.Minute}, logger)
+	ctx := context.Background()
+
+	if err := c.setNotFound(ctx, "quince", notFoundVersion); err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+	c.local.Purge()
+	if _, _, err := c.get(ctx, "quince"); err != ErrUserNotFound {
+		ts.T().Fatalf("got = %v, want = %v", err, ErrUserNotFound)
+	}
+	// from the local tier
+	if _, _, err := c.get(ctx, "quince"); err != ErrUserNotFound {
+		ts.T().Fatalf("got = %v, want = %v", err, ErrUserNotFound)
+	}
+	if ttl := ts.rdb.PTTL(ctx, c.rdbUserKey("quince")).Val(); ttl <= 0 || ttl > time.Minute {
+		ts.T().Fatalf("got = %v, want = %v", ttl, "the not found TTL")
+	}
+
+	// an upsert replaces it
+	usr := User{Username: "quince", DoB: time.Date(2000, 1, 2, 0, 0, 0, 0, time.UTC)}
+	if err := c.set(ctx, usr, 1); err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+	if got, _, err := c.get(ctx, "quince"); err != nil || !cmp.Equal(got, usr) {
+		ts.T().Fatalf("got = %v, %v, want = %v", got, err, usr)
+	}
+
+	// but a user found missing before the upsert does not replace it
+	if err := c.setNotFound(ctx, "quince", notFoundVersion); err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+	c.local.Purge()
+	if got, _, err := c.get(ctx, "quince"); err != nil || !cmp.Equal(got, usr) {
+		ts.T().Fatalf("got = %v, %v, want = %v", got, err, usr)
+	}
+}
+
+// testUnavailableRedis returns a client of a Redis which refuses connections
+func testUnavailableRedis() redis.UniversalClient {
+	return redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1, DialTimeout: 100 * time.Millisecond})
+}
+
+func TestCacheUnavailable(t *testing.T) {
+	c := newCache(context.Background(), testUnavailableRedis(), StoreConfig{}, zap.NewNop())
+	ctx := context.Background()
+
+	usr := User{Username: "lime", DoB: time.Date(2000, 1, 2, 0, 0, 0, 0, time.UTC)}
+	if err := c.set(ctx, usr, 1); err != ErrCacheUnavailable {
+		t.Fatalf("got = %v, want = %v", err, ErrCacheUnavailable)
+	}
+	if !c.dirty[usr.Username] {
+		t.Fatalf("got = %v, want = %v", c.dirty, usr.Username+" dirty")
+	}
+	// a deletion which did not reach redis leaves the user dirty too
+	if err := c.setNotFound(ctx, "lychee", 2); err != ErrCacheUnavailable {
+		t.Fatalf("got = %v, want = %v", err, ErrCacheUnavailable)
+	}
+	if !c.dirty["lychee"] {
+		t.Fatalf("got = %v, want = %v", c.dirty, "lychee dirty")
+	}
+	// lookups miss, so that reads fall back to the db
+	for i := uint32(0); i < cacheBreakerFailures; i++ {
+		if _, _, err := c.get(ctx, usr.Username); err != errCacheMiss {
+			t.Fatalf("got = %v, want = %v", err, errCacheMiss)
+		}
+	}
+	if err := c.health(); err != ErrCacheUnavailable {
+		t.Fatalf("got = %v, want = %v", err, ErrCacheUnavailable)
+	}
+	// redis is no longer called once the breaker is open
+	if err := c.do(func() error { t.Fatalf("got = %v, want = %v", "a call", "no call"); return nil }); err != ErrCacheUnavailable {
+		t.Fatalf("got = %v, want = %v", err, ErrCacheUnavailable)
+	}
+}
+
+func (ts *cacheTestSuite) TestNotFoundVersion() {
+	c := newCache(context.Background(), ts.rdb, StoreConfig{}, zap.NewNop())
+	ctx := context.Background()
+	// rows written before versions were added have version 0
+	usr := User{Username: "grape", DoB: time.Date(2000, 1, 2, 0, 0, 0, 0, time.UTC)}
+
+	if err := c.setNotFound(ctx, usr.Username, notFoundVersion); err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+	if err := c.set(ctx, usr, 0); err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+	if got, _, err := c.get(ctx, usr.Username); err != nil || !cmp.Equal(got, usr) {
+		ts.T().Fatalf("got = %v, %v, want = %v", got, err, usr)
+	}
+
+	// a stale read which found the user missing does not replace it
+	if err := c.setNotFound(ctx, usr.Username, notFoundVersion); err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+	if got, _, err := c.get(ctx, usr.Username); err != nil || !cmp.Equal(got, usr) {
+		ts.T().Fatalf("got = %v, %v, want = %v", got, err, usr)
+	}
+}
+
+func (ts *cacheTestSuite) TestVersions() {
+	c := newCache(context.Background(), ts.rdb, StoreConfig{}, zap.NewNop())
+	ctx := context.Background()
+	old := User{Username: "orange", DoB: time.Date(2000, 1, 2, 0, 0, 0, 0, time.UTC)}
+	updated := User{Username: "orange", DoB: time.Date(2001, 2, 3, 0, 0, 0, 0, time.UTC)}
+
+	// a value without version, as written before versions
+	if err := ts.rdb.Set(ctx, c.rdbUserKey(old.Username), `{"username":"orange"}`, time.Minute).Err(); err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+	cases := []struct {
+		name    string
+		write   func() error
+		want    User
+		wantErr error
+	}{
+		{"replaces a value without version", func() error { return c.set(ctx, updated, 2) }, updated, nil},
+		{"older version", func() error { return c.set(ctx, old, 1) }, updated, nil},
+		{"same version", func() error { return c.set(ctx, updated, 2) }, updated, nil},
+		{"not found by a read", func() error { return c.setNotFound(ctx, "orange", notFoundVersion) }, updated, nil},
+		{"deleted", func() error { return c.setNotFound(ctx, "orange", 3) }, User{}, ErrUserNotFound},
+		{"older version after deletion", func() error { return c.set(ctx, updated, 2) }, User{}, ErrUserNotFound},
+		{"created again", func() error { return c.set(ctx, old, 4) }, old, nil},
+	}
+	for _, tc := range cases {
+		ts.Run(tc.name, func() {
+			if err := tc.write(); err != nil {
+				ts.T().Fatalf("got = %v, want = %v", err, nil)
+			}
+			got, _, err := c.get(ctx, "orange")
+			if err != tc.wantErr || !cmp.Equal(got, tc.want) {
+				ts.T().Fatalf("got = %v, %v, want = %v, %v", got, err, tc.want, tc.wantErr)
+			}
+		})
+	}
+}
+
+// failScriptsHook fails the scripts sent to Redis, such as the compare-and-set
+// of the cache, and lets the other commands through
+type failScriptsHook struct{}
+
+func (failScriptsHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (failScriptsHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if name := cmd.Name(); name == "eval" || name == "evalsha" {
+			cmd.SetErr(errors.New("script failed"))
+			return cmd.Err()
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (failScriptsHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func (ts *cacheTestSuite) TestStoreDeleteInvalidatesReplicas() {
+	ctx := context.Background()
+	sess, err := common.TestMakeSQLiteDBSession(ts.T().TempDir())
+	if err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+	rdb, err := common.MakeRedisClient(common.TestRedisCfg)
+	if err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+	defer rdb.Close()
+	rdb.AddHook(failScriptsHook{})
+	store := newStore(sess, sqliteDialect{}, rdb, NewMemoryEventBroker(), StoreConfig{}, zap.NewNop())
+	defer store.Close(ctx)
+
+	// another replica holds the user in its local tier
+	replica := newCache(ctx, ts.rdb, StoreConfig{LocalCacheSize: 10, LocalCacheTTL: time.Minute}, zap.NewNop())
+	// wait for the invalidation subscription to be established
+	time.Sleep(100 * time.Millisecond)
+	usr := User{Username: "guava", DoB: time.Date(2000, 1, 2, 0, 0, 0, 0, time.UTC)}
+	if err := store.Upsert(ctx, usr.Username, usr.DoB); err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+	time.Sleep(100 * time.Millisecond)
+	replica.setLocal(usr)
+
+	// the tombstone cannot be written, but the other replicas are invalidated
+	if err := store.Delete(ctx, usr.Username); err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := replica.local.Get(usr.Username); ok {
+		ts.T().Fatalf("got = %v, want = %v", "guava cached locally", "guava evicted")
+	}
+}
+
+// TestStoreBackfillRace reproduces a read which misses the cache, reads the
+// user from the db and writes it to the cache after a concurrent upsert did.
+func (ts *cacheTestSuite) TestStoreBackfillRace() {
+	ctx := context.Background()
+	sess, err := common.TestMakeSQLiteDBSession(ts.T().TempDir())
+	if err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+	store := newStore(sess, sqliteDialect{}, ts.rdb, NewMemoryEventBroker(), StoreConfig{}, zap.NewNop())
+	dob := func(i int) time.Time { return time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC).AddDate(0, 0, i) }
+
+	if err := store.Upsert(ctx, "papaya", dob(0)); err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+	usr, version, err := store.readDB(ctx, "papaya")
+	if err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+	if err := store.Upsert(ctx, "papaya", dob(1)); err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+	if err := store.cache.set(ctx, usr, version); err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+	if got, err := store.Read(ctx, "papaya"); err != nil || !got.DoB.Equal(dob(1)) {
+		ts.T().Fatalf("got = %v, %v, want = %v", got, err, dob(1))
+	}
+
+	// the same with a deletion, and with many upserts and backfills at once
+	usr, version, _ = store.readDB(ctx, "papaya")
+	if err := store.Delete(ctx, "papaya"); err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+	store.cache.set(ctx, usr, version)
+	if _, err := store.Read(ctx, "papaya"); err != ErrUserNotFound {
+		ts.T().Fatalf("got = %v, want = %v", err, ErrUserNotFound)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			if err := store.Upsert(ctx, "papaya", dob(i)); err != nil {
+				ts.T().Errorf("got = %v, want = %v", err, nil)
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			usr, version, err := store.readDB(ctx, "papaya")
+			if err != nil {
+				return
+			}
+			time.Sleep(time.Duration(rand.Intn(10)) * time.Millisecond)
+			store.cache.set(ctx, usr, version)
+		}()
+	}
+	wg.Wait()
+	want, _, err := store.readDB(ctx, "papaya")
+	if err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+	if got, _, err := store.cache.get(ctx, "papaya"); err != nil || !cmp.Equal(got, want) {
+		ts.T().Fatalf("got = %v, %v, want = %v", got, err, want)
+	}
+}
+
+func (ts *cacheTestSuite) TestRepair() {
+	c := newCache(context.Background(), ts.rdb, StoreConfig{}, zap.NewNop())
+	ctx := context.Background()
+
+	// an update which did not reach redis left the user stale there
+	stale := User{Username: "mango", DoB: time.Date(2000, 1, 2, 0, 0, 0, 0, time.UTC)}
+	if err := c.set(ctx, stale, 1); err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+	c.markDirty(stale.Username)
+
+	// the next call which succeeds evicts it
+	if err := c.health(); err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+	if _, _, err := c.get(ctx, "nectarine"); err != errCacheMiss {
+		ts.T().Fatalf("got = %v, want = %v", err, errCacheMiss)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, _, err := c.get(ctx, stale.Username); err != errCacheMiss {
+		ts.T().Fatalf("got = %v, want = %v", err, errCacheMiss)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.dirty) != 0 {
+		ts.T().Fatalf("got = %v, want = %v", c.dirty, "no dirty user")
+	}
+}
+
+func (ts *cacheTestSuite) TestUsernameFilterResync() {
+	ctx := context.Background()
+	sess, err := common.TestMakeSQLiteDBSession(ts.T().TempDir())
+	if err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+	store := newStore(sess, sqliteDialect{}, ts.rdb, NewMemoryEventBroker(), StoreConfig{BloomFilterInterval: time.Hour}, zap.NewNop())
+	defer store.Close(ctx)
+
+	// the filter is in sync once subscribed to the usernames of other replicas
+	synced := func() bool {
+		store.usernames.mu.RLock()
+		defer store.usernames.mu.RUnlock()
+		return store.usernames.synced
+	}
+	for deadline := time.Now().Add(5 * time.Second); !synced(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			ts.T().Fatalf("got = %v, want = %v", "filter out of sync", "filter in sync")
+		}
+	}
+	if store.usernames.mayContain("quince") {
+		ts.T().Fatalf("got = %v, want = %v", true, false)
+	}
+
+	// another replica upserted quince while this one was disconnected from redis,
+	// and the subscription is established again
+	row, err := encodeRow(nil, User{Username: "quince", DoB: time.Date(2000, 1, 2, 0, 0, 0, 0, time.UTC)})
+	if err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+	if _, _, err := store.dialect.upsert(ctx, sess, row); err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+	store.usernames.resync()
+	// quince is read from the db while the filter is rebuilt, and afterwards
+	for deadline := time.Now().Add(5 * time.Second); !synced(); time.Sleep(10 * time.Millisecond) {
+		if _, err := store.Read(ctx, "quince"); err != nil {
+			ts.T().Fatalf("got = %v, want = %v", err, nil)
+		}
+		if time.Now().After(deadline) {
+			ts.T().Fatalf("got = %v, want = %v", "filter out of sync", "filter in sync")
+		}
+	}
+	if !store.usernames.mayContain("quince") {
+		ts.T().Fatalf("got = %v, want = %v", false, true)
+	}
+}
@@ -0,0 +1,236 @@
+package users
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/awhdesmond/user-service/pkg/common"
+	commonpb "github.com/awhdesmond/user-service/pkg/common/pb"
+	"github.com/awhdesmond/user-service/pkg/users/pb"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+// mapStore keeps users in a map, for transport tests which do not need Postgres
+type mapStore map[string]User
+
+func (s mapStore) Upsert(_ context.Context, username string, dob time.Time) error {
+	s[username] = User{Username: username, DoB: dob}
+	return nil
+}
+
+func (s mapStore) Read(_ context.Context, username string) (User, error) {
+	u, ok := s[username]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	return u, nil
+}
+
+func (s mapStore) List(context.Context) ([]User, error) {
+	return nil, nil
+}
+
+func (s mapStore) ListByBirthday(context.Context, time.Time, time.Time) ([]User, error) {
+	return nil, nil
+}
+
+func (s mapStore) Delete(_ context.Context, username string) error {
+	delete(s, username)
+	return nil
+}
+
+func (s mapStore) Export(_ context.Context, username string) (UserExport, error) {
+	u, ok := s[username]
+	if !ok {
+		return UserExport{}, ErrUserNotFound
+	}
+	return UserExport{Username: username, User: &u, Events: []Event{}}, nil
+}
+
+func (s mapStore) Erase(_ context.Context, username string) (ErasureReceipt, error) {
+	_, ok := s[username]
+	delete(s, username)
+	subjectHash, err := SubjectHash(nil, username)
+	if err != nil {
+		return ErasureReceipt{}, err
+	}
+	receipt := ErasureReceipt{SubjectHash: subjectHash}
+	if ok {
+		receipt.RowsDeleted = 1
+	}
+	receipt.Hash = receipt.computeHash()
+	return receipt, nil
+}
+
+func (s mapStore) Close(context.Context) error {
+	return nil
+}
+
+func TestReadEncodings(t *testing.T) {
+	store := mapStore{}
+	handler := MakeHandler(NewService(store, testTimeFn))
+	store.Upsert(context.Background(), "apple", time.Date(2000, 6, 1, 0, 0, 0, 0, time.UTC))
+
+	wantMsg := "Hello, apple! Happy birthday!"
+	cases := []struct {
+		name            string
+		accept          string
+		wantContentType string
+		decode          func([]byte) (string, error)
+	}{
+		{
+			name:            "json by default",
+			wantContentType: "application/json; charset=utf-8",
+			decode: func(b []byte) (string, error) {
+				var resp ReadResponse
+				err := json.Unmarshal(b, &resp)
+				return resp.Message, err
+			},
+		},
+		{
+			name:            "protobuf",
+			accept:          common.MediaTypeProtobuf,
+			wantContentType: common.MediaTypeProtobuf,
+			decode: func(b []byte) (string, error) {
+				var resp pb.ReadResponse
+				err := proto.Unmarshal(b, &resp)
+				return resp.Message, err
+			},
+		},
+		{
+			name:            "msgpack",
+			accept:          "application/json;q=0.5, " + common.MediaTypeMsgpack,
+			wantContentType: common.MediaTypeMsgpack,
+			decode: func(b []byte) (string, error) {
+				var resp map[string]string
+				err := msgpack.Unmarshal(b, &resp)
+				return resp["message"], err
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/v1/hello/apple", nil)
+			req.Header.Set("Accept", tc.accept)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("got = %v, want = %v", w.Code, http.StatusOK)
+			}
+			if got := w.Header().Get("Content-Type"); got != tc.wantContentType {
+				t.Fatalf("got = %v, want = %v", got, tc.wantContentType)
+			}
+			got, err := tc.decode(w.Body.Bytes())
+			if err != nil {
+				t.Fatalf("got = %v, want = %v", err, nil)
+			}
+			if got != wantMsg {
+				t.Fatalf("got = %v, want = %v", got, wantMsg)
+			}
+		})
+	}
+}
+
+func TestErrorEncodings(t *testing.T) {
+	handler := MakeHandler(NewService(mapStore{}, testTimeFn))
+
+	cases := []struct {
+		name            string
+		accept          string
+		wantContentType string
+		decode          func([]byte) (string, error)
+	}{
+		{
+			name:            "protobuf",
+			accept:          common.MediaTypeProtobuf,
+			wantContentType: common.MediaTypeProtobuf,
+			decode: func(b []byte) (string, error) {
+				var resp commonpb.Error
+				err := proto.Unmarshal(b, &resp)
+				return resp.Error, err
+			},
+		},
+		{
+			name:            "msgpack",
+			accept:          common.MediaTypeMsgpack,
+			wantContentType: common.MediaTypeMsgpack,
+			decode: func(b []byte) (string, error) {
+				var resp map[string]string
+				err := msgpack.Unmarshal(b, &resp)
+				return resp["error"], err
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/v1/hello/apple", nil)
+			req.Header.Set("Accept", tc.accept)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != http.StatusNotFound {
+				t.Fatalf("got = %v, want = %v", w.Code, http.StatusNotFound)
+			}
+			if got := w.Header().Get("Content-Type"); got != tc.wantContentType {
+				t.Fatalf("got = %v, want = %v", got, tc.wantContentType)
+			}
+			got, err := tc.decode(w.Body.Bytes())
+			if err != nil {
+				t.Fatalf("got = %v, want = %v", err, nil)
+			}
+			if got != ErrUserNotFound.Error() {
+				t.Fatalf("got = %v, want = %v", got, ErrUserNotFound.Error())
+			}
+		})
+	}
+}
+
+func TestUpsertEncodings(t *testing.T) {
+	pbBody, _ := proto.Marshal(&pb.UpsertRequest{DateOfBirth: "2000-06-01"})
+	msgpackBody, _ := msgpack.Marshal(map[string]string{"dateOfBirth": "2000-06-01"})
+
+	cases := []struct {
+		name        string
+		contentType string
+		body        []byte
+		wantCode    int
+	}{
+		{"json", "application/json", []byte(`{"dateOfBirth": "2000-06-01"}`), http.StatusNoContent},
+		{"no content type", "", []byte(`{"dateOfBirth": "2000-06-01"}`), http.StatusNoContent},
+		{"protobuf", common.MediaTypeProtobuf, pbBody, http.StatusNoContent},
+		{"msgpack", common.MediaTypeMsgpack, msgpackBody, http.StatusNoContent},
+		{"invalid protobuf", common.MediaTypeProtobuf, []byte{0xff}, http.StatusBadRequest},
+		{"invalid msgpack", common.MediaTypeMsgpack, []byte{0xc1}, http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := mapStore{}
+			handler := MakeHandler(NewService(store, testTimeFn))
+
+			req := httptest.NewRequest(http.MethodPut, "/v1/hello/apple", bytes.NewReader(tc.body))
+			if tc.contentType != "" {
+				req.Header.Set("Content-Type", tc.contentType)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tc.wantCode {
+				t.Fatalf("got = %v, want = %v", w.Code, tc.wantCode)
+			}
+			if tc.wantCode != http.StatusNoContent {
+				return
+			}
+			wantDoB := time.Date(2000, 6, 1, 0, 0, 0, 0, time.UTC)
+			if got := store["apple"].DoB; !got.Equal(wantDoB) {
+				t.Fatalf("got = %v, want = %v", got, wantDoB)
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/awhdesmond/user-service/pkg/common"
+	"github.com/upper/db/v4"
+	"go.uber.org/zap"
+)
+
+const (
+	dateLayout = "2006-01-02"
+
+	DefaultReencryptBatchSize = 100
+)
+
+// userRow is a row of the users table. The date of birth is either in
+// plaintext in DoB, or encrypted in DoBEnc when the store has a keyring.
+type userRow struct {
+	Username      string     `db:"username"`
+	DoB           *time.Time `db:"date_of_birth"`
+	DoBEnc        *string    `db:"date_of_birth_enc"`
+	DoBKeyID      *string    `db:"dob_key_id"`
+	BirthdayIndex *string    `db:"birthday_index"`
+	// Version increases on every write, see dialect.nextVersion
+	Version int64 `db:"version"`
+}
+
+// encodeRow encrypts the date of birth of usr when keyring is not nil.
+// The username is authenticated along with the date, so that an encrypted
+// date copied to another row fails to decrypt.
+func encodeRow(keyring *common.Keyring, usr User) (userRow, error) {
+	row := userRow{Username: usr.Username}
+	if keyring == nil {
+		dob := usr.DoB
+		row.DoB = &dob
+		return row, nil
+	}
+
+	token, err := keyring.Encrypt([]byte(usr.DoB.Format(dateLayout)), []byte(usr.Username))
+	if err != nil {
+		return userRow{}, err
+	}
+	keyID := keyring.PrimaryKeyID()
+	index := keyring.BlindIndex(usr.DoB.Format(monthDayLayout))
+	row.DoBEnc, row.DoBKeyID, row.BirthdayIndex = &token, &keyID, &index
+	return row, nil
+}
+
+// decodeRow decrypts the date of birth of row if it is encrypted
+func decodeRow(keyring *common.Keyring, row userRow) (User, error) {
+	if row.DoBEnc == nil {
+		if row.DoB == nil {
+			return User{}, common.ErrCiphertextInvalid
+		}
+		return User{Username: row.Username, DoB: *row.DoB}, nil
+	}
+	if keyring == nil {
+		return User{}, common.ErrEncryptionDisabled
+	}
+
+	plaintext, err := keyring.Decrypt(*row.DoBEnc, []byte(row.Username))
+	if err != nil {
+		return User{}, err
+	}
+	dob, err := time.Parse(dateLayout, string(plaintext))
+	if err != nil {
+		return User{}, common.ErrCiphertextInvalid
+	}
+	return User{Username: row.Username, DoB: dob}, nil
+}
+
+func (store *store) decodeRows(rows []userRow) ([]User, error) {
+	usrs := make([]User, 0, len(rows))
+	for _, row := range rows {
+		usr, err := decodeRow(store.keyring, row)
+		if err != nil {
+			store.logger.Error("decrypt error", zap.Error(err))
+			return nil, ErrUnexpectedDatabaseError
+		}
+		usrs = append(usrs, usr)
+	}
+	return usrs, nil
+}
+
+// monthDaysBetween returns the MM-DD strings between fromMD and toMD
+// inclusive, including Feb 29, wrapping around the end of the year when
+// toMD is before fromMD. It matches what comparing the strings selects.
+func monthDaysBetween(fromMD, toMD string) []string {
+	mds := []string{}
+	// 2000 is a leap year, so Feb 29 is included
+	for d := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC); d.Year() == 2000; d = d.AddDate(0, 0, 1) {
+		md := d.Format(monthDayLayout)
+		if fromMD <= toMD && md >= fromMD && md <= toMD ||
+			fromMD > toMD && (md >= fromMD || md <= toMD) {
+			mds = append(mds, md)
+		}
+	}
+	return mds
+}
+
+// birthdayIndexes returns the blind indexes of the month and days between fromMD and toMD
+func (store *store) birthdayIndexes(fromMD, toMD string) []string {
+	indexes := []string{}
+	for _, md := range monthDaysBetween(fromMD, toMD) {
+		indexes = append(indexes, store.keyring.BlindIndex(md))
+	}
+	return indexes
+}
+
+// ReencryptUsers encrypts the date of birth of the users which are in
+// plaintext or encrypted with a key other than the primary key of keyring.
+// Batches are locked with SKIP LOCKED, so it runs alongside the service.
+// It only supports Postgres.
+// It returns the number of users re-encrypted.
+//
+// Each re-encrypted user gets a new version, and is evicted through admin
+// when it is not nil, so that replicas do not keep serving the values
+// cached before. Users which could not be evicted are reported in the error,
+// and expire after DefaultCacheTTL.
+func ReencryptUsers(ctx context.Context, sess db.Session, keyring *common.Keyring, admin CacheAdmin, batchSize int) (int, error) {
+	if batchSize <= 0 {
+		batchSize = DefaultReencryptBatchSize
+	}
+
+	total := 0
+	var evictErrs []error
+	for {
+		var rows []userRow
+		err := sess.WithContext(ctx).Tx(func(tx db.Session) error {
+			rows = []userRow{}
+			err := tx.SQL().
+				SelectFrom(dbtable).
+				Where("dob_key_id IS DISTINCT FROM ?", keyring.PrimaryKeyID()).
+				OrderBy("username").
+				Limit(batchSize).
+				Amend(func(q string) string { return q + " FOR UPDATE SKIP LOCKED" }).
+				All(&rows)
+			if err != nil {
+				return err
+			}
+
+			for _, row := range rows {
+				usr, err := decodeRow(keyring, row)
+				if err != nil {
+					return err
+				}
+				enc, err := encodeRow(keyring, usr)
+				if err != nil {
+					return err
+				}
+				version, err := postgresDialect{}.nextVersion(tx)
+				if err != nil {
+					return err
+				}
+				_, err = tx.SQL().Update(dbtable).Set(
+					"date_of_birth", nil,
+					"date_of_birth_enc", enc.DoBEnc,
+					"dob_key_id", enc.DoBKeyID,
+					"birthday_index", enc.BirthdayIndex,
+					"version", version,
+				).Where("username = ?", row.Username).Exec()
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return total, errors.Join(append(evictErrs, err)...)
+		}
+		total += len(rows)
+		if admin != nil {
+			for _, row := range rows {
+				if err := admin.Evict(ctx, row.Username); err != nil {
+					evictErrs = append(evictErrs, fmt.Errorf("evict %s: %w", row.Username, err))
+				}
+			}
+		}
+		if len(rows) < batchSize {
+			return total, errors.Join(evictErrs...)
+		}
+	}
+}
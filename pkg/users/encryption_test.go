@@ -0,0 +1,74 @@
+package users
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/awhdesmond/user-service/pkg/common"
+	"github.com/google/go-cmp/cmp"
+)
+
+func testKeyring(t *testing.T) *common.Keyring {
+	keyring, err := common.NewKeyring(
+		"test",
+		map[string][]byte{"test": bytes.Repeat([]byte{1}, 32)},
+		bytes.Repeat([]byte{2}, 32),
+	)
+	if err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	return keyring
+}
+
+func TestEncodeRow(t *testing.T) {
+	keyring := testKeyring(t)
+	usr := User{Username: "apple", DoB: time.Date(2000, 2, 29, 0, 0, 0, 0, time.UTC)}
+
+	row, err := encodeRow(keyring, usr)
+	if err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	if row.DoB != nil || row.DoBEnc == nil || *row.DoBKeyID != "test" {
+		t.Fatalf("got = %v, want = %v", row, "encrypted row")
+	}
+	if *row.BirthdayIndex != keyring.BlindIndex("02-29") {
+		t.Fatalf("got = %v, want = %v", *row.BirthdayIndex, keyring.BlindIndex("02-29"))
+	}
+
+	got, err := decodeRow(keyring, row)
+	if err != nil || !cmp.Equal(got, usr) {
+		t.Fatalf("got = %v, %v, want = %v", got, err, usr)
+	}
+
+	// the ciphertext is bound to the username
+	row.Username = "pear"
+	if _, err := decodeRow(keyring, row); err != common.ErrCiphertextInvalid {
+		t.Fatalf("got = %v, want = %v", err, common.ErrCiphertextInvalid)
+	}
+
+	// rows written without a keyring stay readable
+	plain, _ := encodeRow(nil, usr)
+	if got, err := decodeRow(keyring, plain); err != nil || !cmp.Equal(got, usr) {
+		t.Fatalf("got = %v, %v, want = %v", got, err, usr)
+	}
+}
+
+func TestMonthDaysBetween(t *testing.T) {
+	cases := []struct {
+		name     string
+		from, to string
+		want     []string
+	}{
+		{name: "same day", from: "06-01", to: "06-01", want: []string{"06-01"}},
+		{name: "leap day", from: "02-28", to: "03-01", want: []string{"02-28", "02-29", "03-01"}},
+		{name: "end of year", from: "12-30", to: "01-02", want: []string{"01-01", "01-02", "12-30", "12-31"}},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := monthDaysBetween(tt.from, tt.to); !cmp.Equal(got, tt.want) {
+				t.Fatalf("got = %v, want = %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -61,3 +61,162 @@ func NewReadEndpoint(svc Service) endpoint.Endpoint {
 		}, nil
 	}
 }
+
+type DeleteRequest struct {
+	Username string `json:"username"`
+}
+
+type DeleteResponse struct {
+	BaseResponse `json:",inline"`
+}
+
+func NewDeleteEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, epReq interface{}) (interface{}, error) {
+		req, ok := epReq.(DeleteRequest)
+		if !ok {
+			return DeleteResponse{BaseResponse: BaseResponse{
+				Err: common.ErrEndpointReqMismatch,
+			}}, nil
+		}
+		err := svc.Delete(ctx, req.Username)
+		return DeleteResponse{BaseResponse: BaseResponse{Err: err}}, nil
+	}
+}
+
+type ListRequest struct{}
+
+type ListResponse struct {
+	BaseResponse `json:",inline"`
+	Users        []User `json:"users,omitempty"`
+}
+
+func NewListEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, epReq interface{}) (interface{}, error) {
+		if _, ok := epReq.(ListRequest); !ok {
+			return ListResponse{BaseResponse: BaseResponse{
+				Err: common.ErrEndpointReqMismatch,
+			}}, nil
+		}
+		usrs, err := svc.List(ctx)
+		return ListResponse{
+			BaseResponse: BaseResponse{Err: err},
+			Users:        usrs,
+		}, nil
+	}
+}
+
+type UpcomingRequest struct {
+	Days int `json:"days"`
+}
+
+type UpcomingResponse struct {
+	BaseResponse `json:",inline"`
+	Birthdays    []UpcomingBirthday `json:"birthdays,omitempty"`
+}
+
+func NewUpcomingEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, epReq interface{}) (interface{}, error) {
+		req, ok := epReq.(UpcomingRequest)
+		if !ok {
+			return UpcomingResponse{BaseResponse: BaseResponse{
+				Err: common.ErrEndpointReqMismatch,
+			}}, nil
+		}
+		birthdays, err := svc.Upcoming(ctx, req.Days)
+		return UpcomingResponse{
+			BaseResponse: BaseResponse{Err: err},
+			Birthdays:    birthdays,
+		}, nil
+	}
+}
+
+type CalendarRequest struct {
+	// Username is empty for the feed of all users
+	Username string `json:"username"`
+}
+
+type CalendarResponse struct {
+	BaseResponse `json:",inline"`
+	Calendar     string `json:"calendar,omitempty"`
+}
+
+func NewBirthdayCalendarEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, epReq interface{}) (interface{}, error) {
+		req, ok := epReq.(CalendarRequest)
+		if !ok {
+			return CalendarResponse{BaseResponse: BaseResponse{
+				Err: common.ErrEndpointReqMismatch,
+			}}, nil
+		}
+		cal, err := svc.BirthdayCalendar(ctx, req.Username)
+		return CalendarResponse{
+			BaseResponse: BaseResponse{Err: err},
+			Calendar:     cal,
+		}, nil
+	}
+}
+
+func NewBirthdaysCalendarEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, epReq interface{}) (interface{}, error) {
+		if _, ok := epReq.(CalendarRequest); !ok {
+			return CalendarResponse{BaseResponse: BaseResponse{
+				Err: common.ErrEndpointReqMismatch,
+			}}, nil
+		}
+		cal, err := svc.BirthdaysCalendar(ctx)
+		return CalendarResponse{
+			BaseResponse: BaseResponse{Err: err},
+			Calendar:     cal,
+		}, nil
+	}
+}
+
+type ExportRequest struct {
+	Username string `json:"username"`
+}
+
+type ExportResponse struct {
+	BaseResponse `json:",inline"`
+	Export       *UserExport `json:"export,omitempty"`
+}
+
+func NewExportEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, epReq interface{}) (interface{}, error) {
+		req, ok := epReq.(ExportRequest)
+		if !ok {
+			return ExportResponse{BaseResponse: BaseResponse{
+				Err: common.ErrEndpointReqMismatch,
+			}}, nil
+		}
+		export, err := svc.Export(ctx, req.Username)
+		if err != nil {
+			return ExportResponse{BaseResponse: BaseResponse{Err: err}}, nil
+		}
+		return ExportResponse{Export: &export}, nil
+	}
+}
+
+type EraseRequest struct {
+	Username string `json:"username"`
+}
+
+type EraseResponse struct {
+	BaseResponse `json:",inline"`
+	Receipt      *ErasureReceipt `json:"receipt,omitempty"`
+}
+
+func NewEraseEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, epReq interface{}) (interface{}, error) {
+		req, ok := epReq.(EraseRequest)
+		if !ok {
+			return EraseResponse{BaseResponse: BaseResponse{
+				Err: common.ErrEndpointReqMismatch,
+			}}, nil
+		}
+		receipt, err := svc.Erase(ctx, req.Username)
+		if err != nil {
+			return EraseResponse{BaseResponse: BaseResponse{Err: err}}, nil
+		}
+		return EraseResponse{Receipt: &receipt}, nil
+	}
+}
@@ -12,6 +12,12 @@ type User struct {
 	DoB      time.Time `json:"dateOfBirth" db:"date_of_birth"`
 }
 
+// UpcomingBirthday is a user whose birthday is in DaysToBirthday day(s)
+type UpcomingBirthday struct {
+	User           `json:",inline"`
+	DaysToBirthday int `json:"daysToBirthday"`
+}
+
 func (u User) CalcDaysToBirthday(nowFn func() time.Time) int {
 	// Use server's local time.
 	// NOTE: Might have some edge cases not handled as we are not storing date's timezone
@@ -0,0 +1,249 @@
+package users
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/awhdesmond/user-service/pkg/common"
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	CacheCodecJSON    = "json"
+	CacheCodecMsgpack = "msgpack"
+
+	CacheCompressionNone = "none"
+	CacheCompressionZstd = "zstd"
+
+	// cacheSchemaVersion is the version of User as cached in Redis. It must be
+	// increased whenever User changes, so that replicas which cache different
+	// versions of User during a rollout use different keys.
+	cacheSchemaVersion = 2
+
+	// envelopeEncrypted is the last step of the format of encrypted values
+	envelopeEncrypted = "enc"
+	// envelopeMaxDecodedSize bounds the memory taken to decompress a value
+	envelopeMaxDecodedSize = 1 << 20
+
+	decodeFailureSchema     = "schema"
+	decodeFailureFormat     = "format"
+	decodeFailureDecrypt    = "decrypt"
+	decodeFailureDecompress = "decompress"
+	decodeFailureUnmarshal  = "unmarshal"
+	decodeFailureUsername   = "username"
+)
+
+var (
+	ErrCacheCodecInvalid       = errors.New("cache codec must be json or msgpack")
+	ErrCacheCompressionInvalid = errors.New("cache compression must be none or zstd")
+	errEnvelopeInvalid         = errors.New("cache envelope is invalid")
+
+	cacheDecodeFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "cache",
+		Name:      "decode_failures_total",
+		Help:      "values of redis which could not be decoded, partitioned by reason",
+	}, []string{"reason"})
+
+	cacheCodecs = map[string]cacheCodec{
+		CacheCodecJSON:    jsonCodec{},
+		CacheCodecMsgpack: msgpackCodec{},
+	}
+
+	// zstdEncoder and zstdDecoder are safe for concurrent use, and made on first use
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+func init() {
+	prometheus.MustRegister(cacheDecodeFailures)
+}
+
+// cacheCodec marshals users for Redis. Unmarshal fails on unknown fields,
+// so that an entry of another version of User is not silently read.
+type cacheCodec interface {
+	marshal(usr User) ([]byte, error)
+	unmarshal(data []byte, usr *User) error
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) marshal(usr User) ([]byte, error) {
+	return json.Marshal(usr)
+}
+
+func (jsonCodec) unmarshal(data []byte, usr *User) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(usr)
+}
+
+// msgpackCodec names fields after their json tags, as common.EncodeMsgpack
+type msgpackCodec struct{}
+
+func (msgpackCodec) marshal(usr User) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	err := enc.Encode(usr)
+	return buf.Bytes(), err
+}
+
+func (msgpackCodec) unmarshal(data []byte, usr *User) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	dec.DisallowUnknownFields(true)
+	return dec.Decode(usr)
+}
+
+// zstdCoders returns the shared zstd encoder and decoder, or why they cannot be made
+func zstdCoders() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdDecoder, zstdErr = makeZstdCoders(envelopeMaxDecodedSize)
+	})
+	return zstdEncoder, zstdDecoder, zstdErr
+}
+
+func makeZstdCoders(maxDecodedSize uint64) (*zstd.Encoder, *zstd.Decoder, error) {
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("zstd encoder: %w", err)
+	}
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecodedSize))
+	if err != nil {
+		enc.Close()
+		return nil, nil, fmt.Errorf("zstd decoder: %w", err)
+	}
+	return enc, dec, nil
+}
+
+// envelope encodes users as v<schema version>:<format>:<payload>, where the
+// format is the codec followed by the steps applied to its output, e.g.
+// msgpack+zstd+enc. Values are decoded from their own format, so that
+// replicas configured with different codecs can read each other's values.
+type envelope struct {
+	codec    string
+	compress bool
+	// keyring encrypts the payload when it is not nil
+	keyring *common.Keyring
+}
+
+func newEnvelope(cfg StoreConfig) envelope {
+	codec := cfg.CacheCodec
+	if codec == "" {
+		codec = CacheCodecJSON
+	}
+	return envelope{
+		codec:    codec,
+		compress: cfg.CacheCompression == CacheCompressionZstd,
+		keyring:  cfg.Keyring,
+	}
+}
+
+func (e envelope) encode(usr User) (string, error) {
+	codec, ok := cacheCodecs[e.codec]
+	if !ok {
+		return "", ErrCacheCodecInvalid
+	}
+	data, err := codec.marshal(usr)
+	if err != nil {
+		return "", err
+	}
+	format := e.codec
+	if e.compress {
+		enc, _, err := zstdCoders()
+		if err != nil {
+			return "", err
+		}
+		data = enc.EncodeAll(data, nil)
+		format += "+" + CacheCompressionZstd
+	}
+	if e.keyring != nil {
+		// the username is authenticated along with the user, so that a
+		// value copied to the key of another user fails to decrypt
+		token, err := e.keyring.Encrypt(data, []byte(usr.Username))
+		if err != nil {
+			return "", err
+		}
+		data = []byte(token)
+		format += "+" + envelopeEncrypted
+	}
+	return fmt.Sprintf("v%d:%s:%s", cacheSchemaVersion, format, data), nil
+}
+
+// decode reverses encode, and counts why values cannot be decoded.
+// Encrypted values cannot be decoded without a keyring.
+func (e envelope) decode(username, value string) (User, error) {
+	parts := strings.SplitN(value, ":", 3)
+	if len(parts) != 3 {
+		return User{}, decodeFailure(decodeFailureFormat, errEnvelopeInvalid)
+	}
+	if parts[0] != fmt.Sprintf("v%d", cacheSchemaVersion) {
+		return User{}, decodeFailure(decodeFailureSchema, errEnvelopeInvalid)
+	}
+	steps := strings.Split(parts[1], "+")
+	codec, ok := cacheCodecs[steps[0]]
+	if !ok {
+		return User{}, decodeFailure(decodeFailureFormat, errEnvelopeInvalid)
+	}
+
+	data := []byte(parts[2])
+	for i := len(steps) - 1; i > 0; i-- {
+		var err error
+		switch steps[i] {
+		case envelopeEncrypted:
+			if e.keyring == nil {
+				return User{}, decodeFailure(decodeFailureDecrypt, common.ErrEncryptionDisabled)
+			}
+			if data, err = e.keyring.Decrypt(string(data), []byte(username)); err != nil {
+				return User{}, decodeFailure(decodeFailureDecrypt, err)
+			}
+		case CacheCompressionZstd:
+			_, dec, err := zstdCoders()
+			if err != nil {
+				return User{}, decodeFailure(decodeFailureDecompress, err)
+			}
+			if data, err = dec.DecodeAll(data, nil); err != nil {
+				return User{}, decodeFailure(decodeFailureDecompress, err)
+			}
+		default:
+			return User{}, decodeFailure(decodeFailureFormat, errEnvelopeInvalid)
+		}
+	}
+
+	var usr User
+	if err := codec.unmarshal(data, &usr); err != nil {
+		return User{}, decodeFailure(decodeFailureUnmarshal, err)
+	}
+	if usr.Username != username {
+		return User{}, decodeFailure(decodeFailureUsername, errEnvelopeInvalid)
+	}
+	return usr, nil
+}
+
+// describeEnvelope returns the format and the payload of an encoded user, for
+// operators. Binary payloads are base64 encoded. Other values are returned as is.
+func describeEnvelope(value string) (string, string) {
+	parts := strings.SplitN(value, ":", 3)
+	if len(parts) != 3 {
+		return "", value
+	}
+	format, payload := parts[1], parts[2]
+	if format != CacheCodecJSON && !strings.HasSuffix(format, "+"+envelopeEncrypted) {
+		payload = base64.StdEncoding.EncodeToString([]byte(payload))
+	}
+	return format, payload
+}
+
+func decodeFailure(reason string, err error) error {
+	cacheDecodeFailures.WithLabelValues(reason).Inc()
+	return err
+}
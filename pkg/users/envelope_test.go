@@ -0,0 +1,87 @@
+package users
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestEnvelope(t *testing.T) {
+	usr := User{Username: "apple", DoB: time.Date(2000, 1, 2, 0, 0, 0, 0, time.UTC)}
+	keyring := testKeyring(t)
+
+	for _, codec := range []string{CacheCodecJSON, CacheCodecMsgpack} {
+		for _, compression := range []string{CacheCompressionNone, CacheCompressionZstd} {
+			cfg := StoreConfig{CacheCodec: codec, CacheCompression: compression}
+			if err := cfg.Validate(); err != nil {
+				t.Fatalf("got = %v, want = %v", err, nil)
+			}
+			for _, e := range []envelope{newEnvelope(cfg), newEnvelope(StoreConfig{CacheCodec: codec, CacheCompression: compression, Keyring: keyring})} {
+				value, err := e.encode(usr)
+				if err != nil {
+					t.Fatalf("got = %v, want = %v", err, nil)
+				}
+				// replicas configured with another codec read it as well
+				got, err := newEnvelope(StoreConfig{Keyring: keyring}).decode(usr.Username, value)
+				if err != nil || !cmp.Equal(got, usr) {
+					t.Fatalf("got = %v, %v, want = %v", got, err, usr)
+				}
+			}
+		}
+	}
+
+	if err := (StoreConfig{CacheCodec: "gob"}).Validate(); err != ErrCacheCodecInvalid {
+		t.Fatalf("got = %v, want = %v", err, ErrCacheCodecInvalid)
+	}
+	if err := (StoreConfig{CacheCompression: "gzip"}).Validate(); err != ErrCacheCompressionInvalid {
+		t.Fatalf("got = %v, want = %v", err, ErrCacheCompressionInvalid)
+	}
+}
+
+func TestMakeZstdCoders(t *testing.T) {
+	if _, _, err := makeZstdCoders(envelopeMaxDecodedSize); err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	if _, _, err := makeZstdCoders(0); err == nil {
+		t.Fatalf("got = %v, want = %v", err, "an error")
+	}
+}
+
+func TestEnvelopeDecodeFailures(t *testing.T) {
+	e := newEnvelope(StoreConfig{})
+	encrypted, _ := newEnvelope(StoreConfig{Keyring: testKeyring(t)}).encode(User{Username: "apple"})
+
+	cases := []struct {
+		name   string
+		value  string
+		reason string
+	}{
+		{"not an envelope", `{"username":"apple"}`, decodeFailureFormat},
+		{"other schema version", `v1:json:{"username":"apple"}`, decodeFailureSchema},
+		{"unknown codec", `v2:gob:apple`, decodeFailureFormat},
+		{"unknown step", `v2:json+gzip:apple`, decodeFailureFormat},
+		{"without keyring", encrypted, decodeFailureDecrypt},
+		{"corrupt compression", `v2:json+zstd:apple`, decodeFailureDecompress},
+		{"unknown field", `v2:json:{"username":"apple","email":"apple@example.com"}`, decodeFailureUnmarshal},
+		{"other user", `v2:json:{"username":"banana"}`, decodeFailureUsername},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			before := testutil.ToFloat64(cacheDecodeFailures.WithLabelValues(tc.reason))
+			if _, err := e.decode("apple", tc.value); err == nil {
+				t.Fatalf("got = %v, want = %v", err, "an error")
+			}
+			if n := testutil.ToFloat64(cacheDecodeFailures.WithLabelValues(tc.reason)) - before; n != 1 {
+				t.Fatalf("got = %v, want = %v", n, 1)
+			}
+		})
+	}
+
+	format, payload := describeEnvelope(`v2:msgpack+zstd:` + "\x00\x01")
+	if format != "msgpack+zstd" || strings.ContainsRune(payload, 0) {
+		t.Fatalf("got = %v, %v, want = %v", format, payload, "a base64 payload")
+	}
+}
@@ -0,0 +1,394 @@
+package users
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+type EventType string
+
+const (
+	EventUserCreated EventType = "created"
+	EventUserUpdated EventType = "updated"
+	EventUserDeleted EventType = "deleted"
+
+	// rdbEventStream is the Redis stream that stores user events.
+	rdbEventStream = "user_service:events"
+	// rdbEventStreamMaxLen is the approximate number of events retained
+	// for subscribers resuming from an older event.
+	rdbEventStreamMaxLen = 10000
+	rdbEventField        = "event"
+
+	// eventReadBlock also bounds how long Close waits for the tail to stop
+	eventReadBlock = time.Second
+	eventRetryWait = time.Second
+	eventReadCount = 100
+	eventScanCount = 1000
+	// eventSubscriberBuffer is the number of pending events per subscriber.
+	// Subscribers that fall further behind are dropped and must resume.
+	eventSubscriberBuffer = 64
+
+	eventsLoggerName = "users.events"
+)
+
+var (
+	ErrEventIDInvalid = errors.New("invalid event id")
+)
+
+// Event describes a change to a user. It does not carry the date of birth,
+// which would be stored in plaintext in the stream even when the users are
+// encrypted at rest. Subscribers read the user to get it.
+type Event struct {
+	// ID is assigned by the EventBroker when the event is published
+	ID       string    `json:"-"`
+	Type     EventType `json:"type"`
+	Username string    `json:"username"`
+	Time     time.Time `json:"time"`
+}
+
+// EventBroker publishes user events and fans them out to subscribers.
+type EventBroker interface {
+	Publish(ctx context.Context, evt Event) error
+	// Subscribe streams the events published after lastEventID until ctx is done.
+	// When lastEventID is empty, only new events are streamed. The channel is
+	// closed when ctx is done or when the subscriber falls too far behind.
+	Subscribe(ctx context.Context, lastEventID string) (<-chan Event, error)
+	// History returns the retained events of the user, oldest first.
+	History(ctx context.Context, username string) ([]Event, error)
+	// Erase deletes the retained events of the user and returns how many were deleted.
+	Erase(ctx context.Context, username string) (int, error)
+	// Close stops the broker and ends the subscriptions, or gives up when ctx is done.
+	Close(ctx context.Context) error
+}
+
+// redisEventBroker stores events in a Redis stream so that every replica
+// sees every change, and so that subscribers can resume from an event ID.
+// A single reader per replica tails the stream and fans events out to the
+// local subscribers, so subscribers do not hold a Redis connection each.
+type redisEventBroker struct {
+	subscribers
+
+	rdb    redis.UniversalClient
+	logger *zap.Logger
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func NewRedisEventBroker(rdb redis.UniversalClient, logger *zap.Logger) EventBroker {
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &redisEventBroker{
+		subscribers: newSubscribers(),
+		rdb:         rdb,
+		logger:      logger.Named(eventsLoggerName),
+		cancel:      cancel,
+		done:        make(chan struct{}),
+	}
+	go b.tail(ctx)
+	return b
+}
+
+func (b *redisEventBroker) Close(ctx context.Context) error {
+	b.cancel()
+	select {
+	case <-b.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	b.closeAll()
+	return nil
+}
+
+func (b *redisEventBroker) Publish(ctx context.Context, evt Event) error {
+	data, err := json.Marshal(evt)
+	if err != nil {
+		return err
+	}
+	cmd := b.rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: rdbEventStream,
+		MaxLen: rdbEventStreamMaxLen,
+		Approx: true,
+		Values: map[string]interface{}{rdbEventField: data},
+	})
+	if cmd.Err() != nil {
+		b.logger.Error("event publish error", zap.Error(cmd.Err()))
+		return ErrUnexpectedDatabaseError
+	}
+	return nil
+}
+
+func (b *redisEventBroker) Subscribe(ctx context.Context, lastEventID string) (<-chan Event, error) {
+	if lastEventID != "" {
+		if _, _, err := parseEventID(lastEventID); err != nil {
+			return nil, err
+		}
+	}
+
+	// Register before replaying so that no event published in between is lost.
+	sub := b.subscribe()
+
+	var replay []Event
+	if lastEventID != "" {
+		msgs, err := b.rdb.XRange(ctx, rdbEventStream, lastEventID, "+").Result()
+		if err != nil {
+			b.unsubscribe(sub)
+			b.logger.Error("event replay error", zap.Error(err))
+			return nil, ErrUnexpectedDatabaseError
+		}
+		for _, msg := range msgs {
+			if evt, ok := b.decode(msg); ok && msg.ID != lastEventID {
+				replay = append(replay, evt)
+			}
+		}
+	}
+	return b.stream(ctx, sub, replay, lastEventID), nil
+}
+
+func (b *redisEventBroker) History(ctx context.Context, username string) ([]Event, error) {
+	history := []Event{}
+	err := b.scan(ctx, func(evt Event) {
+		if evt.Username == username {
+			history = append(history, evt)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+func (b *redisEventBroker) Erase(ctx context.Context, username string) (int, error) {
+	ids := []string{}
+	err := b.scan(ctx, func(evt Event) {
+		if evt.Username == username {
+			ids = append(ids, evt.ID)
+		}
+	})
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+
+	n, err := b.rdb.XDel(ctx, rdbEventStream, ids...).Result()
+	if err != nil {
+		b.logger.Error("event erase error", zap.Error(err))
+		return 0, ErrUnexpectedDatabaseError
+	}
+	return int(n), nil
+}
+
+// scan calls fn with every event retained in the stream, oldest first.
+func (b *redisEventBroker) scan(ctx context.Context, fn func(Event)) error {
+	start := "-"
+	for {
+		msgs, err := b.rdb.XRangeN(ctx, rdbEventStream, start, "+", eventScanCount).Result()
+		if err != nil {
+			b.logger.Error("event scan error", zap.Error(err))
+			return ErrUnexpectedDatabaseError
+		}
+		for _, msg := range msgs {
+			if evt, ok := b.decode(msg); ok {
+				fn(evt)
+			}
+		}
+		if len(msgs) < eventScanCount {
+			return nil
+		}
+		// exclusive range, so that the last message is not read twice
+		start = "(" + msgs[len(msgs)-1].ID
+	}
+}
+
+// tail reads new events from the stream and broadcasts them until ctx is done.
+func (b *redisEventBroker) tail(ctx context.Context) {
+	defer close(b.done)
+
+	lastID := ""
+	for ctx.Err() == nil {
+		if lastID == "" {
+			// Start after the newest event. Reading from "$" on every call
+			// would miss events published between two calls.
+			msgs, err := b.rdb.XRevRangeN(ctx, rdbEventStream, "+", "-", 1).Result()
+			if err != nil {
+				b.logger.Warn("event stream error", zap.Error(err))
+				b.wait(ctx)
+				continue
+			}
+			lastID = "0-0"
+			if len(msgs) > 0 {
+				lastID = msgs[0].ID
+			}
+		}
+
+		streams, err := b.rdb.XRead(ctx, &redis.XReadArgs{
+			Streams: []string{rdbEventStream, lastID},
+			Count:   eventReadCount,
+			Block:   eventReadBlock,
+		}).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				b.logger.Warn("event stream error", zap.Error(err))
+			}
+			b.wait(ctx)
+			continue
+		}
+		for _, stream := range streams {
+			for _, msg := range stream.Messages {
+				lastID = msg.ID
+				if evt, ok := b.decode(msg); ok {
+					b.broadcast(evt)
+				}
+			}
+		}
+	}
+}
+
+// wait pauses the tail after an error, unless ctx is done
+func (b *redisEventBroker) wait(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(eventRetryWait):
+	}
+}
+
+func (b *redisEventBroker) decode(msg redis.XMessage) (Event, bool) {
+	var evt Event
+	data, _ := msg.Values[rdbEventField].(string)
+	if err := json.Unmarshal([]byte(data), &evt); err != nil {
+		b.logger.Warn("event unmarshal error", zap.String("id", msg.ID), zap.Error(err))
+		return Event{}, false
+	}
+	evt.ID = msg.ID
+	return evt, true
+}
+
+// parseEventID parses a Redis stream ID of the form <ms>-<seq>.
+func parseEventID(id string) (uint64, uint64, error) {
+	msStr, seqStr, ok := strings.Cut(id, "-")
+	if !ok {
+		return 0, 0, ErrEventIDInvalid
+	}
+	ms, err := strconv.ParseUint(msStr, 10, 64)
+	if err != nil {
+		return 0, 0, ErrEventIDInvalid
+	}
+	seq, err := strconv.ParseUint(seqStr, 10, 64)
+	if err != nil {
+		return 0, 0, ErrEventIDInvalid
+	}
+	return ms, seq, nil
+}
+
+// eventIDAfter reports whether event ID a is after b.
+func eventIDAfter(a, b string) bool {
+	aMs, aSeq, _ := parseEventID(a)
+	bMs, bSeq, _ := parseEventID(b)
+	if aMs != bMs {
+		return aMs > bMs
+	}
+	return aSeq > bSeq
+}
+
+// subscribers fans events out to the local subscribers of an EventBroker
+type subscribers struct {
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+func newSubscribers() subscribers {
+	return subscribers{subs: map[chan Event]struct{}{}}
+}
+
+func (s *subscribers) subscribe() chan Event {
+	sub := make(chan Event, eventSubscriberBuffer)
+	s.mu.Lock()
+	s.subs[sub] = struct{}{}
+	s.mu.Unlock()
+	return sub
+}
+
+func (s *subscribers) unsubscribe(sub chan Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.subs[sub]; ok {
+		delete(s.subs, sub)
+		close(sub)
+	}
+}
+
+// closeAll drops every subscriber, which ends their streams
+func (s *subscribers) closeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sub := range s.subs {
+		delete(s.subs, sub)
+		close(sub)
+	}
+}
+
+func (s *subscribers) broadcast(evt Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sub := range s.subs {
+		select {
+		case sub <- evt:
+		default:
+			// subscriber is too slow, drop it so that it resumes with Last-Event-ID
+			delete(s.subs, sub)
+			close(sub)
+		}
+	}
+}
+
+// stream sends the replayed events, then the live events of sub which are
+// after them, until ctx is done or sub is dropped.
+func (s *subscribers) stream(ctx context.Context, sub chan Event, replay []Event, lastEventID string) <-chan Event {
+	out := make(chan Event)
+	go func() {
+		defer close(out)
+		defer s.unsubscribe(sub)
+
+		last := lastEventID
+		send := func(evt Event) bool {
+			select {
+			case out <- evt:
+				last = evt.ID
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		for _, evt := range replay {
+			if !send(evt) {
+				return
+			}
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case evt, ok := <-sub:
+				if !ok {
+					return
+				}
+				// skip live events that were already replayed
+				if last != "" && !eventIDAfter(evt.ID, last) {
+					continue
+				}
+				if !send(evt) {
+					return
+				}
+			}
+		}
+	}()
+	return out
+}
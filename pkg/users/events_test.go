@@ -0,0 +1,258 @@
+package users
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/awhdesmond/user-service/pkg/common"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/suite"
+	"go.uber.org/zap"
+)
+
+// EventsTestSuite runs against the Redis broker, or against
+// the memory broker when memory is true
+type EventsTestSuite struct {
+	suite.Suite
+
+	memory bool
+	rdb    redis.UniversalClient
+	broker EventBroker
+}
+
+func TestEventsTestSuite(t *testing.T) {
+	suite.Run(t, new(EventsTestSuite))
+}
+
+func TestEventsTestSuiteMemory(t *testing.T) {
+	suite.Run(t, &EventsTestSuite{memory: true})
+}
+
+func (ts *EventsTestSuite) SetupSuite() {
+	if ts.memory {
+		return
+	}
+	rdb, err := common.MakeRedisClient(common.TestRedisCfg)
+	if err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+	ts.rdb = rdb
+}
+
+// SetupTest gives every test an empty stream and its own broker, so that the
+// events published by a test never reach the subscribers of the next one
+func (ts *EventsTestSuite) SetupTest() {
+	if ts.memory {
+		ts.broker = NewMemoryEventBroker()
+		return
+	}
+	if err := ts.rdb.Del(context.TODO(), rdbEventStream).Err(); err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+	logger, _ := common.InitZap("debug")
+	ts.broker = NewRedisEventBroker(ts.rdb, logger)
+	// wait for the broker to start tailing the stream
+	time.Sleep(100 * time.Millisecond)
+}
+
+func (ts *EventsTestSuite) TearDownTest() {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*eventReadBlock)
+	defer cancel()
+	if err := ts.broker.Close(ctx); err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+}
+
+func (ts *EventsTestSuite) TearDownSuite() {
+	if ts.rdb != nil {
+		ts.rdb.FlushDB(context.TODO())
+	}
+}
+
+func (ts *EventsTestSuite) receive(events <-chan Event) Event {
+	select {
+	case evt := <-events:
+		return evt
+	case <-time.After(10 * time.Second):
+		ts.T().Fatalf("timed out waiting for event")
+	}
+	return Event{}
+}
+
+func (ts *EventsTestSuite) TestSubscribeAndResume() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, err := ts.broker.Subscribe(ctx, "")
+	if err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+
+	for _, username := range []string{"apple", "pear", "mango"} {
+		if err := ts.broker.Publish(ctx, Event{Type: EventUserCreated, Username: username}); err != nil {
+			ts.T().Fatalf("got = %v, want = %v", err, nil)
+		}
+	}
+
+	first := ts.receive(events)
+	if first.Username != "apple" {
+		ts.T().Fatalf("got = %v, want = %v", first.Username, "apple")
+	}
+	for _, want := range []string{"pear", "mango"} {
+		if evt := ts.receive(events); evt.Username != want {
+			ts.T().Fatalf("got = %v, want = %v", evt.Username, want)
+		}
+	}
+
+	// resume after the first event
+	resumed, err := ts.broker.Subscribe(ctx, first.ID)
+	if err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+	for _, want := range []string{"pear", "mango"} {
+		if evt := ts.receive(resumed); evt.Username != want {
+			ts.T().Fatalf("got = %v, want = %v", evt.Username, want)
+		}
+	}
+
+	_, err = ts.broker.Subscribe(ctx, "not-an-id")
+	if err != ErrEventIDInvalid {
+		ts.T().Fatalf("got = %v, want = %v", err, ErrEventIDInvalid)
+	}
+}
+
+func (ts *EventsTestSuite) TestEventsHandler() {
+	srv := httptest.NewServer(MakeEventsHandler(ts.broker, zap.NewNop()))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"?prefix=ki", nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+	defer res.Body.Close()
+
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		ts.T().Fatalf("got = %v, want = %v", ct, "text/event-stream")
+	}
+
+	for _, username := range []string{"banana", "kiwi"} {
+		if err := ts.broker.Publish(ctx, Event{Type: EventUserUpdated, Username: username}); err != nil {
+			ts.T().Fatalf("got = %v, want = %v", err, nil)
+		}
+	}
+
+	// the first data line must be kiwi since banana is filtered out
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		if !strings.Contains(line, `"username":"kiwi"`) {
+			ts.T().Fatalf("got = %v, want = %v", line, "kiwi")
+		}
+		return
+	}
+	ts.T().Fatalf("got = %v, want = %v", scanner.Err(), "kiwi event")
+}
+
+func (ts *EventsTestSuite) TestHistoryAndErase() {
+	ctx := context.Background()
+	for _, evt := range []Event{
+		{Type: EventUserCreated, Username: "lemon"},
+		{Type: EventUserCreated, Username: "lime"},
+		{Type: EventUserUpdated, Username: "lemon"},
+	} {
+		if err := ts.broker.Publish(ctx, evt); err != nil {
+			ts.T().Fatalf("got = %v, want = %v", err, nil)
+		}
+	}
+
+	history, err := ts.broker.History(ctx, "lemon")
+	if err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+	if len(history) != 2 || history[0].Type != EventUserCreated || history[1].Type != EventUserUpdated {
+		ts.T().Fatalf("got = %v, want = %v", history, "created and updated events of lemon")
+	}
+
+	n, err := ts.broker.Erase(ctx, "lemon")
+	if err != nil || n != 2 {
+		ts.T().Fatalf("got = %v, %v, want = %v, %v", n, err, 2, nil)
+	}
+	if history, _ = ts.broker.History(ctx, "lemon"); len(history) != 0 {
+		ts.T().Fatalf("got = %v, want = %v", history, "no events")
+	}
+	if history, _ = ts.broker.History(ctx, "lime"); len(history) != 1 {
+		ts.T().Fatalf("got = %v, want = %v", history, "lime event is kept")
+	}
+}
+
+func (ts *EventsTestSuite) TestClose() {
+	broker := NewMemoryEventBroker()
+	if !ts.memory {
+		broker = NewRedisEventBroker(ts.rdb, zap.NewNop())
+	}
+	events, err := broker.Subscribe(context.Background(), "")
+	if err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*eventReadBlock)
+	defer cancel()
+	if err := broker.Close(ctx); err != nil {
+		ts.T().Fatalf("got = %v, want = %v", err, nil)
+	}
+	// the subscription ends
+	select {
+	case _, ok := <-events:
+		if ok {
+			ts.T().Fatalf("got = %v, want = %v", "an event", "closed subscription")
+		}
+	case <-time.After(time.Second):
+		ts.T().Fatalf("got = %v, want = %v", "open subscription", "closed subscription")
+	}
+}
+
+func TestMemoryEventBrokerOrder(t *testing.T) {
+	const publishers, perPublisher = 8, eventSubscriberBuffer / 8
+	for round := 0; round < 50; round++ {
+		broker := NewMemoryEventBroker().(*memoryEventBroker)
+		sub := broker.subscribe()
+
+		// hold the subscribers, so that the publishers which assigned their IDs wait to broadcast together
+		broker.subscribers.mu.Lock()
+		var wg sync.WaitGroup
+		for i := 0; i < publishers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < perPublisher; j++ {
+					broker.Publish(context.Background(), Event{Type: EventUserUpdated, Username: "apple"})
+				}
+			}()
+		}
+		time.Sleep(time.Millisecond)
+		broker.subscribers.mu.Unlock()
+		wg.Wait()
+
+		last := ""
+		for i := 0; i < publishers*perPublisher; i++ {
+			evt := <-sub
+			if last != "" && !eventIDAfter(evt.ID, last) {
+				t.Fatalf("got = %v, want = %v", evt.ID, "an ID after "+last)
+			}
+			last = evt.ID
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package users
+
+import (
+	"context"
+
+	"github.com/awhdesmond/user-service/pkg/common"
+	"github.com/awhdesmond/user-service/pkg/users/pb"
+	grpctransport "github.com/go-kit/kit/transport/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// GRPCServiceName is the fully qualified name of the Users gRPC service,
+	// used to report its status through the gRPC health checking protocol.
+	GRPCServiceName = "users.v1.Users"
+)
+
+// errToGRPCCode maps a specific error to a gRPC status code
+func errToGRPCCode(err error) codes.Code {
+	if common.ErrorContains([]error{ErrUserNotFound}, err) {
+		return codes.NotFound
+	}
+	// as HTTP 503, see errToHttpCode
+	if common.ErrorContains([]error{ErrCacheUnavailable}, err) {
+		return codes.Unavailable
+	}
+	if common.ErrorContains(
+		[]error{
+			ErrDoBFutureUsed,
+			ErrDoBInvalid,
+			ErrDoBTooOld,
+			ErrUsernameContainsNonLetters,
+			ErrUsernameIsEmpty,
+		},
+		err,
+	) {
+		return codes.InvalidArgument
+	}
+	return codes.Internal
+}
+
+func errToGRPCStatus(err error) error {
+	return status.Error(errToGRPCCode(err), err.Error())
+}
+
+type grpcServer struct {
+	pb.UnimplementedUsersServer
+
+	read   grpctransport.Handler
+	upsert grpctransport.Handler
+	delete grpctransport.Handler
+}
+
+// MakeGRPCServer makes the users service available over gRPC
+func MakeGRPCServer(svc Service) pb.UsersServer {
+	return &grpcServer{
+		read: grpctransport.NewServer(
+			NewReadEndpoint(svc),
+			decodeGRPCReadRequest,
+			encodeGRPCReadResponse,
+		),
+		upsert: grpctransport.NewServer(
+			NewUpsertEndpoint(svc),
+			decodeGRPCUpsertRequest,
+			encodeGRPCUpsertResponse,
+		),
+		delete: grpctransport.NewServer(
+			NewDeleteEndpoint(svc),
+			decodeGRPCDeleteRequest,
+			encodeGRPCDeleteResponse,
+		),
+	}
+}
+
+func (s *grpcServer) Read(ctx context.Context, req *pb.ReadRequest) (*pb.ReadResponse, error) {
+	_, resp, err := s.read.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*pb.ReadResponse), nil
+}
+
+func (s *grpcServer) Upsert(ctx context.Context, req *pb.UpsertRequest) (*pb.UpsertResponse, error) {
+	_, resp, err := s.upsert.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*pb.UpsertResponse), nil
+}
+
+func (s *grpcServer) Delete(ctx context.Context, req *pb.DeleteRequest) (*pb.DeleteResponse, error) {
+	_, resp, err := s.delete.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*pb.DeleteResponse), nil
+}
+
+func decodeGRPCReadRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*pb.ReadRequest)
+	return ReadRequest{Username: req.Username}, nil
+}
+
+func encodeGRPCReadResponse(_ context.Context, response interface{}) (interface{}, error) {
+	if e, ok := response.(common.Errorer); ok && e.Error() != nil {
+		return nil, errToGRPCStatus(e.Error())
+	}
+	resp := response.(ReadResponse)
+	return &pb.ReadResponse{Message: resp.Message}, nil
+}
+
+func decodeGRPCUpsertRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*pb.UpsertRequest)
+	return UpsertRequest{Username: req.Username, DoB: req.DateOfBirth}, nil
+}
+
+func encodeGRPCUpsertResponse(_ context.Context, response interface{}) (interface{}, error) {
+	if e, ok := response.(common.Errorer); ok && e.Error() != nil {
+		return nil, errToGRPCStatus(e.Error())
+	}
+	return &pb.UpsertResponse{}, nil
+}
+
+func decodeGRPCDeleteRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*pb.DeleteRequest)
+	return DeleteRequest{Username: req.Username}, nil
+}
+
+func encodeGRPCDeleteResponse(_ context.Context, response interface{}) (interface{}, error) {
+	if e, ok := response.(common.Errorer); ok && e.Error() != nil {
+		return nil, errToGRPCStatus(e.Error())
+	}
+	return &pb.DeleteResponse{}, nil
+}
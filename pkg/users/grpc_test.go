@@ -0,0 +1,124 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/awhdesmond/user-service/pkg/users/pb"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestErrToGRPCCode(t *testing.T) {
+	cases := []struct {
+		err  error
+		want codes.Code
+	}{
+		{ErrUserNotFound, codes.NotFound},
+		{ErrCacheUnavailable, codes.Unavailable},
+		{ErrDoBInvalid, codes.InvalidArgument},
+		{ErrUsernameIsEmpty, codes.InvalidArgument},
+		{errors.New("boom"), codes.Internal},
+	}
+	for _, tt := range cases {
+		if got := errToGRPCCode(tt.err); got != tt.want {
+			t.Fatalf("got = %v, want = %v", got, tt.want)
+		}
+	}
+}
+
+// unavailableStore fails every call as a store whose Redis is down
+type unavailableStore struct {
+	Store
+}
+
+func (unavailableStore) Upsert(context.Context, string, time.Time) error {
+	return ErrCacheUnavailable
+}
+
+func (unavailableStore) Read(context.Context, string) (User, error) {
+	return User{}, ErrCacheUnavailable
+}
+
+func (unavailableStore) Delete(context.Context, string) error {
+	return ErrCacheUnavailable
+}
+
+// makeGRPCTestClient serves svc over an in-memory connection
+func makeGRPCTestClient(t *testing.T, svc Service) pb.UsersClient {
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	pb.RegisterUsersServer(srv, MakeGRPCServer(svc))
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewUsersClient(conn)
+}
+
+func TestGRPCRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore(NewMemoryEventBroker(), zap.NewNop())
+	client := makeGRPCTestClient(t, NewService(store, time.Now))
+
+	if _, err := client.Upsert(ctx, &pb.UpsertRequest{Username: "apple", DateOfBirth: "2000-01-02"}); err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	resp, err := client.Read(ctx, &pb.ReadRequest{Username: "apple"})
+	if err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	if resp.Message == "" {
+		t.Fatalf("got = %v, want = %v", resp.Message, "a birthday message")
+	}
+	if _, err := client.Delete(ctx, &pb.DeleteRequest{Username: "apple"}); err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+
+	_, err = client.Read(ctx, &pb.ReadRequest{Username: "apple"})
+	if got := status.Code(err); got != codes.NotFound {
+		t.Fatalf("got = %v, want = %v", got, codes.NotFound)
+	}
+	_, err = client.Upsert(ctx, &pb.UpsertRequest{Username: "apple", DateOfBirth: "abcd"})
+	if got := status.Code(err); got != codes.InvalidArgument {
+		t.Fatalf("got = %v, want = %v", got, codes.InvalidArgument)
+	}
+	_, err = client.Delete(ctx, &pb.DeleteRequest{Username: ""})
+	if got := status.Code(err); got != codes.InvalidArgument {
+		t.Fatalf("got = %v, want = %v", got, codes.InvalidArgument)
+	}
+}
+
+func TestGRPCUnavailable(t *testing.T) {
+	ctx := context.Background()
+	client := makeGRPCTestClient(t, NewService(unavailableStore{}, time.Now))
+
+	_, err := client.Read(ctx, &pb.ReadRequest{Username: "apple"})
+	if got := status.Code(err); got != codes.Unavailable {
+		t.Fatalf("got = %v, want = %v", got, codes.Unavailable)
+	}
+	_, err = client.Upsert(ctx, &pb.UpsertRequest{Username: "apple", DateOfBirth: "2000-01-02"})
+	if got := status.Code(err); got != codes.Unavailable {
+		t.Fatalf("got = %v, want = %v", got, codes.Unavailable)
+	}
+	_, err = client.Delete(ctx, &pb.DeleteRequest{Username: "apple"})
+	if got := status.Code(err); got != codes.Unavailable {
+		t.Fatalf("got = %v, want = %v", got, codes.Unavailable)
+	}
+}
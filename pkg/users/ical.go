@@ -0,0 +1,118 @@
+package users
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// iCalendar (RFC 5545) rendering of users' birthdays.
+
+const (
+	icalProdID       = "-//awhdesmond//user-service//EN"
+	icalUIDDomain    = "user-service"
+	icalDateLayout   = "20060102"
+	icalStampLayout  = "20060102T150405Z"
+	icalLineEnding   = "\r\n"
+	icalMaxLineOctet = 75
+)
+
+// icalUID is stable for a given user so that calendar clients
+// deduplicate the event across refreshes of the feed.
+func (u User) icalUID() string {
+	return fmt.Sprintf("birthday-%s@%s", u.Username, icalUIDDomain)
+}
+
+// icalLeapDayOfYear is the day of the year of Feb 29 in leap years and of Mar 1 otherwise.
+const icalLeapDayOfYear = 60
+
+// icalRRule returns a yearly recurrence rule for the user's birthday.
+// Birthdays on Feb 29 recur on the 60th day of the year, i.e. on Mar 1
+// in non-leap years like CalcDaysToBirthday. A plain FREQ=YEARLY rule
+// would skip those years. BYYEARDAY is part of RFC 5545, but some clients,
+// e.g. Google Calendar and Outlook, handle it less well than
+// BYMONTH=2;BYMONTHDAY=-1, which would recur on Feb 28 instead.
+func (u User) icalRRule() string {
+	if u.DoB.Month() == time.February && u.DoB.Day() == 29 {
+		return fmt.Sprintf("FREQ=YEARLY;BYYEARDAY=%d", icalLeapDayOfYear)
+	}
+	return "FREQ=YEARLY"
+}
+
+// icalEvent returns the content lines of an all-day VEVENT for the user's birthday.
+// dtstamp is the time at which the feed was generated.
+func (u User) icalEvent(dtstamp time.Time) []string {
+	start := time.Date(u.DoB.Year(), u.DoB.Month(), u.DoB.Day(), 0, 0, 0, 0, time.UTC)
+	return []string{
+		"BEGIN:VEVENT",
+		"UID:" + u.icalUID(),
+		"DTSTAMP:" + dtstamp.UTC().Format(icalStampLayout),
+		"DTSTART;VALUE=DATE:" + start.Format(icalDateLayout),
+		"DTEND;VALUE=DATE:" + start.AddDate(0, 0, 1).Format(icalDateLayout),
+		"RRULE:" + u.icalRRule(),
+		"SUMMARY:" + icalEscapeText(fmt.Sprintf("%s's birthday", u.Username)),
+		"TRANSP:TRANSPARENT",
+		"END:VEVENT",
+	}
+}
+
+// GenerateCalendar renders an iCalendar object containing
+// a yearly recurring all-day event for each user's birthday.
+func GenerateCalendar(name string, usrs []User, nowFn func() time.Time) string {
+	dtstamp := nowFn()
+
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:" + icalProdID,
+		"CALSCALE:GREGORIAN",
+		"METHOD:PUBLISH",
+		"X-WR-CALNAME:" + icalEscapeText(name),
+	}
+	for _, u := range usrs {
+		lines = append(lines, u.icalEvent(dtstamp)...)
+	}
+	lines = append(lines, "END:VCALENDAR")
+
+	var sb strings.Builder
+	for _, line := range lines {
+		sb.WriteString(icalFoldLine(line))
+		sb.WriteString(icalLineEnding)
+	}
+	return sb.String()
+}
+
+// icalEscapeText escapes a TEXT property value (RFC 5545 section 3.3.11).
+func icalEscapeText(s string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		";", `\;`,
+		",", `\,`,
+		"\n", `\n`,
+	).Replace(s)
+}
+
+// icalFoldLine splits content lines longer than 75 octets
+// (RFC 5545 section 3.1) without breaking multi-byte characters.
+func icalFoldLine(line string) string {
+	if len(line) <= icalMaxLineOctet {
+		return line
+	}
+
+	var sb strings.Builder
+	limit := icalMaxLineOctet
+	n := 0
+	for _, r := range line {
+		size := utf8.RuneLen(r)
+		if n+size > limit {
+			sb.WriteString(icalLineEnding + " ")
+			// continuation lines start with a space which counts towards the limit
+			limit = icalMaxLineOctet - 1
+			n = 0
+		}
+		sb.WriteRune(r)
+		n += size
+	}
+	return sb.String()
+}
@@ -0,0 +1,142 @@
+package users
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGenerateCalendar(t *testing.T) {
+	nowFn := func() time.Time {
+		return time.Date(2024, 6, 1, 10, 30, 0, 0, time.UTC)
+	}
+
+	cases := []struct {
+		name string
+		user User
+		want []string
+	}{
+		{
+			name: "basic",
+			user: User{Username: "apple", DoB: time.Date(2000, 3, 3, 0, 0, 0, 0, time.UTC)},
+			want: []string{
+				"UID:birthday-apple@user-service",
+				"DTSTAMP:20240601T103000Z",
+				"DTSTART;VALUE=DATE:20000303",
+				"DTEND;VALUE=DATE:20000304",
+				"RRULE:FREQ=YEARLY",
+				`SUMMARY:apple's birthday`,
+			},
+		},
+		{
+			name: "leap day",
+			user: User{Username: "pear", DoB: time.Date(2000, 2, 29, 0, 0, 0, 0, time.UTC)},
+			want: []string{
+				"DTSTART;VALUE=DATE:20000229",
+				"DTEND;VALUE=DATE:20000301",
+				"RRULE:FREQ=YEARLY;BYYEARDAY=60",
+			},
+		},
+		{
+			name: "end of year",
+			user: User{Username: "mango", DoB: time.Date(1999, 12, 31, 0, 0, 0, 0, time.UTC)},
+			want: []string{
+				"DTSTART;VALUE=DATE:19991231",
+				"DTEND;VALUE=DATE:20000101",
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			cal := GenerateCalendar("Birthdays", []User{tt.user}, nowFn)
+
+			if !strings.HasPrefix(cal, "BEGIN:VCALENDAR\r\n") {
+				t.Fatalf("got = %q, want prefix = %q", cal, "BEGIN:VCALENDAR\r\n")
+			}
+			if !strings.HasSuffix(cal, "END:VCALENDAR\r\n") {
+				t.Fatalf("got = %q, want suffix = %q", cal, "END:VCALENDAR\r\n")
+			}
+
+			lines := strings.Split(cal, "\r\n")
+			for _, want := range tt.want {
+				found := false
+				for _, line := range lines {
+					if line == want {
+						found = true
+						break
+					}
+				}
+				if !found {
+					t.Fatalf("got = %q, want line = %q", cal, want)
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateCalendarLeapDay(t *testing.T) {
+	u := User{Username: "pear", DoB: time.Date(2000, 2, 29, 0, 0, 0, 0, time.UTC)}
+	cal := GenerateCalendar("Birthdays", []User{u}, func() time.Time {
+		return time.Date(2024, 6, 1, 10, 30, 0, 0, time.UTC)
+	})
+
+	props := map[string]string{}
+	for _, line := range strings.Split(cal, "\r\n") {
+		if name, value, ok := strings.Cut(line, ":"); ok {
+			props[name] = value
+		}
+	}
+	if got := props["DTSTART;VALUE=DATE"]; got != "20000229" {
+		t.Fatalf("got = %v, want = %v", got, "20000229")
+	}
+	rrule := props["RRULE"]
+	if rrule != "FREQ=YEARLY;BYYEARDAY=60" {
+		t.Fatalf("got = %v, want = %v", rrule, "FREQ=YEARLY;BYYEARDAY=60")
+	}
+
+	// expand the rule: BYYEARDAY counts from Jan 1, as does time.Date when normalising the day
+	yearDay, err := strconv.Atoi(strings.TrimPrefix(rrule, "FREQ=YEARLY;BYYEARDAY="))
+	if err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	cases := []struct {
+		year int
+		want time.Time
+	}{
+		{2000, time.Date(2000, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{2023, time.Date(2023, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{2024, time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{2100, time.Date(2100, 3, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range cases {
+		got := time.Date(tt.year, 1, yearDay, 0, 0, 0, 0, time.UTC)
+		if !got.Equal(tt.want) {
+			t.Fatalf("got = %v, want = %v", got, tt.want)
+		}
+
+		// the calendar agrees with the days to birthday of the user
+		nowFn := func() time.Time { return time.Date(tt.year, 1, 1, 0, 0, 0, 0, time.UTC) }
+		if d := u.CalcDaysToBirthday(nowFn); d != int(got.Sub(nowFn()).Hours()/24) {
+			t.Fatalf("got = %v, want = %v", d, got.Sub(nowFn()))
+		}
+	}
+}
+
+func TestIcalFoldLine(t *testing.T) {
+	line := "SUMMARY:" + strings.Repeat("é", 80)
+	folded := icalFoldLine(line)
+
+	for _, l := range strings.Split(folded, "\r\n") {
+		if len(l) > icalMaxLineOctet {
+			t.Fatalf("got = %v, want <= %v", len(l), icalMaxLineOctet)
+		}
+	}
+
+	unfolded := strings.ReplaceAll(folded, "\r\n ", "")
+	if unfolded != line {
+		t.Fatalf("got = %v, want = %v", unfolded, line)
+	}
+}
@@ -0,0 +1,271 @@
+package users
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	StoreBackendPostgres = "postgres"
+	StoreBackendMemory   = "memory"
+)
+
+// memoryEventBroker keeps the events in process, for a single replica
+// without Redis. Event IDs have the same <ms>-<seq> form as Redis stream IDs.
+type memoryEventBroker struct {
+	subscribers
+
+	mu      sync.Mutex
+	events  []Event
+	lastMs  uint64
+	lastSeq uint64
+}
+
+func NewMemoryEventBroker() EventBroker {
+	return &memoryEventBroker{subscribers: newSubscribers()}
+}
+
+// Publish broadcasts while it holds the lock, so that subscribers receive the
+// events in the order of their IDs and do not skip an event as already sent.
+func (b *memoryEventBroker) Publish(_ context.Context, evt Event) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ms := uint64(time.Now().UnixMilli())
+	if ms <= b.lastMs {
+		ms, b.lastSeq = b.lastMs, b.lastSeq+1
+	} else {
+		b.lastSeq = 0
+	}
+	b.lastMs = ms
+	evt.ID = fmt.Sprintf("%d-%d", ms, b.lastSeq)
+
+	b.events = append(b.events, evt)
+	if len(b.events) > rdbEventStreamMaxLen {
+		b.events = b.events[len(b.events)-rdbEventStreamMaxLen:]
+	}
+	b.broadcast(evt)
+	return nil
+}
+
+func (b *memoryEventBroker) Subscribe(ctx context.Context, lastEventID string) (<-chan Event, error) {
+	if lastEventID != "" {
+		if _, _, err := parseEventID(lastEventID); err != nil {
+			return nil, err
+		}
+	}
+
+	// Register before replaying so that no event published in between is lost.
+	sub := b.subscribe()
+
+	var replay []Event
+	if lastEventID != "" {
+		b.mu.Lock()
+		for _, evt := range b.events {
+			if eventIDAfter(evt.ID, lastEventID) {
+				replay = append(replay, evt)
+			}
+		}
+		b.mu.Unlock()
+	}
+	return b.stream(ctx, sub, replay, lastEventID), nil
+}
+
+func (b *memoryEventBroker) Close(context.Context) error {
+	b.closeAll()
+	return nil
+}
+
+func (b *memoryEventBroker) History(_ context.Context, username string) ([]Event, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	history := []Event{}
+	for _, evt := range b.events {
+		if evt.Username == username {
+			history = append(history, evt)
+		}
+	}
+	return history, nil
+}
+
+func (b *memoryEventBroker) Erase(_ context.Context, username string) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	kept := b.events[:0]
+	for _, evt := range b.events {
+		if evt.Username != username {
+			kept = append(kept, evt)
+		}
+	}
+	n := len(b.events) - len(kept)
+	b.events = kept
+	return n, nil
+}
+
+// memoryStore keeps users in a map, for local development and tests
+// without Postgres and Redis. Nothing survives a restart, and it cannot
+// be shared between replicas.
+type memoryStore struct {
+	mu       sync.RWMutex
+	users    map[string]User
+	receipts []ErasureReceipt
+
+	events EventBroker
+	logger *zap.Logger
+}
+
+func NewMemoryStore(events EventBroker, logger *zap.Logger) Store {
+	return &memoryStore{
+		users:  map[string]User{},
+		events: events,
+		logger: logger.Named(loggerName),
+	}
+}
+
+// publish emits a user event. The change has already been made,
+// so a failure is logged rather than returned to the caller.
+func (store *memoryStore) publish(ctx context.Context, evtType EventType, username string) {
+	evt := Event{Type: evtType, Username: username, Time: time.Now().UTC()}
+	if err := store.events.Publish(ctx, evt); err != nil {
+		store.logger.Warn("event error", zap.Error(err))
+	}
+}
+
+func (store *memoryStore) Upsert(ctx context.Context, username string, dob time.Time) error {
+	store.mu.Lock()
+	_, exists := store.users[username]
+	store.users[username] = User{Username: username, DoB: dob}
+	store.mu.Unlock()
+
+	evtType := EventUserCreated
+	if exists {
+		evtType = EventUserUpdated
+	}
+	store.publish(ctx, evtType, username)
+	return nil
+}
+
+func (store *memoryStore) Read(_ context.Context, username string) (User, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	usr, ok := store.users[username]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	return usr, nil
+}
+
+// list returns the users matching fn ordered by username
+func (store *memoryStore) list(fn func(User) bool) []User {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	usrs := []User{}
+	for _, usr := range store.users {
+		if fn(usr) {
+			usrs = append(usrs, usr)
+		}
+	}
+	sort.Slice(usrs, func(i, j int) bool { return usrs[i].Username < usrs[j].Username })
+	return usrs
+}
+
+func (store *memoryStore) List(context.Context) ([]User, error) {
+	return store.list(func(User) bool { return true }), nil
+}
+
+// ListByBirthday selects the same users as the Postgres store, by comparing
+// the MM-DD of the dates of birth with those of from and to.
+func (store *memoryStore) ListByBirthday(_ context.Context, from, to time.Time) ([]User, error) {
+	wholeYear := !to.Before(from.AddDate(1, 0, 0))
+	fromMD, toMD := from.Format(monthDayLayout), to.Format(monthDayLayout)
+	return store.list(func(usr User) bool {
+		md := usr.DoB.Format(monthDayLayout)
+		switch {
+		case wholeYear:
+			return true
+		case fromMD <= toMD:
+			return md >= fromMD && md <= toMD
+		default:
+			return md >= fromMD || md <= toMD
+		}
+	}), nil
+}
+
+func (store *memoryStore) Delete(ctx context.Context, username string) error {
+	store.mu.Lock()
+	_, ok := store.users[username]
+	delete(store.users, username)
+	store.mu.Unlock()
+
+	if !ok {
+		return ErrUserNotFound
+	}
+	store.publish(ctx, EventUserDeleted, username)
+	return nil
+}
+
+// Export gathers the user and its events. There is no cache entry.
+func (store *memoryStore) Export(ctx context.Context, username string) (UserExport, error) {
+	export := UserExport{Username: username, ExportedAt: time.Now().UTC()}
+	if usr, err := store.Read(ctx, username); err == nil {
+		export.User = &usr
+	}
+
+	var err error
+	if export.Events, err = store.events.History(ctx, username); err != nil {
+		return UserExport{}, err
+	}
+	if export.User == nil && len(export.Events) == 0 {
+		return UserExport{}, ErrUserNotFound
+	}
+	return export, nil
+}
+
+// Erase deletes the events and the user, and appends a receipt to the
+// receipt chain, which is kept in memory as well.
+func (store *memoryStore) Erase(ctx context.Context, username string) (ErasureReceipt, error) {
+	// there is no keyring, so the subject is a random ID
+	subjectHash, err := SubjectHash(nil, username)
+	if err != nil {
+		return ErasureReceipt{}, err
+	}
+	eventsDeleted, err := store.events.Erase(ctx, username)
+	if err != nil {
+		return ErasureReceipt{}, err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	receipt := ErasureReceipt{
+		ID:            int64(len(store.receipts) + 1),
+		SubjectHash:   subjectHash,
+		ErasedAt:      time.Now().UTC(),
+		EventsDeleted: eventsDeleted,
+	}
+	if _, ok := store.users[username]; ok {
+		receipt.RowsDeleted = 1
+		delete(store.users, username)
+	}
+	if len(store.receipts) > 0 {
+		receipt.PrevHash = store.receipts[len(store.receipts)-1].Hash
+	}
+	receipt.Hash = receipt.computeHash()
+	store.receipts = append(store.receipts, receipt)
+
+	store.logger.Info("user erased", zap.Int64("receipt", receipt.ID), zap.String("hash", receipt.Hash))
+	return receipt, nil
+}
+
+// Close does nothing, the memory store has no background tasks
+func (store *memoryStore) Close(context.Context) error {
+	return nil
+}
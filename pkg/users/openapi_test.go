@@ -0,0 +1,67 @@
+package users
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/awhdesmond/user-service/docs"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/gorilla/mux"
+)
+
+// TestOpenAPISpecCoversRoutes fails when a route is added to the transport
+// without documenting it in docs/swagger.yaml
+func TestOpenAPISpecCoversRoutes(t *testing.T) {
+	doc, err := openapi3.NewLoader().LoadFromData(docs.OpenAPISpec)
+	if err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+
+	r := MakeHandler(NewService(nil, testTimeFn)).(*mux.Router)
+	err = r.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		methods, err := route.GetMethods()
+		if err != nil {
+			// subrouters
+			return nil
+		}
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+
+		// the spec lists /v1 as a server
+		item := doc.Paths.Find(strings.TrimPrefix(path, APIV1Prefix))
+		if item == nil {
+			t.Errorf("got = %v, want = %v", nil, path)
+			return nil
+		}
+		for _, method := range methods {
+			if item.GetOperation(method) == nil {
+				t.Errorf("got = %v, want = %v", nil, method+" "+path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+
+	// and the other way round
+	for path, item := range doc.Paths {
+		for method := range item.Operations() {
+			if path == "/events" {
+				// served by MakeEventsHandler
+				continue
+			}
+			for _, server := range doc.Servers {
+				url := strings.TrimSuffix(server.URL, "/") + strings.ReplaceAll(path, "{username}", "apple")
+				req, _ := http.NewRequest(method, url, nil)
+				var match mux.RouteMatch
+				if !r.Match(req, &match) || match.MatchErr != nil {
+					t.Errorf("got = %v, want = %v", nil, method+" "+url)
+				}
+			}
+		}
+	}
+}
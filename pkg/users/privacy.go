@@ -0,0 +1,247 @@
+package users
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/awhdesmond/user-service/pkg/common"
+	"github.com/upper/db/v4"
+	"go.uber.org/zap"
+)
+
+const (
+	dbReceiptsTable = "erasure_receipts"
+
+	eventEraseAttempts = 3
+	eventEraseTimeout  = 5 * time.Second
+)
+
+var (
+	ErrErasureReceiptTampered = errors.New("erasure receipt chain has been tampered with")
+)
+
+// UserExport is every piece of data held about a user,
+// returned for data subject access requests
+type UserExport struct {
+	Username   string    `json:"username"`
+	ExportedAt time.Time `json:"exportedAt"`
+	// User is the stored row, nil when there is none
+	User *User `json:"user"`
+	// Cache is the value cached in Redis, nil when the user is not cached
+	Cache *CacheEntry `json:"cache"`
+	// Events are the retained change events of the user, oldest first
+	Events []Event `json:"events"`
+}
+
+// ErasureReceipt records that the data of a user was erased. The username
+// itself is not kept. Each receipt hashes the previous receipt, so that
+// editing or deleting a receipt breaks the chain.
+type ErasureReceipt struct {
+	ID            int64     `json:"id" db:"id,omitempty"`
+	SubjectHash   string    `json:"subjectHash" db:"subject_hash"`
+	ErasedAt      time.Time `json:"erasedAt" db:"erased_at"`
+	RowsDeleted   int       `json:"rowsDeleted" db:"rows_deleted"`
+	EventsDeleted int       `json:"eventsDeleted" db:"events_deleted"`
+	PrevHash      string    `json:"prevHash" db:"prev_hash"`
+	Hash          string    `json:"hash" db:"hash"`
+}
+
+func sha256Hex(parts ...string) string {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// SubjectHash identifies the user of a receipt without storing the username.
+// It is keyed with the blind index key of keyring, since a plain hash of a
+// username can be reversed by hashing every likely username. Without a
+// keyring, it is a random ID which cannot be linked to the user at all.
+func SubjectHash(keyring *common.Keyring, username string) (string, error) {
+	if keyring != nil {
+		return keyring.BlindIndex("subject:" + username), nil
+	}
+	id := make([]byte, sha256.Size)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// computeHash hashes the content of the receipt along with the previous hash
+func (r ErasureReceipt) computeHash() string {
+	return sha256Hex(
+		r.PrevHash,
+		r.SubjectHash,
+		r.ErasedAt.UTC().Format(time.RFC3339Nano),
+		strconv.Itoa(r.RowsDeleted),
+		strconv.Itoa(r.EventsDeleted),
+	)
+}
+
+// VerifyErasureReceipts checks the hash chain of receipts ordered by ID.
+// It returns ErrErasureReceiptTampered when a receipt was edited, or
+// when a receipt other than the last one was deleted.
+func VerifyErasureReceipts(receipts []ErasureReceipt) error {
+	prevHash := ""
+	for _, r := range receipts {
+		if r.PrevHash != prevHash || r.computeHash() != r.Hash {
+			return fmt.Errorf("%w: receipt %d", ErrErasureReceiptTampered, r.ID)
+		}
+		prevHash = r.Hash
+	}
+	return nil
+}
+
+// ListErasureReceipts reads all receipts ordered by ID, e.g. to verify them
+func ListErasureReceipts(ctx context.Context, sess db.Session) ([]ErasureReceipt, error) {
+	receipts := []ErasureReceipt{}
+	q := sess.WithContext(ctx).SQL().SelectFrom(dbReceiptsTable).OrderBy("id")
+	if err := q.All(&receipts); err != nil {
+		return nil, err
+	}
+	return receipts, nil
+}
+
+// Export gathers the row, the cache entry and the events of the user.
+// It returns ErrUserNotFound when none of them exist.
+func (store *store) Export(ctx context.Context, username string) (UserExport, error) {
+	export := UserExport{Username: username, ExportedAt: time.Now().UTC()}
+
+	var row userRow
+	err := store.sess.WithContext(ctx).SQL().SelectFrom(dbtable).Where("username = ?", username).One(&row)
+	if err != nil && !common.IsDBErrorNoRows(err) {
+		store.logger.Error("db error", zap.Error(err))
+		return UserExport{}, ErrUnexpectedDatabaseError
+	}
+	if err == nil {
+		usr, err := decodeRow(store.keyring, row)
+		if err != nil {
+			store.logger.Error("decrypt error", zap.Error(err))
+			return UserExport{}, ErrUnexpectedDatabaseError
+		}
+		export.User = &usr
+	}
+
+	entry, err := store.cache.inspect(ctx, username)
+	if err != nil && !errors.Is(err, ErrNotCached) {
+		return UserExport{}, err
+	}
+	if err == nil {
+		export.Cache = &entry
+	}
+
+	if export.Events, err = store.events.History(ctx, username); err != nil {
+		return UserExport{}, err
+	}
+
+	if export.User == nil && export.Cache == nil && len(export.Events) == 0 {
+		return UserExport{}, ErrUserNotFound
+	}
+	return export, nil
+}
+
+// Erase deletes the row of the user and appends a receipt to the receipt
+// chain in one transaction, then deletes the events and the cache entries of
+// the user. Unlike Delete, it does not emit a deleted event, which would store
+// the username again. The user is cached as not found with a new version, so
+// that a read which raced with the erasure cannot cache the user again.
+//
+// Once the receipt is committed, Erase returns it even when the events or the
+// cache could not be erased, so that retries do not append receipts. The
+// events are erased again on failure, and the cache once Redis recovers.
+func (store *store) Erase(ctx context.Context, username string) (ErasureReceipt, error) {
+	// the events are counted first, and only erased once the receipt is committed
+	events, err := store.events.History(ctx, username)
+	if err != nil {
+		return ErasureReceipt{}, err
+	}
+
+	subjectHash, err := SubjectHash(store.keyring, username)
+	if err != nil {
+		return ErasureReceipt{}, err
+	}
+	receipt := ErasureReceipt{
+		SubjectHash: subjectHash,
+		// Postgres keeps microseconds, the hash must match the stored time
+		ErasedAt:      time.Now().UTC().Truncate(time.Microsecond),
+		EventsDeleted: len(events),
+	}
+	var version int64
+	err = store.sess.WithContext(ctx).Tx(func(tx db.Session) error {
+		res, err := tx.SQL().DeleteFrom(dbtable).Where("username = ?", username).Exec()
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		receipt.RowsDeleted = int(n)
+		if version, err = store.dialect.nextVersion(tx); err != nil {
+			return err
+		}
+
+		// concurrent erasures would otherwise chain to the same receipt
+		if err := store.dialect.lockReceipts(tx); err != nil {
+			return err
+		}
+		var prev ErasureReceipt
+		err = tx.SQL().SelectFrom(dbReceiptsTable).OrderBy("-id").Limit(1).One(&prev)
+		if err != nil && !common.IsDBErrorNoRows(err) {
+			return err
+		}
+		receipt.PrevHash = prev.Hash
+		receipt.Hash = receipt.computeHash()
+
+		inserted, err := tx.Collection(dbReceiptsTable).Insert(receipt)
+		if err != nil {
+			return err
+		}
+		receipt.ID, _ = inserted.ID().(int64)
+		return nil
+	})
+	if err != nil {
+		store.logger.Error("db error", zap.Error(err))
+		return ErasureReceipt{}, ErrUnexpectedDatabaseError
+	}
+	store.logger.Info("user erased", zap.Int64("receipt", receipt.ID), zap.String("hash", receipt.Hash))
+
+	if len(events) > 0 {
+		store.eraseEvents(username, receipt.ID)
+	}
+	// the user is dirty when the cache could not be written, and evicted once it recovers
+	if err := store.cache.setNotFound(ctx, username, version); err != nil {
+		store.logger.Warn("cache error", zap.Error(err))
+	}
+	if err := store.cache.invalidate(ctx, username); err != nil {
+		store.logger.Warn("cache error", zap.Error(err))
+	}
+	return receipt, nil
+}
+
+// eraseEvents deletes the events of an erased user, with a few attempts. It does
+// not use the context of the request, since the erasure is already committed.
+// Events which could not be erased are logged along with the receipt, so that
+// the erasure can be repeated.
+func (store *store) eraseEvents(username string, receiptID int64) {
+	ctx, cancel := context.WithTimeout(context.Background(), eventEraseTimeout)
+	defer cancel()
+
+	var err error
+	for attempt := 1; attempt <= eventEraseAttempts && ctx.Err() == nil; attempt++ {
+		if _, err = store.events.Erase(ctx, username); err == nil {
+			return
+		}
+		time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+	}
+	store.logger.Error("event erase error", zap.Int64("receipt", receiptID), zap.Error(err))
+}
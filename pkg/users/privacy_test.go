@@ -0,0 +1,219 @@
+package users
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/awhdesmond/user-service/docs"
+	"github.com/awhdesmond/user-service/pkg/api"
+	"github.com/awhdesmond/user-service/pkg/common"
+	"go.uber.org/zap"
+)
+
+func testReceiptChain(n int) []ErasureReceipt {
+	receipts := []ErasureReceipt{}
+	prevHash := ""
+	for i := 1; i <= n; i++ {
+		r := ErasureReceipt{
+			ID:          int64(i),
+			SubjectHash: "subject",
+			ErasedAt:    time.Date(2026, 10, i, 0, 0, 0, 0, time.UTC),
+			RowsDeleted: 1,
+			PrevHash:    prevHash,
+		}
+		r.Hash = r.computeHash()
+		prevHash = r.Hash
+		receipts = append(receipts, r)
+	}
+	return receipts
+}
+
+func TestVerifyErasureReceipts(t *testing.T) {
+	cases := []struct {
+		name   string
+		tamper func([]ErasureReceipt) []ErasureReceipt
+		want   error
+	}{
+		{
+			name:   "intact",
+			tamper: func(r []ErasureReceipt) []ErasureReceipt { return r },
+			want:   nil,
+		},
+		{
+			name: "edited",
+			tamper: func(r []ErasureReceipt) []ErasureReceipt {
+				r[1].EventsDeleted = 5
+				return r
+			},
+			want: ErrErasureReceiptTampered,
+		},
+		{
+			name: "edited and rehashed",
+			tamper: func(r []ErasureReceipt) []ErasureReceipt {
+				r[1].RowsDeleted = 0
+				r[1].Hash = r[1].computeHash()
+				return r
+			},
+			want: ErrErasureReceiptTampered,
+		},
+		{
+			name: "deleted",
+			tamper: func(r []ErasureReceipt) []ErasureReceipt {
+				return append(r[:1], r[2:]...)
+			},
+			want: ErrErasureReceiptTampered,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifyErasureReceipts(tt.tamper(testReceiptChain(3)))
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got = %v, want = %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubjectHash(t *testing.T) {
+	keyring := testKeyring(t)
+	hash, err := SubjectHash(keyring, "apple")
+	if err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	if again, _ := SubjectHash(keyring, "apple"); again != hash {
+		t.Fatalf("got = %v, want = %v", again, hash)
+	}
+
+	// hashing the username without the key does not find the subject
+	for _, guess := range []string{
+		sha256Hex("subject", "apple"),
+		sha256Hex("apple"),
+	} {
+		if guess == hash {
+			t.Fatalf("got = %v, want = %v", guess, "a hash which needs the key")
+		}
+	}
+	other, err := common.NewKeyring("other", map[string][]byte{"other": bytes.Repeat([]byte{3}, 32)}, bytes.Repeat([]byte{4}, 32))
+	if err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	if guess, _ := SubjectHash(other, "apple"); guess == hash {
+		t.Fatalf("got = %v, want = %v", guess, "a hash which needs the key")
+	}
+
+	// without a keyring, receipts of the same user cannot be linked
+	first, _ := SubjectHash(nil, "apple")
+	second, _ := SubjectHash(nil, "apple")
+	if first == "" || first == second {
+		t.Fatalf("got = %v, %v, want = %v", first, second, "two random IDs")
+	}
+}
+
+func TestExportAndErase(t *testing.T) {
+	logger, _ := common.InitZap("debug")
+	openapi, err := api.NewOpenAPI(docs.OpenAPISpec, logger)
+	if err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	validationMW := api.NewOpenAPIValidationMiddleware(openapi, api.OpenAPIConfig{ValidateResponses: true})
+
+	store := mapStore{}
+	handler := validationMW.Handler(MakeHandler(NewService(store, testTimeFn)))
+	store.Upsert(context.Background(), "apple", time.Date(2000, 6, 1, 0, 0, 0, 0, time.UTC))
+
+	w := common.TestSendReq(nil, apiPrefix+"/apple/export", http.MethodGet, handler)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got = %v, want = %v", w.Code, http.StatusOK)
+	}
+	var exportResp ExportResponse
+	if err := json.NewDecoder(w.Body).Decode(&exportResp); err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	if exportResp.Export == nil || exportResp.Export.User == nil || exportResp.Export.User.Username != "apple" {
+		t.Fatalf("got = %v, want = %v", exportResp.Export, "export of apple")
+	}
+
+	w = common.TestSendReq(nil, apiPrefix+"/apple/erase", http.MethodPost, handler)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got = %v, want = %v", w.Code, http.StatusOK)
+	}
+	var eraseResp EraseResponse
+	if err := json.NewDecoder(w.Body).Decode(&eraseResp); err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	if eraseResp.Receipt == nil || eraseResp.Receipt.SubjectHash == "" || eraseResp.Receipt.RowsDeleted != 1 {
+		t.Fatalf("got = %v, want = %v", eraseResp.Receipt, "receipt of apple")
+	}
+
+	w = common.TestSendReq(nil, apiPrefix+"/apple/export", http.MethodGet, handler)
+	common.TestIsResponseErrorExpected(w, t, ErrUserNotFound.Error())
+}
+
+// failingEventBroker fails to erase events the first failures times
+type failingEventBroker struct {
+	EventBroker
+	failures int
+}
+
+func (b *failingEventBroker) Erase(ctx context.Context, username string) (int, error) {
+	if b.failures > 0 {
+		b.failures--
+		return 0, ErrUnexpectedDatabaseError
+	}
+	return b.EventBroker.Erase(ctx, username)
+}
+
+func TestStoreErase(t *testing.T) {
+	ctx := context.Background()
+	sess, err := common.TestMakeSQLiteDBSession(t.TempDir())
+	if err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	events := &failingEventBroker{EventBroker: NewMemoryEventBroker(), failures: 1}
+	store := newStore(sess, sqliteDialect{}, testUnavailableRedis(), events, StoreConfig{}, zap.NewNop())
+	defer store.Close(ctx)
+
+	dob := time.Date(2000, 6, 1, 0, 0, 0, 0, time.UTC)
+	if err := store.Upsert(ctx, "apple", dob); err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+
+	// the receipt is returned once committed, although the cache is unavailable
+	// and the events are only erased on the second attempt
+	receipt, err := store.Erase(ctx, "apple")
+	if err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	if receipt.RowsDeleted != 1 || receipt.EventsDeleted != 1 {
+		t.Fatalf("got = %v, want = %v", receipt, "1 row and 1 event deleted")
+	}
+	if history, _ := events.History(ctx, "apple"); len(history) != 0 {
+		t.Fatalf("got = %v, want = %v", history, "no events")
+	}
+	if !store.cache.dirty["apple"] {
+		t.Fatalf("got = %v, want = %v", store.cache.dirty, "apple dirty")
+	}
+
+	// the events are kept when the erasure is not committed
+	if err := store.Upsert(ctx, "banana", dob); err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	if _, err := sess.SQL().Exec("DROP TABLE " + dbReceiptsTable); err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	if _, err := store.Erase(ctx, "banana"); err != ErrUnexpectedDatabaseError {
+		t.Fatalf("got = %v, want = %v", err, ErrUnexpectedDatabaseError)
+	}
+	if history, _ := events.History(ctx, "banana"); len(history) != 1 {
+		t.Fatalf("got = %v, want = %v", history, "the created event of banana")
+	}
+	if _, _, err := store.readDB(ctx, "banana"); err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+}
@@ -0,0 +1,39 @@
+package users
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// seedUser is an entry of a seed file. The date of birth has the same
+// layout as in upsert requests.
+type seedUser struct {
+	Username string `json:"username"`
+	DoB      string `json:"dateOfBirth"`
+}
+
+// SeedFromFile upserts the users of a JSON file such as
+//
+//	[{"username": "apple", "dateOfBirth": "2000-01-02"}]
+//
+// through svc, so that they are validated like any other write.
+// It returns the number of users upserted.
+func SeedFromFile(ctx context.Context, svc Service, path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var seed []seedUser
+	if err := json.Unmarshal(data, &seed); err != nil {
+		return 0, err
+	}
+
+	for i, usr := range seed {
+		if err := svc.Upsert(ctx, usr.Username, usr.DoB); err != nil {
+			return i, fmt.Errorf("seed user %d: %w", i, err)
+		}
+	}
+	return len(seed), nil
+}
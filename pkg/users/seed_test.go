@@ -0,0 +1,55 @@
+package users
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestSeedFromFile(t *testing.T) {
+	cases := []struct {
+		name    string
+		seed    string
+		want    int
+		wantErr bool
+	}{
+		{
+			name: "basic",
+			seed: `[{"username": "apple", "dateOfBirth": "2000-01-02"}, {"username": "pear", "dateOfBirth": "2001-02-03"}]`,
+			want: 2,
+		},
+		{
+			name:    "invalid user",
+			seed:    `[{"username": "apple", "dateOfBirth": "2000-01-02"}, {"username": "pear1", "dateOfBirth": "2001-02-03"}]`,
+			want:    1,
+			wantErr: true,
+		},
+		{
+			name:    "invalid json",
+			seed:    `{"username": "apple"}`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "seed.json")
+			if err := os.WriteFile(path, []byte(tt.seed), 0o600); err != nil {
+				t.Fatalf("got = %v, want = %v", err, nil)
+			}
+			store := NewMemoryStore(NewMemoryEventBroker(), zap.NewNop())
+
+			n, err := SeedFromFile(context.Background(), NewDefaultService(store), path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got = %v, want error = %v", err, tt.wantErr)
+			}
+			usrs, _ := store.List(context.Background())
+			if n != tt.want || len(usrs) != tt.want {
+				t.Fatalf("got = %v, %v, want = %v", n, len(usrs), tt.want)
+			}
+		})
+	}
+}
@@ -3,6 +3,8 @@ package users
 import (
 	"context"
 	"errors"
+	"fmt"
+	"sort"
 	"time"
 
 	"github.com/awhdesmond/user-service/pkg/common"
@@ -10,6 +12,10 @@ import (
 
 const (
 	MaxYears = 150
+	// MaxUpcomingDays is the widest window of upcoming birthdays
+	MaxUpcomingDays = 366
+
+	teamCalendarName = "Birthdays"
 )
 
 var (
@@ -18,11 +24,19 @@ var (
 	ErrDoBFutureUsed              = errors.New("a date of birth in the future is used")
 	ErrDoBTooOld                  = errors.New("date of birth is too old")
 	ErrDoBInvalid                 = errors.New("invalid date of birth")
+	ErrDaysInvalid                = errors.New("days must be between 0 and 366")
 )
 
 type Service interface {
 	Upsert(ctx context.Context, username, dob string) error
 	Read(ctx context.Context, username string) (string, error)
+	Delete(ctx context.Context, username string) error
+	List(ctx context.Context) ([]User, error)
+	Upcoming(ctx context.Context, days int) ([]UpcomingBirthday, error)
+	BirthdayCalendar(ctx context.Context, username string) (string, error)
+	BirthdaysCalendar(ctx context.Context) (string, error)
+	Export(ctx context.Context, username string) (UserExport, error)
+	Erase(ctx context.Context, username string) (ErasureReceipt, error)
 }
 
 type service struct {
@@ -85,3 +99,84 @@ func (svc *service) Read(ctx context.Context, username string) (string, error) {
 
 	return user.GenerateDobMessage(svc.nowFn), nil
 }
+
+// Delete removes the user from the database
+func (svc *service) Delete(ctx context.Context, username string) error {
+	if err := svc.validateUsername(username); err != nil {
+		return err
+	}
+	return svc.store.Delete(ctx, username)
+}
+
+// List retrieves all users
+func (svc *service) List(ctx context.Context) ([]User, error) {
+	return svc.store.List(ctx)
+}
+
+// Upcoming retrieves the users whose birthday is within the given number of days,
+// ordered by the number of days to their birthday
+func (svc *service) Upcoming(ctx context.Context, days int) ([]UpcomingBirthday, error) {
+	if days < 0 || days > MaxUpcomingDays {
+		return nil, ErrDaysInvalid
+	}
+
+	today := svc.nowFn()
+	// Start a day early: Feb 29 birthdays are celebrated on Mar 1 in non-leap years
+	usrs, err := svc.store.ListByBirthday(ctx, today.AddDate(0, 0, -1), today.AddDate(0, 0, days))
+	if err != nil {
+		return nil, err
+	}
+
+	upcoming := []UpcomingBirthday{}
+	for _, u := range usrs {
+		d := u.CalcDaysToBirthday(svc.nowFn)
+		if d <= days {
+			upcoming = append(upcoming, UpcomingBirthday{User: u, DaysToBirthday: d})
+		}
+	}
+	sort.SliceStable(upcoming, func(i, j int) bool {
+		return upcoming[i].DaysToBirthday < upcoming[j].DaysToBirthday
+	})
+	return upcoming, nil
+}
+
+// BirthdayCalendar generates an iCalendar feed with the user's birthday
+func (svc *service) BirthdayCalendar(ctx context.Context, username string) (string, error) {
+	if err := svc.validateUsername(username); err != nil {
+		return "", err
+	}
+
+	user, err := svc.store.Read(ctx, username)
+	if err != nil {
+		return "", err
+	}
+
+	return GenerateCalendar(fmt.Sprintf("%s's birthday", user.Username), []User{user}, svc.nowFn), nil
+}
+
+// BirthdaysCalendar generates an iCalendar feed with the birthdays of all users
+func (svc *service) BirthdaysCalendar(ctx context.Context) (string, error) {
+	usrs, err := svc.store.List(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return GenerateCalendar(teamCalendarName, usrs, svc.nowFn), nil
+}
+
+// Export retrieves every piece of data held about the user
+func (svc *service) Export(ctx context.Context, username string) (UserExport, error) {
+	if err := svc.validateUsername(username); err != nil {
+		return UserExport{}, err
+	}
+	return svc.store.Export(ctx, username)
+}
+
+// Erase removes every piece of data held about the user
+// and returns the receipt of the erasure
+func (svc *service) Erase(ctx context.Context, username string) (ErasureReceipt, error) {
+	if err := svc.validateUsername(username); err != nil {
+		return ErasureReceipt{}, err
+	}
+	return svc.store.Erase(ctx, username)
+}
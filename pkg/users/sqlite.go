@@ -0,0 +1,83 @@
+package users
+
+import (
+	"context"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/upper/db/v4"
+	"go.uber.org/zap"
+)
+
+const (
+	StoreBackendSQLite = "sqlite"
+)
+
+// sqliteDialect runs the store on SQLite, e.g. on a single small VM.
+// The schema is in db/sqlite/migrations.
+type sqliteDialect struct{}
+
+// upsert checks whether the user exists in the same transaction,
+// since SQLite has no equivalent of xmax.
+func (d sqliteDialect) upsert(ctx context.Context, sess db.Session, usrRow userRow) (bool, int64, error) {
+	inserted := false
+	var version int64
+	err := sess.WithContext(ctx).Tx(func(tx db.Session) error {
+		n, err := tx.Collection(dbtable).Find("username", usrRow.Username).Count()
+		if err != nil {
+			return err
+		}
+		inserted = n == 0
+		if version, err = d.nextVersion(tx); err != nil {
+			return err
+		}
+
+		_, err = tx.SQL().Exec(`
+			INSERT INTO users (username, date_of_birth, date_of_birth_enc, dob_key_id, birthday_index, version)
+			VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT(username)
+			DO UPDATE SET
+				date_of_birth = excluded.date_of_birth,
+				date_of_birth_enc = excluded.date_of_birth_enc,
+				dob_key_id = excluded.dob_key_id,
+				birthday_index = excluded.birthday_index,
+				version = excluded.version
+		`, usrRow.Username, usrRow.DoB, usrRow.DoBEnc, usrRow.DoBKeyID, usrRow.BirthdayIndex, version)
+		return err
+	})
+	return inserted, version, err
+}
+
+// nextVersion increments the version in user_versions, which is kept
+// locked until tx ends.
+func (sqliteDialect) nextVersion(tx db.Session) (int64, error) {
+	row, err := tx.SQL().QueryRow(`UPDATE user_versions SET version = version + 1 RETURNING version`)
+	if err != nil {
+		return 0, err
+	}
+	var version int64
+	err = row.Scan(&version)
+	return version, err
+}
+
+func (sqliteDialect) monthDay() string {
+	return "strftime('%m-%d', date_of_birth)"
+}
+
+// lockReceipts does nothing, the session has a single
+// connection so that transactions are serialised already.
+func (sqliteDialect) lockReceipts(db.Session) error {
+	return nil
+}
+
+// NewSQLiteStore returns a store on a SQLite session such as the one
+// of common.MakeSQLiteDBSession. Redis is optional: when rdb is nil,
+// users are only cached in the local tier.
+func NewSQLiteStore(
+	sess db.Session,
+	rdb redis.UniversalClient,
+	events EventBroker,
+	cfg StoreConfig,
+	logger *zap.Logger,
+) Store {
+	return newStore(sess, sqliteDialect{}, rdb, events, cfg, logger)
+}
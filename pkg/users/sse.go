@@ -0,0 +1,80 @@
+package users
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/awhdesmond/user-service/pkg/common"
+	"go.uber.org/zap"
+)
+
+const (
+	URLQueryPrefix = "prefix"
+
+	headerLastEventID = "Last-Event-ID"
+
+	// sseKeepAliveInterval keeps idle connections open through proxies
+	sseKeepAliveInterval = 15 * time.Second
+	// sseRetry is the reconnection delay sent to clients, in milliseconds
+	sseRetry = 3000
+)
+
+// MakeEventsHandler streams user events as server-sent events.
+// Events can be filtered by username prefix with the "prefix" query parameter,
+// and clients resume from the last event they received with the Last-Event-ID header.
+func MakeEventsHandler(broker EventBroker, logger *zap.Logger) http.Handler {
+	logger = logger.Named(eventsLoggerName)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			common.EncodeErrorFactory(errToHttpCode)(r.Context(), common.ErrStreamingUnsupported, w)
+			return
+		}
+
+		prefix := r.URL.Query().Get(URLQueryPrefix)
+		events, err := broker.Subscribe(r.Context(), r.Header.Get(headerLastEventID))
+		if err != nil {
+			common.EncodeErrorFactory(errToHttpCode)(r.Context(), err, w)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "retry: %d\n\n", sseRetry)
+		flusher.Flush()
+
+		keepAlive := time.NewTicker(sseKeepAliveInterval)
+		defer keepAlive.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-keepAlive.C:
+				fmt.Fprint(w, ": keep-alive\n\n")
+				flusher.Flush()
+			case evt, ok := <-events:
+				if !ok {
+					// the client is expected to reconnect with Last-Event-ID
+					return
+				}
+				if !strings.HasPrefix(evt.Username, prefix) {
+					continue
+				}
+				data, err := json.Marshal(evt)
+				if err != nil {
+					logger.Error("event marshal error", zap.Error(err))
+					continue
+				}
+				fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", evt.ID, evt.Type, data)
+				flusher.Flush()
+			}
+		}
+	})
+}
@@ -2,120 +2,489 @@ package users
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
-	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/awhdesmond/user-service/pkg/common"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/redis/go-redis/v9"
 	"github.com/upper/db/v4"
 	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
 )
 
 const (
-	dbtable    = "users"
-	loggerName = "users.store"
+	dbtable        = "users"
+	loggerName     = "users.store"
+	monthDayLayout = "01-02"
 )
 
 var (
 	ErrUserNotFound            = errors.New("username not found")
 	ErrUnexpectedDatabaseError = errors.New("unexpected error")
+	ErrStoreBackendInvalid     = errors.New("store must be postgres, sqlite or memory")
 
 	DefaultCacheTTL = 10 * time.Minute
+	// DefaultLocalCacheTTL is short so that replicas which miss an
+	// invalidation message do not serve stale data for long.
+	DefaultLocalCacheTTL = 5 * time.Second
+	// DefaultNotFoundCacheTTL is short, since a username may be taken at any time
+	DefaultNotFoundCacheTTL = 30 * time.Second
+
+	userLoads = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: "store",
+		Name:      "user_loads_total",
+		Help:      "users read from the database because they were not cached",
+	})
 )
 
+func init() {
+	prometheus.MustRegister(userLoads)
+}
+
 type Store interface {
 	Upsert(ctx context.Context, username string, dob time.Time) error
 	Read(ctx context.Context, username string) (User, error)
+	List(ctx context.Context) ([]User, error)
+	ListByBirthday(ctx context.Context, from, to time.Time) ([]User, error)
+	Delete(ctx context.Context, username string) error
+	Export(ctx context.Context, username string) (UserExport, error)
+	// Erase removes every piece of data held about the user and records a receipt.
+	Erase(ctx context.Context, username string) (ErasureReceipt, error)
+	// Close waits for the pending cache writes, or until ctx is done, and stops
+	// the background tasks of the store.
+	Close(ctx context.Context) error
 }
 
-type store struct {
-	sess   db.Session
-	rdb    redis.UniversalClient
-	logger *zap.Logger
+// CacheHealthChecker is implemented by the stores which cache users in Redis
+type CacheHealthChecker interface {
+	CacheHealth() error
 }
 
-func NewStore(sess db.Session, rdb redis.UniversalClient, logger *zap.Logger) Store {
-	return &store{sess, rdb, logger.Named(loggerName)}
+// StoreConfig configures the backend and the caching behaviour of the store.
+type StoreConfig struct {
+	// Backend is postgres, sqlite, or memory to run without a database and Redis
+	Backend string `mapstructure:"store"`
+	// SeedFile is a JSON file of users upserted on startup, see SeedFromFile
+	SeedFile string `mapstructure:"store-seed-file"`
+
+	// LocalCacheSize is the maximum number of users kept in the in-process
+	// cache in front of Redis. The in-process cache is disabled when it is 0.
+	LocalCacheSize int           `mapstructure:"local-cache-size"`
+	LocalCacheTTL  time.Duration `mapstructure:"local-cache-ttl"`
+	// NotFoundCacheTTL is how long usernames which do not exist are cached
+	NotFoundCacheTTL time.Duration `mapstructure:"not-found-cache-ttl"`
+	// BloomFilterInterval is how often the Bloom filter of the existing
+	// usernames is rebuilt. The filter is disabled when it is 0.
+	BloomFilterInterval time.Duration `mapstructure:"bloom-filter-interval"`
+	// CacheWriteWorkers write the users read from the DB to the cache, from a
+	// queue of CacheWriteQueueSize users. Each write times out after CacheWriteTimeout.
+	CacheWriteWorkers   int           `mapstructure:"cache-write-workers"`
+	CacheWriteQueueSize int           `mapstructure:"cache-write-queue-size"`
+	CacheWriteTimeout   time.Duration `mapstructure:"cache-write-timeout"`
+	// CacheCodec is json or msgpack, and CacheCompression none or zstd. They
+	// only apply to the values written to Redis, every format can be read.
+	CacheCodec       string `mapstructure:"cache-codec"`
+	CacheCompression string `mapstructure:"cache-compression"`
+	// Keyring encrypts the date of birth in Postgres and the users cached
+	// in Redis. They are stored in plaintext when it is nil.
+	Keyring *common.Keyring `mapstructure:"-"`
+	// Replicas serve the reads which tolerate replication lag, such as
+	// List, unless the context reads from the primary (see common.WithPrimary)
+	Replicas []db.Session `mapstructure:"-"`
 }
 
-func (store *store) rdbUserKey(username string) string {
-	return fmt.Sprintf("user_service:username:%s", username)
+// Validate checks the cache codec and compression, and makes the zstd coders
+// when values are compressed. Empty values are the defaults.
+func (cfg StoreConfig) Validate() error {
+	if _, ok := cacheCodecs[cfg.CacheCodec]; !ok && cfg.CacheCodec != "" {
+		return ErrCacheCodecInvalid
+	}
+	switch cfg.CacheCompression {
+	case "", CacheCompressionNone:
+		return nil
+	case CacheCompressionZstd:
+		_, _, err := zstdCoders()
+		return err
+	}
+	return ErrCacheCompressionInvalid
+}
+
+// dialect has the queries which differ between the SQL databases of the store
+type dialect interface {
+	// upsert inserts or updates the row with the next version, and reports
+	// whether it was inserted along with its version
+	upsert(ctx context.Context, sess db.Session, row userRow) (bool, int64, error)
+	// nextVersion returns the next version of the users, which is higher than
+	// the version of every user written before, including deleted ones
+	nextVersion(tx db.Session) (int64, error)
+	// monthDay is the SQL expression of the MM-DD of date_of_birth
+	monthDay() string
+	// lockReceipts prevents concurrent erasures from chaining to the same receipt
+	lockReceipts(tx db.Session) error
+}
+
+type postgresDialect struct{}
+
+// upsert takes the next version while it holds the lock of the row, so that
+// concurrent upserts of a user commit in the order of their versions.
+func (postgresDialect) upsert(ctx context.Context, sess db.Session, usrRow userRow) (bool, int64, error) {
+	// xmax is 0 for a freshly inserted row
+	row, err := sess.WithContext(ctx).SQL().QueryRow(`
+		INSERT INTO users (username, date_of_birth, date_of_birth_enc, dob_key_id, birthday_index)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(username)
+		DO UPDATE SET
+			date_of_birth = EXCLUDED.date_of_birth,
+			date_of_birth_enc = EXCLUDED.date_of_birth_enc,
+			dob_key_id = EXCLUDED.dob_key_id,
+			birthday_index = EXCLUDED.birthday_index,
+			version = nextval('users_version_seq')
+		RETURNING (xmax = 0) AS inserted, version
+	`, usrRow.Username, usrRow.DoB, usrRow.DoBEnc, usrRow.DoBKeyID, usrRow.BirthdayIndex)
+	if err != nil {
+		return false, 0, err
+	}
+	var inserted bool
+	var version int64
+	err = row.Scan(&inserted, &version)
+	return inserted, version, err
 }
 
-func (store *store) writeToCache(ctx context.Context, usr User) error {
-	data, err := json.Marshal(usr)
+func (postgresDialect) nextVersion(tx db.Session) (int64, error) {
+	row, err := tx.SQL().QueryRow(`SELECT nextval('users_version_seq')`)
 	if err != nil {
-		store.logger.Error("redis marshal error", zap.Error(err))
+		return 0, err
+	}
+	var version int64
+	err = row.Scan(&version)
+	return version, err
+}
+
+func (postgresDialect) monthDay() string {
+	return "to_char(date_of_birth, 'MM-DD')"
+}
+
+func (postgresDialect) lockReceipts(tx db.Session) error {
+	_, err := tx.SQL().Exec(`LOCK TABLE erasure_receipts IN EXCLUSIVE MODE`)
+	return err
+}
+
+type store struct {
+	sess     db.Session
+	replicas []db.Session
+	next     atomic.Uint32
+	loads    singleflight.Group
+	// usernames is nil when the Bloom filter is disabled
+	usernames *usernameFilter
+	dialect   dialect
+	cache     *cache
+	writer    *cacheWriter
+	events    EventBroker
+	keyring   *common.Keyring
+	logger    *zap.Logger
+	// cancel stops the background tasks of the store
+	cancel context.CancelFunc
+}
+
+func NewStore(
+	sess db.Session,
+	rdb redis.UniversalClient,
+	events EventBroker,
+	cfg StoreConfig,
+	logger *zap.Logger,
+) Store {
+	return newStore(sess, postgresDialect{}, rdb, events, cfg, logger)
+}
+
+func newStore(
+	sess db.Session,
+	dialect dialect,
+	rdb redis.UniversalClient,
+	events EventBroker,
+	cfg StoreConfig,
+	logger *zap.Logger,
+) *store {
+	logger = logger.Named(loggerName)
+	ctx, cancel := context.WithCancel(context.Background())
+	store := &store{
+		sess:     sess,
+		replicas: cfg.Replicas,
+		dialect:  dialect,
+		cache:    newCache(ctx, rdb, cfg, logger),
+		writer:   newCacheWriter(cfg, logger),
+		events:   events,
+		keyring:  cfg.Keyring,
+		logger:   logger,
+		cancel:   cancel,
+	}
+	if cfg.BloomFilterInterval > 0 {
+		// rebuilds which fail for two intervals stop the filter from rejecting usernames
+		store.usernames = newUsernameFilter(2*cfg.BloomFilterInterval, rdb != nil)
+		go store.rebuildUsernameFilter(ctx, cfg.BloomFilterInterval)
+		if rdb != nil {
+			go store.watchUsernames(ctx, rdb)
+		}
+	}
+	return store
+}
+
+func (store *store) Close(ctx context.Context) error {
+	store.cancel()
+	return store.writer.close(ctx)
+}
+
+// query runs a read on the next replica, round robin, or on the primary when
+// there is no replica or ctx reads from the primary. A read which fails on a
+// replica is retried on the primary.
+func (store *store) query(ctx context.Context, read func(sess db.Session) error) error {
+	if len(store.replicas) == 0 || common.UsePrimary(ctx) {
+		return read(store.sess.WithContext(ctx))
+	}
+	replica := store.replicas[int(store.next.Add(1)-1)%len(store.replicas)]
+	err := read(replica.WithContext(ctx))
+	if err == nil || common.IsDBErrorNoRows(err) || ctx.Err() != nil {
 		return err
 	}
-	cmd := store.rdb.Set(ctx, store.rdbUserKey(usr.Username), data, DefaultCacheTTL)
-	if cmd.Err() != nil {
-		store.logger.Error("cache error", zap.Error(cmd.Err()))
-		return ErrUnexpectedDatabaseError
+	store.logger.Warn("replica error", zap.Error(err))
+	return read(store.sess.WithContext(ctx))
+}
+
+// publish emits a user event. The change has already been committed,
+// so a failure is logged rather than returned to the caller.
+func (store *store) publish(ctx context.Context, evtType EventType, username string) {
+	evt := Event{Type: evtType, Username: username, Time: time.Now().UTC()}
+	if err := store.events.Publish(ctx, evt); err != nil {
+		store.logger.Warn("event error", zap.Error(err))
 	}
-	return nil
 }
 
 // Upsert saves the username along with the date of a birth of a user. It also
-// implements the write-through cache policy to save the information to redis.
+// implements the write-through cache policy to save the information to redis,
+// evicts the user from the local cache of every replica and emits a
+// created or updated event. It succeeds when the cache is unavailable, in
+// which case the user is evicted from the cache once it recovers.
 func (store *store) Upsert(ctx context.Context, username string, dob time.Time) error {
-	_, err := store.sess.WithContext(ctx).SQL().Query(`
-		INSERT INTO users (username, date_of_birth)
-		VALUES (?, ?)
-		ON CONFLICT(username)
-		DO UPDATE SET
-			date_of_birth = EXCLUDED.date_of_birth
-	`, username, dob)
+	usrRow, err := encodeRow(store.keyring, User{Username: username, DoB: dob})
+	if err != nil {
+		store.logger.Error("encrypt error", zap.Error(err))
+		return ErrUnexpectedDatabaseError
+	}
+
+	inserted, version, err := store.dialect.upsert(ctx, store.sess, usrRow)
 	if err != nil {
 		store.logger.Error("db error", zap.Error(err))
 		return ErrUnexpectedDatabaseError
 	}
 
-	return store.writeToCache(ctx, User{Username: username, DoB: dob})
+	evtType := EventUserUpdated
+	if inserted {
+		evtType = EventUserCreated
+	}
+	store.usernames.add(username)
+	store.publish(ctx, evtType, username)
+
+	if err := store.cache.set(ctx, User{Username: username, DoB: dob}, version); err != nil {
+		store.logger.Warn("cache error", zap.Error(err))
+	}
+	// evicts the local tier even when redis could not be written, in which
+	// case the user is dirty and the other replicas are invalidated on repair
+	if err := store.cache.invalidate(ctx, username); err != nil {
+		store.logger.Warn("cache error", zap.Error(err))
+	}
+	return nil
 }
 
-// Read retrieves the user from the cache (if it exists), else from the DB.
-// It saves the information to the cache when the cache does not have it.
+// Read retrieves the user from the local cache or redis (if it exists), else from the DB.
+// It saves the information to the cache when the cache does not have it, and
+// refreshes users which are about to expire from the cache in the background.
+// Usernames which are cached as not found, or are not in the Bloom filter,
+// do not reach the DB.
 func (store *store) Read(ctx context.Context, username string) (User, error) {
-	var usr User
-
-	rdbUserKey := store.rdbUserKey(username)
-	cmd := store.rdb.Get(ctx, rdbUserKey)
-	if cmd.Err() != nil {
-		// unexpected error
-		if !errors.Is(cmd.Err(), redis.Nil) {
-			store.logger.Error("cache error", zap.Error(cmd.Err()))
-			return User{}, ErrUnexpectedDatabaseError
-		}
-		// else is key not found, so just fallthrough
-	} else {
-		// Key is found, return from cache
-		if err := json.Unmarshal([]byte(cmd.Val()), &usr); err != nil {
-			// dirty data in cache, refetch from db
-			store.rdb.Del(ctx, rdbUserKey)
-		} else {
-			return usr, nil
+	usr, refresh, err := store.cache.get(ctx, username)
+	if err == nil {
+		if refresh {
+			store.load(ctx, username)
 		}
+		return usr, nil
+	}
+	if !errors.Is(err, errCacheMiss) {
+		return User{}, err
+	}
+	if !store.usernames.mayContain(username) {
+		return User{}, ErrUserNotFound
 	}
 
 	// Key is not found in cache, fetch from db
-	q := store.sess.WithContext(ctx).SQL().SelectFrom(dbtable).Where("username = ?", username)
-	err := q.One(&usr)
+	select {
+	case res := <-store.load(ctx, username):
+		if res.Err != nil {
+			return User{}, res.Err
+		}
+		return res.Val.(User), nil
+	case <-ctx.Done():
+		return User{}, ctx.Err()
+	}
+}
+
+// load reads the user from the DB and queues the write of it, or that it was
+// not found, to the cache. Concurrent loads of a user are coalesced into a single query,
+// which is not cancelled along with the request that started it since other
+// requests may wait for it.
+func (store *store) load(ctx context.Context, username string) <-chan singleflight.Result {
+	key := username
+	if common.UsePrimary(ctx) {
+		// reads from the primary must not wait for a read from a replica
+		key = "primary:" + username
+	}
+	return store.loads.DoChan(key, func() (interface{}, error) {
+		usr, version, err := store.readDB(detachedContext{ctx}, username)
+		if err != nil && !errors.Is(err, ErrUserNotFound) {
+			return nil, err
+		}
+		// the versions keep the cache from moving back to what this read saw,
+		// if a concurrent write updates it first
+		if err == nil {
+			store.writer.enqueue(username, func(ctx context.Context) error {
+				return store.cache.set(ctx, usr, version)
+			})
+		} else {
+			store.writer.enqueue(username, func(ctx context.Context) error {
+				return store.cache.setNotFound(ctx, username, notFoundVersion)
+			})
+		}
+		return usr, err
+	})
+}
+
+// readDB reads the user and its version from the DB, bypassing the cache
+func (store *store) readDB(ctx context.Context, username string) (User, int64, error) {
+	userLoads.Inc()
+	var row userRow
+	err := store.query(ctx, func(sess db.Session) error {
+		return sess.SQL().SelectFrom(dbtable).Where("username = ?", username).One(&row)
+	})
 
 	if common.IsDBErrorNoRows(err) {
-		return User{}, ErrUserNotFound
+		return User{}, 0, ErrUserNotFound
 	}
 	if err != nil {
 		store.logger.Error("db error", zap.Error(err))
-		return User{}, ErrUnexpectedDatabaseError
+		return User{}, 0, ErrUnexpectedDatabaseError
 	}
+	usr, err := decodeRow(store.keyring, row)
+	if err != nil {
+		store.logger.Error("decrypt error", zap.Error(err))
+		return User{}, 0, ErrUnexpectedDatabaseError
+	}
+	return usr, row.Version, nil
+}
 
-	go func() {
-		if err := store.writeToCache(context.Background(), usr); err != nil {
-			store.logger.Warn("cache error", zap.Error(err))
+// detachedContext keeps the values of its parent, such as whether to read
+// from the primary, but not its deadline and cancellation
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// List retrieves all users from the DB ordered by username.
+func (store *store) List(ctx context.Context) ([]User, error) {
+	rows := []userRow{}
+	err := store.query(ctx, func(sess db.Session) error {
+		return sess.SQL().SelectFrom(dbtable).OrderBy("username").All(&rows)
+	})
+	if err != nil {
+		store.logger.Error("db error", zap.Error(err))
+		return nil, ErrUnexpectedDatabaseError
+	}
+	return store.decodeRows(rows)
+}
+
+// ListByBirthday retrieves the users whose birthday (month and day) is
+// between from and to inclusive, ordered by username. The range wraps
+// around the end of the year when to is in the following year.
+//
+// Encrypted rows are matched by the blind indexes of every month and day
+// in the range, plaintext rows by their date of birth.
+func (store *store) ListByBirthday(ctx context.Context, from, to time.Time) ([]User, error) {
+	fromMD, toMD := from.Format(monthDayLayout), to.Format(monthDayLayout)
+	md := store.dialect.monthDay()
+	cond, args := "", []interface{}{}
+	switch {
+	case !to.Before(from.AddDate(1, 0, 0)):
+		// the range covers the whole year
+	case fromMD <= toMD:
+		cond = md + " BETWEEN ? AND ?"
+	default:
+		cond = md + " >= ? OR " + md + " <= ?"
+	}
+	if cond != "" && store.keyring == nil {
+		args = append(args, cond, fromMD, toMD)
+	} else if cond != "" {
+		args = append(args, "("+cond+") OR birthday_index IN ?", fromMD, toMD, store.birthdayIndexes(fromMD, toMD))
+	}
+
+	rows := []userRow{}
+	err := store.query(ctx, func(sess db.Session) error {
+		q := sess.SQL().SelectFrom(dbtable).OrderBy("username")
+		if len(args) > 0 {
+			q = q.Where(args...)
 		}
-	}()
-	return usr, nil
+		return q.All(&rows)
+	})
+	if err != nil {
+		store.logger.Error("db error", zap.Error(err))
+		return nil, ErrUnexpectedDatabaseError
+	}
+	return store.decodeRows(rows)
+}
+
+// Delete removes the user from the DB, caches it as not found with a new
+// version, and emits a deleted event. Like Upsert, it succeeds when the cache
+// is unavailable.
+func (store *store) Delete(ctx context.Context, username string) error {
+	var version int64
+	err := store.sess.WithContext(ctx).Tx(func(tx db.Session) error {
+		res, err := tx.SQL().DeleteFrom(dbtable).Where("username = ?", username).Exec()
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrUserNotFound
+		}
+		version, err = store.dialect.nextVersion(tx)
+		return err
+	})
+	if errors.Is(err, ErrUserNotFound) {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		store.logger.Error("db error", zap.Error(err))
+		return ErrUnexpectedDatabaseError
+	}
+
+	store.publish(ctx, EventUserDeleted, username)
+
+	// the local tiers are evicted even when Redis could not be written
+	if err := store.cache.setNotFound(ctx, username, version); err != nil {
+		store.logger.Warn("cache error", zap.Error(err))
+	}
+	if err := store.cache.invalidate(ctx, username); err != nil {
+		store.logger.Warn("cache error", zap.Error(err))
+	}
+	return nil
+}
+
+// CacheHealth returns ErrCacheUnavailable while the circuit breaker around
+// Redis is open, i.e. while reads bypass the cache.
+func (store *store) CacheHealth() error {
+	return store.cache.health()
 }
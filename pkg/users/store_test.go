@@ -0,0 +1,249 @@
+package users
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/awhdesmond/user-service/pkg/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/upper/db/v4"
+	"go.uber.org/zap"
+)
+
+func TestStoreReplicas(t *testing.T) {
+	ctx := context.Background()
+	sessions := []db.Session{}
+	for i := 0; i < 2; i++ {
+		sess, err := common.TestMakeSQLiteDBSession(t.TempDir())
+		if err != nil {
+			t.Fatalf("got = %v, want = %v", err, nil)
+		}
+		sessions = append(sessions, sess)
+	}
+	primary, replica := sessions[0], sessions[1]
+
+	// the replica lags: it never receives the writes of the primary
+	cfg := StoreConfig{Replicas: []db.Session{replica}}
+	store := NewSQLiteStore(primary, nil, NewMemoryEventBroker(), cfg, zap.NewNop())
+	if err := store.Upsert(ctx, "apple", time.Date(2000, 1, 2, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+
+	if usrs, err := store.List(ctx); err != nil || len(usrs) != 0 {
+		t.Fatalf("got = %v, %v, want = %v", usrs, err, "users of the replica")
+	}
+	if _, err := store.Read(ctx, "apple"); err != ErrUserNotFound {
+		t.Fatalf("got = %v, want = %v", err, ErrUserNotFound)
+	}
+
+	primaryCtx := common.WithPrimary(ctx)
+	if usrs, err := store.List(primaryCtx); err != nil || len(usrs) != 1 {
+		t.Fatalf("got = %v, %v, want = %v", usrs, err, "users of the primary")
+	}
+	if _, err := store.Read(primaryCtx, "apple"); err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+
+	// reads fall back to the primary when the replica fails
+	broken, err := common.MakeSQLiteDBSession(common.SQLiteConfig{Path: filepath.Join(t.TempDir(), "users.db")})
+	if err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	cfg.Replicas = []db.Session{broken}
+	store = NewSQLiteStore(primary, nil, NewMemoryEventBroker(), cfg, zap.NewNop())
+	if usrs, err := store.List(ctx); err != nil || len(usrs) != 1 {
+		t.Fatalf("got = %v, %v, want = %v", usrs, err, "users of the primary")
+	}
+}
+
+func TestStoreNotFound(t *testing.T) {
+	ctx := context.Background()
+	sess, err := common.TestMakeSQLiteDBSession(t.TempDir())
+	if err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	store := newStore(sess, sqliteDialect{}, nil, NewMemoryEventBroker(), StoreConfig{LocalCacheSize: 10}, zap.NewNop())
+
+	// unknown usernames are cached as not found
+	before := userLoadsTotal(t)
+	for i := 0; i < 2; i++ {
+		if _, err := store.Read(ctx, "apple"); err != ErrUserNotFound {
+			t.Fatalf("got = %v, want = %v", err, ErrUserNotFound)
+		}
+		// the not found result is cached in the background
+		time.Sleep(10 * time.Millisecond)
+	}
+	if loads := userLoadsTotal(t) - before; loads != 1 {
+		t.Fatalf("got = %v, want = %v", loads, 1)
+	}
+	if err := store.Upsert(ctx, "apple", time.Date(2000, 1, 2, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	if _, err := store.Read(ctx, "apple"); err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+
+	// usernames which are not in the Bloom filter do not reach the db
+	store.usernames = &usernameFilter{}
+	if err := store.usernames.rebuild(func() ([]string, error) { return store.listUsernames(ctx) }); err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	before = userLoadsTotal(t)
+	if _, err := store.Read(ctx, "banana"); err != ErrUserNotFound {
+		t.Fatalf("got = %v, want = %v", err, ErrUserNotFound)
+	}
+	if loads := userLoadsTotal(t) - before; loads != 0 {
+		t.Fatalf("got = %v, want = %v", loads, 0)
+	}
+	if err := store.Upsert(ctx, "banana", time.Date(2000, 1, 2, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	if _, err := store.Read(ctx, "banana"); err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+}
+
+func TestStoreCacheUnavailable(t *testing.T) {
+	ctx := context.Background()
+	sess, err := common.TestMakeSQLiteDBSession(t.TempDir())
+	if err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	store := newStore(sess, sqliteDialect{}, testUnavailableRedis(), NewMemoryEventBroker(), StoreConfig{}, zap.NewNop())
+
+	// writes succeed and reads fall back to the db
+	dob := time.Date(2000, 1, 2, 0, 0, 0, 0, time.UTC)
+	if err := store.Upsert(ctx, "apple", dob); err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	if usr, err := store.Read(ctx, "apple"); err != nil || !usr.DoB.Equal(dob) {
+		t.Fatalf("got = %v, %v, want = %v", usr, err, dob)
+	}
+	if err := store.Delete(ctx, "apple"); err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	for i := 0; i < int(cacheBreakerFailures); i++ {
+		if _, err := store.Read(ctx, "apple"); err != ErrUserNotFound {
+			t.Fatalf("got = %v, want = %v", err, ErrUserNotFound)
+		}
+	}
+	if err := store.CacheHealth(); err != ErrCacheUnavailable {
+		t.Fatalf("got = %v, want = %v", err, ErrCacheUnavailable)
+	}
+}
+
+func TestStoreUpsertEvictsLocalCache(t *testing.T) {
+	ctx := context.Background()
+	sess, err := common.TestMakeSQLiteDBSession(t.TempDir())
+	if err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	cfg := StoreConfig{LocalCacheSize: 10, LocalCacheTTL: time.Minute}
+	store := newStore(sess, sqliteDialect{}, testUnavailableRedis(), NewMemoryEventBroker(), cfg, zap.NewNop())
+	defer store.Close(ctx)
+
+	// the local tier holds the user before redis became unavailable
+	old := User{Username: "apple", DoB: time.Date(2000, 1, 2, 0, 0, 0, 0, time.UTC)}
+	store.cache.local.Add(old.Username, old)
+
+	dob := time.Date(2001, 2, 3, 0, 0, 0, 0, time.UTC)
+	if err := store.Upsert(ctx, "apple", dob); err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	if _, ok := store.cache.local.Get("apple"); ok {
+		t.Fatalf("got = %v, want = %v", "apple cached locally", "apple evicted")
+	}
+	if usr, err := store.Read(ctx, "apple"); err != nil || !usr.DoB.Equal(dob) {
+		t.Fatalf("got = %v, %v, want = %v", usr, err, dob)
+	}
+	if !store.cache.dirty["apple"] {
+		t.Fatalf("got = %v, want = %v", store.cache.dirty, "apple dirty")
+	}
+}
+
+func TestRefreshEarly(t *testing.T) {
+	cases := []struct {
+		name string
+		ttl  time.Duration
+		r    float64
+		want bool
+	}{
+		{"far from expiry", time.Minute, 0.01, false},
+		{"close to expiry", 100 * time.Millisecond, 0.5, true},
+		{"close to expiry, unlucky draw", 100 * time.Millisecond, 0.99, false},
+		{"no expiry", -1, 0.01, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := refreshEarly(tc.ttl, time.Second, tc.r); got != tc.want {
+				t.Fatalf("got = %v, want = %v", got, tc.want)
+			}
+		})
+	}
+
+	for i := 0; i < 100; i++ {
+		if ttl := cacheTTL(); ttl < DefaultCacheTTL || ttl > DefaultCacheTTL+DefaultCacheTTL/10 {
+			t.Fatalf("got = %v, want = %v", ttl, "DefaultCacheTTL with up to 10% jitter")
+		}
+	}
+}
+
+func userLoadsTotal(tb testing.TB) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		tb.Fatalf("got = %v, want = %v", err, nil)
+	}
+	for _, mf := range families {
+		if mf.GetName() == "store_user_loads_total" {
+			return mf.GetMetric()[0].GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
+// BenchmarkStoreReadConcurrent reads a user which is not cached from many
+// goroutines at once, as when a popular user expires from the cache, and
+// reports the database queries per read with and without coalescing.
+func BenchmarkStoreReadConcurrent(b *testing.B) {
+	ctx := context.Background()
+	sess, err := common.TestMakeSQLiteDBSession(b.TempDir())
+	if err != nil {
+		b.Fatalf("got = %v, want = %v", err, nil)
+	}
+	// without Redis and a local cache, every read misses the cache
+	store := newStore(sess, sqliteDialect{}, nil, NewMemoryEventBroker(), StoreConfig{}, zap.NewNop())
+	if err := store.Upsert(ctx, "apple", time.Date(2000, 1, 2, 0, 0, 0, 0, time.UTC)); err != nil {
+		b.Fatalf("got = %v, want = %v", err, nil)
+	}
+
+	cases := []struct {
+		name string
+		read func() error
+	}{
+		{"coalesced", func() error {
+			_, err := store.Read(ctx, "apple")
+			return err
+		}},
+		{"uncoalesced", func() error {
+			_, _, err := store.readDB(ctx, "apple")
+			return err
+		}},
+	}
+	for _, tc := range cases {
+		b.Run(tc.name, func(b *testing.B) {
+			before := userLoadsTotal(b)
+			b.SetParallelism(16)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if err := tc.read(); err != nil {
+						b.Errorf("got = %v, want = %v", err, nil)
+						return
+					}
+				}
+			})
+			b.ReportMetric((userLoadsTotal(b)-before)/float64(b.N), "queries/op")
+		})
+	}
+}
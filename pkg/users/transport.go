@@ -3,15 +3,21 @@ package users
 import (
 	"context"
 	"encoding/json"
+	"io"
 	"net/http"
+	"strconv"
 
 	"github.com/awhdesmond/user-service/pkg/common"
+	"github.com/awhdesmond/user-service/pkg/users/pb"
 	kithttp "github.com/go-kit/kit/transport/http"
 	"github.com/gorilla/mux"
 )
 
 const (
 	URLParamUsername = "username"
+	URLQueryDays     = "days"
+
+	DefaultUpcomingDays = 30
 )
 
 // errToHttpCode maps a specific error to a HTTP Status Code
@@ -19,6 +25,12 @@ func errToHttpCode(err error) int {
 	if common.ErrorContains([]error{ErrUserNotFound}, err) {
 		return http.StatusNotFound
 	}
+	if common.ErrorContains([]error{ErrVersionNotAcceptable}, err) {
+		return http.StatusNotAcceptable
+	}
+	if common.ErrorContains([]error{ErrCacheUnavailable}, err) {
+		return http.StatusServiceUnavailable
+	}
 	if common.ErrorContains(
 		[]error{
 			ErrDoBFutureUsed,
@@ -26,6 +38,10 @@ func errToHttpCode(err error) int {
 			ErrDoBTooOld,
 			ErrUsernameContainsNonLetters,
 			ErrUsernameIsEmpty,
+			ErrEventIDInvalid,
+			ErrDaysInvalid,
+			common.ErrInvalidJSONBody,
+			common.ErrInvalidBody,
 		},
 		err,
 	) {
@@ -38,13 +54,19 @@ func MakeHandler(svc Service) http.Handler {
 	r := mux.NewRouter()
 
 	opts := []kithttp.ServerOption{
-		kithttp.ServerErrorEncoder(common.EncodeErrorFactory(errToHttpCode)),
+		kithttp.ServerBefore(kithttp.PopulateRequestContext),
+		kithttp.ServerErrorEncoder(encodeError),
 	}
 
 	readHandler := kithttp.NewServer(
 		NewReadEndpoint(svc),
 		decodeReadRequest,
-		encodeReadResponse,
+		negotiatedEncoder(map[APIVersion]kithttp.EncodeResponseFunc{
+			APIVersion1: encodeReadResponse,
+			APIVersion2: encodeDataResponseFactory(func(resp interface{}) interface{} {
+				return resp
+			}),
+		}),
 		opts...,
 	)
 	upsertHandler := kithttp.NewServer(
@@ -54,8 +76,88 @@ func MakeHandler(svc Service) http.Handler {
 		opts...,
 	)
 
-	r.Handle("/hello/{username}", readHandler).Methods(http.MethodGet)
-	r.Handle("/hello/{username}", upsertHandler).Methods(http.MethodPut)
+	deleteHandler := kithttp.NewServer(
+		NewDeleteEndpoint(svc),
+		decodeDeleteRequest,
+		encodeDeleteResponse,
+		opts...,
+	)
+	listHandler := kithttp.NewServer(
+		NewListEndpoint(svc),
+		decodeListRequest,
+		negotiatedEncoder(map[APIVersion]kithttp.EncodeResponseFunc{
+			APIVersion1: encodeJSONResponse,
+			APIVersion2: encodeDataResponseFactory(func(resp interface{}) interface{} {
+				return resp.(ListResponse).Users
+			}),
+		}),
+		opts...,
+	)
+	upcomingHandler := kithttp.NewServer(
+		NewUpcomingEndpoint(svc),
+		decodeUpcomingRequest,
+		negotiatedEncoder(map[APIVersion]kithttp.EncodeResponseFunc{
+			APIVersion1: encodeJSONResponse,
+			APIVersion2: encodeDataResponseFactory(func(resp interface{}) interface{} {
+				return resp.(UpcomingResponse).Birthdays
+			}),
+		}),
+		opts...,
+	)
+	birthdayCalendarHandler := kithttp.NewServer(
+		NewBirthdayCalendarEndpoint(svc),
+		decodeCalendarRequest,
+		encodeCalendarResponse,
+		opts...,
+	)
+	birthdaysCalendarHandler := kithttp.NewServer(
+		NewBirthdaysCalendarEndpoint(svc),
+		decodeCalendarRequest,
+		encodeCalendarResponse,
+		opts...,
+	)
+	exportHandler := kithttp.NewServer(
+		NewExportEndpoint(svc),
+		decodeExportRequest,
+		negotiatedEncoder(map[APIVersion]kithttp.EncodeResponseFunc{
+			APIVersion1: encodeJSONResponse,
+			APIVersion2: encodeDataResponseFactory(func(resp interface{}) interface{} {
+				return resp.(ExportResponse).Export
+			}),
+		}),
+		opts...,
+	)
+	eraseHandler := kithttp.NewServer(
+		NewEraseEndpoint(svc),
+		decodeEraseRequest,
+		negotiatedEncoder(map[APIVersion]kithttp.EncodeResponseFunc{
+			APIVersion1: encodeJSONResponse,
+			APIVersion2: encodeDataResponseFactory(func(resp interface{}) interface{} {
+				return resp.(EraseResponse).Receipt
+			}),
+		}),
+		opts...,
+	)
+
+	routes := func(r *mux.Router) {
+		r.Handle("/hello", listHandler).Methods(http.MethodGet)
+		r.Handle("/hello/{username}", readHandler).Methods(http.MethodGet)
+		r.Handle("/hello/{username}", upsertHandler).Methods(http.MethodPut)
+		r.Handle("/hello/{username}", deleteHandler).Methods(http.MethodDelete)
+		r.Handle("/hello/{username}/birthday.ics", birthdayCalendarHandler).Methods(http.MethodGet)
+		r.Handle("/hello/{username}/export", exportHandler).Methods(http.MethodGet)
+		r.Handle("/hello/{username}/erase", eraseHandler).Methods(http.MethodPost)
+		r.Handle("/birthdays", upcomingHandler).Methods(http.MethodGet)
+		r.Handle("/birthdays.ics", birthdaysCalendarHandler).Methods(http.MethodGet)
+	}
+
+	r.Use(versionMiddleware)
+	routes(r.PathPrefix(APIV1Prefix).Subrouter())
+
+	// deprecated aliases of /v1
+	legacy := r.NewRoute().Subrouter()
+	legacy.Use(NewLegacyRoutesMiddleware().Handler)
+	routes(legacy)
 
 	return r
 }
@@ -66,19 +168,43 @@ func decodeReadRequest(_ context.Context, r *http.Request) (interface{}, error)
 	return req, nil
 }
 
+// encodeReadResponse encodes the message as JSON, protobuf or MessagePack depending on the Accept header
 func encodeReadResponse(ctx context.Context, w http.ResponseWriter, resp interface{}) error {
 	if e, ok := resp.(common.Errorer); ok && e.Error() != nil {
-		common.EncodeErrorFactory(errToHttpCode)(ctx, e.Error(), w)
+		encodeError(ctx, e.Error(), w)
 		return nil
 	}
+
+	msg := resp.(ReadResponse).Message
+	switch common.NegotiateMediaType(common.RequestAccept(ctx), common.MediaTypes...) {
+	case common.MediaTypeProtobuf:
+		return common.EncodeProtobuf(w, http.StatusOK, &pb.ReadResponse{Message: msg})
+	case common.MediaTypeMsgpack:
+		return common.EncodeMsgpack(w, http.StatusOK, common.GenericJSON{"message": msg})
+	}
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	return json.NewEncoder(w).Encode(resp)
 }
 
+// decodeUpsertRequest decodes a JSON, protobuf or MessagePack body depending on the Content-Type header.
+// Bodies without a Content-Type are decoded as JSON.
 func decodeUpsertRequest(_ context.Context, r *http.Request) (interface{}, error) {
 	req := UpsertRequest{}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		return nil, common.ErrInvalidJSONBody
+	switch common.MediaType(r.Header.Get("Content-Type")) {
+	case common.MediaTypeProtobuf:
+		var m pb.UpsertRequest
+		if err := common.DecodeProtobuf(r.Body, &m); err != nil {
+			return nil, common.ErrInvalidBody
+		}
+		req.DoB = m.DateOfBirth
+	case common.MediaTypeMsgpack:
+		if err := common.DecodeMsgpack(r.Body, &req); err != nil {
+			return nil, common.ErrInvalidBody
+		}
+	default:
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return nil, common.ErrInvalidJSONBody
+		}
 	}
 
 	vars := mux.Vars(r)
@@ -88,10 +214,81 @@ func decodeUpsertRequest(_ context.Context, r *http.Request) (interface{}, error
 
 func encodeUpsertResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
 	if e, ok := response.(common.Errorer); ok && e.Error() != nil {
-		common.EncodeErrorFactory(errToHttpCode)(ctx, e.Error(), w)
+		encodeError(ctx, e.Error(), w)
+		return nil
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func decodeDeleteRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	req := DeleteRequest{vars[URLParamUsername]}
+	return req, nil
+}
+
+func encodeDeleteResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	if e, ok := response.(common.Errorer); ok && e.Error() != nil {
+		encodeError(ctx, e.Error(), w)
 		return nil
 	}
 
 	w.WriteHeader(http.StatusNoContent)
 	return nil
 }
+
+func decodeListRequest(_ context.Context, _ *http.Request) (interface{}, error) {
+	return ListRequest{}, nil
+}
+
+func decodeUpcomingRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	req := UpcomingRequest{Days: DefaultUpcomingDays}
+	if v := r.URL.Query().Get(URLQueryDays); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, ErrDaysInvalid
+		}
+		req.Days = days
+	}
+	return req, nil
+}
+
+func encodeJSONResponse(ctx context.Context, w http.ResponseWriter, resp interface{}) error {
+	if e, ok := resp.(common.Errorer); ok && e.Error() != nil {
+		encodeError(ctx, e.Error(), w)
+		return nil
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	return json.NewEncoder(w).Encode(resp)
+}
+
+func decodeCalendarRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	req := CalendarRequest{vars[URLParamUsername]}
+	return req, nil
+}
+
+func encodeCalendarResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	if e, ok := response.(common.Errorer); ok && e.Error() != nil {
+		encodeError(ctx, e.Error(), w)
+		return nil
+	}
+
+	resp := response.(CalendarResponse)
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	_, err := io.WriteString(w, resp.Calendar)
+	return err
+}
+
+func decodeExportRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	req := ExportRequest{vars[URLParamUsername]}
+	return req, nil
+}
+
+func decodeEraseRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	req := EraseRequest{vars[URLParamUsername]}
+	return req, nil
+}
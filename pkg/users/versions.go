@@ -0,0 +1,128 @@
+package users
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/awhdesmond/user-service/pkg/api"
+	"github.com/awhdesmond/user-service/pkg/common"
+	kithttp "github.com/go-kit/kit/transport/http"
+)
+
+// APIVersion selects the representation of response bodies.
+// The routes and endpoints are the same for every version.
+type APIVersion int
+
+const (
+	APIVersion1 APIVersion = 1
+	// APIVersion2 wraps bodies in a {"data": ...} envelope and
+	// encodes errors as {"error": {"code": ..., "message": ...}}
+	APIVersion2 APIVersion = 2
+
+	APIV1Prefix = "/v1"
+
+	MediaTypeV1 = "application/vnd.users.v1+json"
+	MediaTypeV2 = "application/vnd.users.v2+json"
+
+	mediaTypeVendorPrefix = "application/vnd.users."
+)
+
+var (
+	ErrVersionNotAcceptable = errors.New("requested api version is not supported")
+)
+
+var (
+	// The unversioned routes are aliases of /v1 until LegacyRoutesSunsetAt
+	LegacyRoutesDeprecatedAt = time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)
+	LegacyRoutesSunsetAt     = time.Date(2027, 4, 30, 0, 0, 0, 0, time.UTC)
+)
+
+type apiVersionCtxKey struct{}
+
+// NewLegacyRoutesMiddleware marks the unversioned routes as deprecated in favour of /v1
+func NewLegacyRoutesMiddleware() *api.DeprecationMiddleware {
+	return api.NewDeprecationMiddleware(LegacyRoutesDeprecatedAt, LegacyRoutesSunsetAt, APIV1Prefix)
+}
+
+// negotiateVersion picks the version from the Accept header.
+// Clients which do not ask for a vendor media type get version 1.
+func negotiateVersion(accept string) (APIVersion, error) {
+	accepted := common.ParseAccept(accept)
+
+	vendorOnly := false
+	for _, a := range accepted {
+		switch {
+		case a.MediaType == MediaTypeV1:
+			return APIVersion1, nil
+		case a.MediaType == MediaTypeV2:
+			return APIVersion2, nil
+		case strings.HasPrefix(a.MediaType, mediaTypeVendorPrefix):
+			vendorOnly = true
+		default:
+			return APIVersion1, nil
+		}
+	}
+	if vendorOnly {
+		return 0, ErrVersionNotAcceptable
+	}
+	return APIVersion1, nil
+}
+
+// versionFromContext returns the version negotiated by versionMiddleware
+func versionFromContext(ctx context.Context) APIVersion {
+	if v, ok := ctx.Value(apiVersionCtxKey{}).(APIVersion); ok {
+		return v
+	}
+	return APIVersion1
+}
+
+// versionMiddleware negotiates the version before the request reaches
+// the endpoint, so that an unacceptable version has no side effects
+func versionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept")
+		version, err := negotiateVersion(r.Header.Get("Accept"))
+		if err != nil {
+			encodeError(r.Context(), err, w)
+			return
+		}
+		ctx := context.WithValue(r.Context(), apiVersionCtxKey{}, version)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// encodeError encodes err in the representation of the negotiated version
+func encodeError(ctx context.Context, err error, w http.ResponseWriter) {
+	if versionFromContext(ctx) == APIVersion2 {
+		common.EncodeErrorObjectFactory(errToHttpCode, MediaTypeV2)(ctx, err, w)
+		return
+	}
+	common.EncodeErrorFactory(errToHttpCode)(ctx, err, w)
+}
+
+// negotiatedEncoder lets one endpoint share encoders of several versions
+func negotiatedEncoder(encoders map[APIVersion]kithttp.EncodeResponseFunc) kithttp.EncodeResponseFunc {
+	return func(ctx context.Context, w http.ResponseWriter, resp interface{}) error {
+		if enc, ok := encoders[versionFromContext(ctx)]; ok {
+			return enc(ctx, w, resp)
+		}
+		return encoders[APIVersion1](ctx, w, resp)
+	}
+}
+
+// encodeDataResponseFactory encodes the value returned by data
+// in a version 2 {"data": ...} envelope
+func encodeDataResponseFactory(data func(interface{}) interface{}) kithttp.EncodeResponseFunc {
+	return func(ctx context.Context, w http.ResponseWriter, resp interface{}) error {
+		if e, ok := resp.(common.Errorer); ok && e.Error() != nil {
+			encodeError(ctx, e.Error(), w)
+			return nil
+		}
+		w.Header().Set("Content-Type", MediaTypeV2)
+		return json.NewEncoder(w).Encode(common.GenericJSON{"data": data(resp)})
+	}
+}
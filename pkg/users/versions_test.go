@@ -0,0 +1,138 @@
+package users
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiateVersion(t *testing.T) {
+	cases := []struct {
+		accept  string
+		want    APIVersion
+		wantErr error
+	}{
+		{"", APIVersion1, nil},
+		{"*/*", APIVersion1, nil},
+		{"application/json", APIVersion1, nil},
+		{"text/calendar", APIVersion1, nil},
+		{MediaTypeV1, APIVersion1, nil},
+		{MediaTypeV2, APIVersion2, nil},
+		{"application/json;q=0.5, " + MediaTypeV2, APIVersion2, nil},
+		{MediaTypeV2 + ";q=0.5, application/json", APIVersion1, nil},
+		{MediaTypeV2 + ";q=0, application/json", APIVersion1, nil},
+		{"application/vnd.users.v3+json, " + MediaTypeV2 + ";q=0.1", APIVersion2, nil},
+		{"application/vnd.users.v3+json, */*;q=0.1", APIVersion1, nil},
+		{"application/vnd.users.v3+json", 0, ErrVersionNotAcceptable},
+	}
+	for _, tc := range cases {
+		t.Run(tc.accept, func(t *testing.T) {
+			got, err := negotiateVersion(tc.accept)
+			if err != tc.wantErr {
+				t.Fatalf("got = %v, want = %v", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Fatalf("got = %v, want = %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestVersionedRoutes(t *testing.T) {
+	// the username is rejected before the store is used
+	handler := MakeHandler(NewService(nil, testTimeFn))
+
+	cases := []struct {
+		name            string
+		path            string
+		accept          string
+		wantCode        int
+		wantContentType string
+		wantBody        string
+		wantDeprecated  bool
+	}{
+		{
+			name:            "v1",
+			path:            "/v1/hello/app1e",
+			wantCode:        http.StatusBadRequest,
+			wantContentType: "application/json; charset=utf-8",
+			wantBody:        `{"error":"username contains non letters"}`,
+		},
+		{
+			name:            "v2",
+			path:            "/v1/hello/app1e",
+			accept:          MediaTypeV2,
+			wantCode:        http.StatusBadRequest,
+			wantContentType: MediaTypeV2,
+			wantBody:        `{"error":{"code":400,"message":"username contains non letters"}}`,
+		},
+		{
+			name:            "unsupported version",
+			path:            "/v1/hello/app1e",
+			accept:          "application/vnd.users.v3+json",
+			wantCode:        http.StatusNotAcceptable,
+			wantContentType: "application/json; charset=utf-8",
+			wantBody:        `{"error":"requested api version is not supported"}`,
+		},
+		{
+			name:            "deprecated alias",
+			path:            "/hello/app1e",
+			wantCode:        http.StatusBadRequest,
+			wantContentType: "application/json; charset=utf-8",
+			wantBody:        `{"error":"username contains non letters"}`,
+			wantDeprecated:  true,
+		},
+		{
+			name:            "deprecated alias v2",
+			path:            "/hello/app1e",
+			accept:          MediaTypeV2,
+			wantCode:        http.StatusBadRequest,
+			wantContentType: MediaTypeV2,
+			wantBody:        `{"error":{"code":400,"message":"username contains non letters"}}`,
+			wantDeprecated:  true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			if tc.accept != "" {
+				req.Header.Set("Accept", tc.accept)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tc.wantCode {
+				t.Fatalf("got = %v, want = %v", w.Code, tc.wantCode)
+			}
+			if got := w.Header().Get("Content-Type"); got != tc.wantContentType {
+				t.Fatalf("got = %v, want = %v", got, tc.wantContentType)
+			}
+			var got, want interface{}
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatalf("got = %v, want = %v", err, nil)
+			}
+			json.Unmarshal([]byte(tc.wantBody), &want)
+			gotJSON, _ := json.Marshal(got)
+			wantJSON, _ := json.Marshal(want)
+			if string(gotJSON) != string(wantJSON) {
+				t.Fatalf("got = %v, want = %v", string(gotJSON), string(wantJSON))
+			}
+
+			deprecated := w.Header().Get("Deprecation") != ""
+			if deprecated != tc.wantDeprecated {
+				t.Fatalf("got = %v, want = %v", deprecated, tc.wantDeprecated)
+			}
+			if tc.wantDeprecated {
+				wantSunset := "Fri, 30 Apr 2027 00:00:00 GMT"
+				if got := w.Header().Get("Sunset"); got != wantSunset {
+					t.Fatalf("got = %v, want = %v", got, wantSunset)
+				}
+				wantLink := `</v1/hello/app1e>; rel="successor-version"`
+				if got := w.Header().Get("Link"); got != wantLink {
+					t.Fatalf("got = %v, want = %v", got, wantLink)
+				}
+			}
+		})
+	}
+}
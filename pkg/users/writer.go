@@ -0,0 +1,142 @@
+package users
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const (
+	cacheWriteWritten      = "written"
+	cacheWriteFailed       = "failed"
+	cacheWriteDropped      = "dropped"
+	cacheWriteDeduplicated = "deduplicated"
+)
+
+var (
+	DefaultCacheWriteWorkers   = 4
+	DefaultCacheWriteQueueSize = 1024
+	DefaultCacheWriteTimeout   = time.Second
+
+	cacheWrites = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "cache",
+		Name:      "background_writes_total",
+		Help:      "users written to the cache after a miss, partitioned by result",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(cacheWrites)
+}
+
+// cacheWriter writes users to the cache in the background, after they were
+// read from the DB, with a fixed number of workers. Writes are dropped when
+// the queue is full, and a write replaces the pending write of the same user,
+// so that the cache gets the latest value once.
+type cacheWriter struct {
+	queue   chan string
+	timeout time.Duration
+	logger  *zap.Logger
+	wg      sync.WaitGroup
+	once    sync.Once
+
+	mu      sync.Mutex
+	pending map[string]func(ctx context.Context) error
+	closed  bool
+}
+
+func newCacheWriter(cfg StoreConfig, logger *zap.Logger) *cacheWriter {
+	workers := cfg.CacheWriteWorkers
+	if workers <= 0 {
+		workers = DefaultCacheWriteWorkers
+	}
+	size := cfg.CacheWriteQueueSize
+	if size <= 0 {
+		size = DefaultCacheWriteQueueSize
+	}
+	timeout := cfg.CacheWriteTimeout
+	if timeout <= 0 {
+		timeout = DefaultCacheWriteTimeout
+	}
+
+	w := &cacheWriter{
+		queue:   make(chan string, size),
+		timeout: timeout,
+		logger:  logger,
+		pending: map[string]func(ctx context.Context) error{},
+	}
+	w.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go w.work()
+	}
+	return w
+}
+
+// enqueue schedules the write of the user. It does not block, and drops
+// the write once the writer is closed.
+func (w *cacheWriter) enqueue(username string, write func(ctx context.Context) error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		cacheWrites.WithLabelValues(cacheWriteDropped).Inc()
+		return
+	}
+	if _, ok := w.pending[username]; ok {
+		w.pending[username] = write
+		cacheWrites.WithLabelValues(cacheWriteDeduplicated).Inc()
+		return
+	}
+	select {
+	case w.queue <- username:
+		w.pending[username] = write
+	default:
+		cacheWrites.WithLabelValues(cacheWriteDropped).Inc()
+	}
+}
+
+func (w *cacheWriter) work() {
+	defer w.wg.Done()
+	for username := range w.queue {
+		w.mu.Lock()
+		write := w.pending[username]
+		delete(w.pending, username)
+		w.mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), w.timeout)
+		err := write(ctx)
+		cancel()
+		if err != nil {
+			w.logger.Warn("cache error", zap.Error(err))
+			cacheWrites.WithLabelValues(cacheWriteFailed).Inc()
+			continue
+		}
+		cacheWrites.WithLabelValues(cacheWriteWritten).Inc()
+	}
+}
+
+// close stops accepting writes and waits until the queued writes are done,
+// or until ctx is done. It can be called more than once.
+func (w *cacheWriter) close(ctx context.Context) error {
+	w.once.Do(func() {
+		// enqueue checks closed under the lock, so it never sends on the closed queue
+		w.mu.Lock()
+		w.closed = true
+		close(w.queue)
+		w.mu.Unlock()
+	})
+
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,107 @@
+package users
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestCacheWriter(t *testing.T) {
+	w := newCacheWriter(StoreConfig{CacheWriteWorkers: 1, CacheWriteQueueSize: 1}, zap.NewNop())
+
+	var mu sync.Mutex
+	written := []string{}
+	write := func(value string) func(context.Context) error {
+		return func(context.Context) error {
+			mu.Lock()
+			defer mu.Unlock()
+			written = append(written, value)
+			return nil
+		}
+	}
+
+	// the only worker is busy with apple
+	started, unblock := make(chan struct{}), make(chan struct{})
+	w.enqueue("apple", func(context.Context) error {
+		close(started)
+		<-unblock
+		return nil
+	})
+	<-started
+
+	w.enqueue("banana", write("banana 1"))
+	// replaces the pending write of banana
+	w.enqueue("banana", write("banana 2"))
+	// the queue is full
+	w.enqueue("cherry", write("cherry"))
+
+	close(unblock)
+	if err := w.close(context.Background()); err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	if len(written) != 1 || written[0] != "banana 2" {
+		t.Fatalf("got = %v, want = %v", written, []string{"banana 2"})
+	}
+	// writes are dropped once closed
+	w.enqueue("durian", write("durian"))
+	if len(written) != 1 {
+		t.Fatalf("got = %v, want = %v", written, []string{"banana 2"})
+	}
+}
+
+func TestCacheWriterTimeout(t *testing.T) {
+	w := newCacheWriter(StoreConfig{CacheWriteWorkers: 1, CacheWriteTimeout: 10 * time.Millisecond}, zap.NewNop())
+
+	var err error
+	w.enqueue("apple", func(ctx context.Context) error {
+		<-ctx.Done()
+		err = ctx.Err()
+		return err
+	})
+	if err := w.close(context.Background()); err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	if err != context.DeadlineExceeded {
+		t.Fatalf("got = %v, want = %v", err, context.DeadlineExceeded)
+	}
+
+	// close gives up on the writes which do not finish in time
+	w = newCacheWriter(StoreConfig{CacheWriteWorkers: 1, CacheWriteTimeout: time.Second}, zap.NewNop())
+	w.enqueue("apple", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := w.close(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("got = %v, want = %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestCacheWriterCloseRace(t *testing.T) {
+	w := newCacheWriter(StoreConfig{CacheWriteWorkers: 2}, zap.NewNop())
+	noop := func(context.Context) error { return nil }
+
+	// writes racing with close are dropped rather than sent on the closed queue
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				w.enqueue("apple", noop)
+			}
+		}()
+	}
+	if err := w.close(context.Background()); err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+	wg.Wait()
+	// a second close, e.g. by the shutdown closers after a command closed the store
+	if err := w.close(context.Background()); err != nil {
+		t.Fatalf("got = %v, want = %v", err, nil)
+	}
+}
@@ -1,9 +1,5 @@
 #!/bin/sh
 
 DB_NAME=${1-postgres}
-flyway \
-    -url="jdbc:postgresql://127.0.0.1:5432/${DB_NAME}" \
-    -user="postgres" \
-    -password="postgres" \
-    -cleanDisabled="false" \
-    clean
+docker exec user-service-postgres-1 \
+    psql -U postgres -d "${DB_NAME}" -c 'DROP SCHEMA public CASCADE; CREATE SCHEMA public;'
@@ -1,10 +1,10 @@
 #!/bin/sh
 
 DB_NAME=${1-postgres}
-flyway \
-    -url="jdbc:postgresql://127.0.0.1:5432/${DB_NAME}" \
-    -user="postgres" \
-    -password="postgres" \
-    -locations="filesystem:db/migrations/" \
-    -validateMigrationNaming=true \
-    migrate
+USERS_SVC_STORE=postgres \
+USERS_SVC_POSTGRES_HOST=127.0.0.1 \
+USERS_SVC_POSTGRES_PORT=5432 \
+USERS_SVC_POSTGRES_USERNAME=postgres \
+USERS_SVC_POSTGRES_PASSWORD=postgres \
+USERS_SVC_POSTGRES_DATABASE="${DB_NAME}" \
+    go run ./cmd/server migrate up
@@ -0,0 +1,6 @@
+#!/bin/sh
+
+DB_PATH=${1-users.db}
+USERS_SVC_STORE=sqlite \
+USERS_SVC_SQLITE_PATH="${DB_PATH}" \
+    go run ./cmd/server migrate up